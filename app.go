@@ -1,43 +1,332 @@
 /*
-* This is a template for creating an app. It only has one command which
-* prints out the name of the app.
+* The certchain app is used to create CertChains, to log certificates in them
+* and to check whether a certificate is logged.
  */
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"gopkg.in/dedis/onet.v1/app"
 
+	"github.com/TinfoilHat0/certchain/ctlog"
+	"github.com/TinfoilHat0/certchain/gateway"
+	"github.com/TinfoilHat0/certchain/merkle_tree"
 	"github.com/TinfoilHat0/certchain/service"
+	"github.com/TinfoilHat0/certchain/staple"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 	"gopkg.in/urfave/cli.v1"
 )
 
 func main() {
 	cliApp := cli.NewApp()
-	cliApp.Name = "Template"
-	cliApp.Usage = "Used for building other apps."
+	cliApp.Name = "certchain"
+	cliApp.Usage = "Log certificates in CertChains and check them."
 	cliApp.Version = "0.1"
-	groupsDef := "the group-definition-file"
+	chainDef := "chain-id"
 	cliApp.Commands = []cli.Command{
 		{
-			Name:      "time",
-			Usage:     "measure the time to contact all nodes",
-			Aliases:   []string{"t"},
-			ArgsUsage: groupsDef,
-			Action:    cmdTime,
+			Name:  "chain",
+			Usage: "create and follow CertChains",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create",
+					Usage:     "create a new CertChain with the given certificates in the genesis block",
+					ArgsUsage: "[cert-file...]",
+					Action:    cmdChainCreate,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "DNS name or wildcard zone to bind the CertChain to",
+						},
+						cli.IntFlag{
+							Name:  "base",
+							Value: 1,
+							Usage: "base of the forward links",
+						},
+						cli.IntFlag{
+							Name:  "height",
+							Value: 1,
+							Usage: "maximum height of the forward links",
+						},
+						cli.StringFlag{
+							Name:  "policy",
+							Usage: "TOML file with the policy every block of the CertChain has to follow",
+						},
+						cli.StringFlag{
+							Name:  "issuer",
+							Usage: "PEM file with the issuing chain of the certificates, sent along with their bodies",
+						},
+					},
+				},
+				{
+					Name:      "add",
+					Usage:     "log a batch of certificates in a new block",
+					ArgsUsage: chainDef + " cert-file...",
+					Action:    cmdChainAdd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "issuer",
+							Usage: "PEM file with the issuing chain of the certificates, sent along with their bodies",
+						},
+						cli.StringFlag{
+							Name:  "attest",
+							Usage: "PEM private key of the issuer, to attest the certificates as their CA",
+						},
+						cli.StringFlag{
+							Name:  "type",
+							Value: "x509",
+							Usage: "type of the records in the files: x509, dns, ssh or pgp",
+						},
+						cli.StringFlag{
+							Name:  "delegation",
+							Usage: "delegation file, to sign the block with the keystore as a delegate of the owner",
+						},
+					},
+				},
+				{
+					Name:      "delegate",
+					Usage:     "authorize a sub-key, as printed by key, to append blocks",
+					ArgsUsage: chainDef + " key",
+					Action:    cmdChainDelegate,
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "suffix",
+							Usage: "domain under which the names of the records have to be",
+						},
+						cli.DurationFlag{
+							Name:  "expiry",
+							Usage: "how long the delegation lasts",
+						},
+						cli.IntFlag{
+							Name:  "max",
+							Usage: "largest number of certificates logged under the delegation",
+						},
+						cli.StringFlag{
+							Name:  "out",
+							Value: "delegation.ccd",
+							Usage: "file to write the delegation to",
+						},
+					},
+				},
+				{
+					Name:      "show",
+					Usage:     "show all the blocks of a CertChain",
+					ArgsUsage: chainDef,
+					Action:    cmdChainShow,
+				},
+				{
+					Name:      "head",
+					Usage:     "fetch and store the latest block of a CertChain",
+					ArgsUsage: chainDef,
+					Action:    cmdChainHead,
+				},
+				{
+					Name:      "heartbeat",
+					Usage:     "show the latest head of a CertChain signed by the roster",
+					ArgsUsage: chainDef,
+					Action:    cmdChainHeartbeat,
+				},
+			},
 		},
 		{
-			Name:      "counter",
-			Usage:     "return the counter",
-			Aliases:   []string{"t"},
-			ArgsUsage: groupsDef,
-			Action:    cmdCounter,
+			Name:  "cert",
+			Usage: "check certificates against a CertChain",
+			Subcommands: []cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "check whether a certificate is logged",
+					ArgsUsage: chainDef + " cert-file",
+					Action:    cmdCertVerify,
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "fresh",
+							Usage: "require a heartbeat of the CertChain younger than this",
+						},
+					},
+				},
+				{
+					Name:      "prove",
+					Usage:     "print the inclusion proof of a certificate",
+					ArgsUsage: chainDef + " cert-file",
+					Action:    cmdCertProve,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "out",
+							Usage: "file to write the inclusion proof to",
+						},
+					},
+				},
+				{
+					Name:      "staple",
+					Usage:     "write the CertChain proof a TLS server staples to its certificate",
+					ArgsUsage: chainDef + " cert-file",
+					Action:    cmdCertStaple,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "out",
+							Value: "proof.ccp",
+							Usage: "file to write the encoded proof to",
+						},
+					},
+				},
+				{
+					Name:      "first-seen",
+					Usage:     "print the earliest block logging a certificate and its timestamp",
+					ArgsUsage: chainDef + " cert-file",
+					Action:    cmdCertFirstSeen,
+				},
+				{
+					Name:      "revoke",
+					Usage:     "revoke logged certificates in a new block",
+					ArgsUsage: chainDef + " cert-file...",
+					Action:    cmdCertRevoke,
+				},
+				{
+					Name:      "status",
+					Usage:     "check whether a certificate is revoked",
+					ArgsUsage: chainDef + " cert-file",
+					Action:    cmdCertStatus,
+				},
+			},
+		},
+		{
+			Name:      "key",
+			Usage:     "print the owner key and how a domain publishes it",
+			ArgsUsage: "[name]",
+			Action:    cmdKey,
+		},
+		{
+			Name:      "export",
+			Usage:     "write a bundle of a CertChain that can be verified offline",
+			ArgsUsage: chainDef,
+			Action:    cmdExport,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "out",
+					Value: "bundle.bin",
+					Usage: "file to write the bundle to",
+				},
+				cli.StringSliceFlag{
+					Name:  "cert",
+					Usage: "certificate file whose body is added to the bundle",
+				},
+			},
+		},
+		{
+			Name:      "verify-bundle",
+			Usage:     "verify a bundle offline against the chain-id or the group and print a report",
+			ArgsUsage: "bundle-file",
+			Action:    cmdVerifyBundle,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "chain",
+					Usage: "hex ID of the genesis block the bundle has to start with, instead of the group",
+				},
+			},
+		},
+		{
+			Name:      "stamp",
+			Usage:     "timestamp files and write a receipt next to each of them",
+			ArgsUsage: "file...",
+			Action:    cmdStamp,
+		},
+		{
+			Name:      "verify-receipt",
+			Usage:     "verify offline that a file existed at the time of its receipt",
+			ArgsUsage: "file receipt-file",
+			Action:    cmdVerifyReceipt,
+		},
+		{
+			Name:   "monitor",
+			Usage:  "follow CertChains, audit every new block and write alerts as JSON lines",
+			Action: cmdMonitor,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "chain",
+					Usage: "ID of a CertChain to watch",
+				},
+				cli.StringSliceFlag{
+					Name:  "domain",
+					Usage: "DNS name whose CertChain is watched and whose certificates, and those of its subdomains, are reported",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: 30 * time.Second,
+					Usage: "time between two rounds of polling",
+				},
+				cli.StringFlag{
+					Name:  "alerts",
+					Usage: "file to append the alerts to instead of stdout",
+				},
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "audit the CertChains once and exit",
+				},
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "log the certificates of a dump of CT log entries, resuming an interrupted import",
+			ArgsUsage: chainDef + " dump-file",
+			Action:    cmdImport,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: ctlog.FormatJSON,
+					Usage: "format of the dump, json or raw",
+				},
+				cli.StringFlag{
+					Name:  "domain",
+					Usage: "only log the certificates for this domain and the names under it",
+				},
+				cli.IntFlag{
+					Name:  "batch",
+					Value: 100,
+					Usage: "number of certificates logged per block",
+				},
+			},
+		},
+		{
+			Name:   "gateway",
+			Usage:  "serve the CertChain service as JSON over HTTP",
+			Action: cmdGateway,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "localhost:8080",
+					Usage: "address to listen on",
+				},
+			},
 		},
 	}
 	cliApp.Flags = []cli.Flag{
 		app.FlagDebug,
+		cli.StringFlag{
+			Name:  "group, g",
+			Value: "public.toml",
+			Usage: "the group-definition-file",
+		},
+		cli.StringFlag{
+			Name:  "keystore, k",
+			Value: path.Join(os.Getenv("HOME"), ".certchain", "key.toml"),
+			Usage: "the file holding the key of the CertChain owner",
+		},
+		cli.StringFlag{
+			Name:  "state, s",
+			Value: path.Join(os.Getenv("HOME"), ".certchain", "chains"),
+			Usage: "the directory where the chain IDs and heads are kept",
+		},
 	}
 	cliApp.Before = func(c *cli.Context) error {
 		log.SetDebugVisible(c.Int("debug"))
@@ -46,37 +335,562 @@ func main() {
 	cliApp.Run(os.Args)
 }
 
-// Returns the time needed to contact all nodes.
-func cmdTime(c *cli.Context) error {
-	log.Info("Time command")
+// Creates a new CertChain and stores its genesis block as the head.
+func cmdChainCreate(c *cli.Context) error {
+	log.Info("Create command")
 	group := readGroup(c)
-	client := template.NewClient()
-	resp, err := client.Clock(group.Roster)
-	if err != nil {
-		log.Fatal("When asking the time:", err)
+	kp, err := loadOrCreateKeyPair(c.GlobalString("keystore"))
+	log.ErrFatal(err, "Couldn't load the keystore")
+	certs := readCerts(c.Args())
+	client := certchain.NewClient()
+	cb := client.CreateCertBlock(certs, make([]byte, 32), kp)
+	var policy *certchain.Policy
+	if file := c.String("policy"); file != "" {
+		policy, err = readPolicy(file)
+		log.ErrFatal(err, "Couldn't read the policy")
+	}
+	if policy != nil && policy.NeedsBodies() {
+		cb = client.CreateCertBlockWithBodies(readCertBodies(c.Args(), c.String("issuer")), make([]byte, 32), kp)
+	} else if c.String("issuer") != "" {
+		log.Fatal("The issuing chain is only sent under a policy that checks the certificates")
+	}
+	cb.Policy = policy
+	sb, cerr := client.CreateCustomSkipchain(group.Roster, c.String("name"), c.Int("base"), c.Int("height"), cb)
+	if cerr != nil {
+		log.Fatal("When creating the CertChain:", cerr)
 	}
-	log.Infof("Children: %d - Time spent: %f", resp.Children, resp.Time)
+	log.ErrFatal(saveHead(c.GlobalString("state"), sb.Hash, sb))
+	log.Infof("Created CertChain %x with %d certificates", []byte(sb.Hash), len(certs))
 	return nil
 }
 
-// Returns the number of calls.
-func cmdCounter(c *cli.Context) error {
-	log.Info("Counter command")
+// Logs the given certificates in a new block on top of the latest one.
+func cmdChainAdd(c *cli.Context) error {
+	log.Info("Add command")
+	if c.NArg() < 2 {
+		log.Fatal("Please give the chain-id and at least one certificate")
+	}
 	group := readGroup(c)
-	client := template.NewClient()
-	counter, err := client.Count(group.Roster.RandomServerIdentity())
-	if err != nil {
-		log.Fatal("When asking for counter:", err)
+	kp, err := loadKeyPair(c.GlobalString("keystore"))
+	log.ErrFatal(err, "Couldn't load the keystore")
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	head := fetchHead(c, client, group.Roster, id)
+	recordType, err := certchain.ParseRecordType(c.String("type"))
+	log.ErrFatal(err)
+	if recordType != certchain.RecordX509 {
+		cb, err := client.CreateRecordBlock(recordType, readRecords(c.Args().Tail()), certBlock(head).LatestMTR, kp)
+		log.ErrFatal(err, "Couldn't read the records")
+		addBlock(c, client, id, head, delegateBlock(c, head, cb))
+		return nil
+	}
+	certs := readCerts(c.Args().Tail())
+	cb := client.CreateCertBlock(certs, certBlock(head).LatestMTR, kp)
+	genesis, cerr := client.WalkToIndex(group.Roster, id, 0)
+	if cerr != nil {
+		log.Fatal("When fetching the genesis block:", cerr)
+	}
+	policy := certBlock(genesis[0]).Policy
+	if c.String("issuer") != "" || c.String("delegation") != "" || (policy != nil && policy.NeedsBodies()) {
+		bodies := readCertBodies(c.Args().Tail(), c.String("issuer"))
+		cb = client.CreateCertBlockWithBodies(bodies, certBlock(head).LatestMTR, kp)
+	}
+	if c.String("attest") != "" {
+		if c.String("issuer") == "" {
+			log.Fatal("Please give the issuing chain of the attested certificates with --issuer")
+		}
+		if len(cb.Certificates) == 0 || len(cb.Certificates[0].Chain) == 0 {
+			log.Fatal("Please give attested certificates and an issuing chain holding a certificate")
+		}
+		key, err := readSigningKey(c.String("attest"))
+		log.ErrFatal(err, "Couldn't read the key of the CA")
+		attestation, err := certchain.NewCAAttestation(cb, cb.Certificates[0].Chain[0], key)
+		log.ErrFatal(err, "Couldn't attest the certificates")
+		cb.Attestations = append(cb.Attestations, attestation)
 	}
-	log.Info("Number of requests:", counter)
+	addBlock(c, client, id, head, delegateBlock(c, head, cb))
 	return nil
 }
 
-func readGroup(c *cli.Context) *app.Group {
+// delegateBlock turns a CertBlock signed with the keystore into a block appended under the
+// delegation given by the flag, if any
+func delegateBlock(c *cli.Context, head *skipchain.SkipBlock, cb *certchain.CertBlock) *certchain.CertBlock {
+	if c.String("delegation") == "" {
+		return cb
+	}
+	buf, err := ioutil.ReadFile(c.String("delegation"))
+	log.ErrFatal(err, "Couldn't read the delegation")
+	_, msg, err := network.Unmarshal(buf)
+	log.ErrFatal(err, "Couldn't unmarshal the delegation")
+	d, ok := msg.(*certchain.Delegation)
+	if !ok {
+		log.Fatal(c.String("delegation"), "doesn't hold a delegation")
+	}
+	return certchain.DelegateBlock(cb, certBlock(head).PublicKey, d)
+}
+
+// Publishes a delegation to a sub-key in a new block signed by the owner.
+func cmdChainDelegate(c *cli.Context) error {
+	log.Info("Delegate command")
+	if c.NArg() != 2 {
+		log.Fatal("Please give the chain-id and the key of the delegate")
+	}
+	group := readGroup(c)
+	kp, err := loadKeyPair(c.GlobalString("keystore"))
+	log.ErrFatal(err, "Couldn't load the keystore")
+	buf, err := hex.DecodeString(c.Args().Get(1))
+	log.ErrFatal(err, "Couldn't decode the key of the delegate")
+	key := network.Suite.Point()
+	log.ErrFatal(key.UnmarshalBinary(buf), "Couldn't decode the key of the delegate")
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	head := fetchHead(c, client, group.Roster, id)
+	var expiry time.Time
+	if c.Duration("expiry") > 0 {
+		expiry = time.Now().Add(c.Duration("expiry"))
+	}
+	d := client.CreateDelegation(key, c.StringSlice("suffix"), expiry, c.Int("max"), kp)
+	if d == nil {
+		log.Fatal("Couldn't sign the delegation")
+	}
+	cb := client.CreateCertBlock(nil, certBlock(head).LatestMTR, kp)
+	cb.Delegations = []*certchain.Delegation{d}
+	addBlock(c, client, id, head, cb)
+	out, err := network.Marshal(d)
+	log.ErrFatal(err)
+	log.ErrFatal(ioutil.WriteFile(c.String("out"), out, 0644))
+	log.Info("Wrote the delegation to", c.String("out"))
+	return nil
+}
+
+// addBlock stores a CertBlock in a new block on top of head
+func addBlock(c *cli.Context, client *certchain.Client, id skipchain.SkipBlockID, head *skipchain.SkipBlock, cb *certchain.CertBlock) {
+	sb, cerr := client.AddNewTxn(head.Roster, head, cb)
+	if perr := certchain.AsPolicyError(cerr); perr != nil {
+		log.Fatalf("The policy of the CertChain rejects the block (rule %s): %s", perr.Rule, perr.Detail)
+	}
+	if cerr != nil {
+		log.Fatal("When adding the records:", cerr)
+	}
+	log.ErrFatal(saveHead(c.GlobalString("state"), id, sb))
+	log.Infof("Logged %d %s records in block %d", len(cb.Certs), cb.Type, sb.Index)
+}
+
+// Shows all the blocks of a CertChain.
+func cmdChainShow(c *cli.Context) error {
+	group := readGroup(c)
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	blocks, cerr := client.GetChain(group.Roster, id)
+	if cerr != nil {
+		log.Fatal("When fetching the CertChain:", cerr)
+	}
+	for _, sb := range blocks {
+		cb := certBlock(sb)
+		log.Infof("Block %d: %x", sb.Index, []byte(sb.Hash))
+		log.Infof("\tLatestMTR: %x", cb.LatestMTR)
+		log.Infof("\tPrevMTR: %x", cb.PrevMTR)
+		if cb.Timestamp != 0 {
+			log.Infof("\tTimestamp: %s", cb.Time().UTC().Format(time.RFC3339))
+		}
+		log.Infof("\tRecords: %d %s", len(cb.Certs), cb.Type)
+	}
+	log.ErrFatal(saveHead(c.GlobalString("state"), id, blocks[len(blocks)-1]))
+	return nil
+}
+
+// Fetches the latest block of a CertChain and stores it as the head.
+func cmdChainHead(c *cli.Context) error {
+	group := readGroup(c)
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	head := fetchHead(c, client, group.Roster, id)
+	log.ErrFatal(saveHead(c.GlobalString("state"), id, head))
+	log.Infof("Head of %x is block %d: %x", []byte(id), head.Index, []byte(head.Hash))
+	log.Infof("\tLatestMTR: %x", certBlock(head).LatestMTR)
+	return nil
+}
+
+// Shows the latest heartbeat of a CertChain.
+func cmdChainHeartbeat(c *cli.Context) error {
+	group := readGroup(c)
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	hb, cerr := client.GetHeartbeat(group.Roster, id)
+	if cerr != nil {
+		log.Fatal("When fetching the heartbeat:", cerr)
+	}
+	log.Infof("Head of %x is block %d: %x", []byte(id), hb.Head.Index, []byte(hb.Head.BlockID))
+	log.Infof("\tStated at %s, %s ago", hb.Time().Format(time.RFC3339), time.Since(hb.Time()))
+	return nil
+}
+
+// Checks whether a certificate is logged in a CertChain.
+func cmdCertVerify(c *cli.Context) error {
+	inclusion, absence := lookupCert(c)
+	if inclusion == nil {
+		log.Infof("Certificate is not logged up to block %d, signed by %s", absence.Height, absence.Signer)
+		return nil
+	}
+	log.Infof("Certificate is logged in block %d at position %d", inclusion.Block().Index, inclusion.Position)
+	return nil
+}
+
+// Prints the earliest block logging a certificate and when it was created.
+func cmdCertFirstSeen(c *cli.Context) error {
+	if c.NArg() != 2 {
+		log.Fatal("Please give the chain-id and the certificate")
+	}
+	group := readGroup(c)
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	certs := readCerts(c.Args().Tail())
+	if len(certs) != 1 {
+		log.Fatal("Please give exactly one certificate")
+	}
+	inclusion, seen, cerr := client.FirstSeen(group.Roster, id, certs[0])
+	if cerr != nil {
+		log.Fatal("When looking up the certificate:", cerr)
+	}
+	if seen.IsZero() {
+		log.Infof("Certificate is first logged in block %d, which has no timestamp", inclusion.Block().Index)
+		return nil
+	}
+	log.Infof("Certificate is first logged in block %d at %s", inclusion.Block().Index, seen.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// Prints the inclusion proof of a certificate and optionally writes it to a file.
+func cmdCertProve(c *cli.Context) error {
+	inclusion, _ := lookupCert(c)
+	if inclusion == nil {
+		log.Fatal("Certificate is not logged")
+	}
+	log.Infof("Block %d: %x", inclusion.Block().Index, []byte(inclusion.Block().Hash))
+	log.Infof("MTR: %x", certBlock(inclusion.Block()).LatestMTR)
+	log.Infof("Position: %d", inclusion.Position)
+	for i, h := range inclusion.Proof {
+		log.Infof("Proof %d: %x", i, []byte(h))
+	}
+	if out := c.String("out"); out != "" {
+		buf, err := network.Marshal(inclusion)
+		log.ErrFatal(err)
+		log.ErrFatal(writeFile(out, buf))
+	}
+	return nil
+}
+
+// Writes the encoded CertChain proof of a certificate for a TLS server.
+func cmdCertStaple(c *cli.Context) error {
+	if c.NArg() != 2 {
+		log.Fatal("Please give the chain-id and the certificate")
+	}
+	group := readGroup(c)
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	ders, err := readCertFile(c.Args().Get(1))
+	log.ErrFatal(err, "Couldn't read certificate")
+	if len(ders) == 0 {
+		log.Fatal("Please give exactly one certificate")
+	}
+	proof, err := staple.New(client, group.Roster, id, ders[0])
+	log.ErrFatal(err, "Couldn't get the proof")
+	buf, err := staple.Encode(proof)
+	log.ErrFatal(err)
+	log.ErrFatal(writeFile(c.String("out"), buf))
+	log.Infof("Wrote a proof of %d bytes, fresh until %s", len(buf),
+		proof.Heartbeat.Time().Add(staple.DefaultMaxAge).Format(time.RFC3339))
+	return nil
+}
+
+// Revokes the given certificates in a new block on top of the latest one.
+func cmdCertRevoke(c *cli.Context) error {
+	log.Info("Revoke command")
+	if c.NArg() < 2 {
+		log.Fatal("Please give the chain-id and at least one certificate")
+	}
+	group := readGroup(c)
+	kp, err := loadKeyPair(c.GlobalString("keystore"))
+	log.ErrFatal(err, "Couldn't load the keystore")
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	blocks, cerr := client.GetChain(group.Roster, id)
+	if cerr != nil {
+		log.Fatal("When fetching the CertChain:", cerr)
+	}
+	revoked, err := certchain.RevokedSet(blocks)
+	log.ErrFatal(err)
+	head := blocks[len(blocks)-1]
+	certs := readCerts(c.Args().Tail())
+	cb := client.CreateRevocationBlock(certs, revoked, certBlock(head).LatestMTR, kp)
+	sb, cerr := client.AddNewTxn(head.Roster, head, cb)
+	if cerr != nil {
+		log.Fatal("When revoking the certificates:", cerr)
+	}
+	log.ErrFatal(saveHead(c.GlobalString("state"), id, sb))
+	log.Infof("Revoked %d certificates in block %d", len(certs), sb.Index)
+	return nil
+}
+
+// Prints whether a certificate is revoked as of the latest block.
+func cmdCertStatus(c *cli.Context) error {
+	if c.NArg() != 2 {
+		log.Fatal("Please give the chain-id and the certificate")
+	}
+	group := readGroup(c)
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	certs := readCerts(c.Args().Tail())
+	if len(certs) != 1 {
+		log.Fatal("Please give exactly one certificate")
+	}
+	status, cerr := client.RevocationStatus(group.Roster, id, certs[0])
+	if cerr != nil {
+		log.Fatal("When fetching the revocation status:", cerr)
+	}
+	if status.Revoked {
+		log.Infof("Certificate is revoked as of block %d, signed by %s", status.Index, status.Signer)
+		return nil
+	}
+	log.Infof("Certificate is not revoked as of block %d, signed by %s", status.Index, status.Signer)
+	return nil
+}
+
+// Prints the owner key, creating it if needed, and the records proving control of a domain.
+func cmdKey(c *cli.Context) error {
+	kp, err := loadOrCreateKeyPair(c.GlobalString("keystore"))
+	log.ErrFatal(err, "Couldn't load the keystore")
+	key := certchain.KeyString(kp.Public)
+	log.Infof("Owner key: %s", key)
+	if c.NArg() > 0 {
+		domain := strings.TrimPrefix(c.Args().First(), "*.")
+		log.Infof("DNS: _certchain.%s. TXT \"certchain-key=%s\"", domain, key)
+		log.Infof("HTTP: http://%s/.well-known/certchain listing %s", domain, key)
+	}
+	return nil
+}
+
+// Writes the bundle of a CertChain with the optional certificate bodies.
+func cmdExport(c *cli.Context) error {
+	log.Info("Export command")
+	group := readGroup(c)
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	blocks, cerr := client.GetChain(group.Roster, id)
+	if cerr != nil {
+		log.Fatal("When fetching the CertChain:", cerr)
+	}
+	var bodies [][]byte
+	for _, file := range c.StringSlice("cert") {
+		ders, err := readCertFile(file)
+		log.ErrFatal(err, "Couldn't read certificate")
+		bodies = append(bodies, ders...)
+	}
+	bundle, err := certchain.NewBundle(group.Roster, blocks, bodies)
+	log.ErrFatal(err, "Couldn't create the bundle")
+	buf, err := network.Marshal(bundle)
+	log.ErrFatal(err)
+	log.ErrFatal(writeFile(c.String("out"), buf))
+	log.Infof("Exported %d blocks and %d certificates to %s", len(blocks), len(bodies), c.String("out"))
+	return nil
+}
+
+// Verifies a bundle without contacting the cothority.
+func cmdVerifyBundle(c *cli.Context) error {
 	if c.NArg() != 1 {
-		log.Fatal("Please give the group-file as argument")
+		log.Fatal("Please give the bundle file")
+	}
+	buf, err := ioutil.ReadFile(c.Args().First())
+	log.ErrFatal(err, "Couldn't read the bundle")
+	_, msg, err := network.Unmarshal(buf)
+	log.ErrFatal(err, "Couldn't unmarshal the bundle")
+	bundle, ok := msg.(*certchain.Bundle)
+	if !ok {
+		log.Fatal("File doesn't hold a bundle")
+	}
+	// The bundle is only trusted as far as the genesis block or the roster given by the user
+	var report *certchain.BundleReport
+	if chain := c.String("chain"); chain != "" {
+		id, err := hex.DecodeString(chain)
+		log.ErrFatal(err, "Couldn't decode the chain-id")
+		report = bundle.Verify(id, nil)
+	} else {
+		report = bundle.Verify(nil, readGroup(c).Roster)
+	}
+	log.Infof("Blocks: %d", report.Blocks)
+	log.Infof("Certificates: %d", report.Certificates)
+	log.Infof("Certificate bodies: %d", report.Bodies)
+	log.Infof("Merkle proofs: %d", report.Proofs)
+	for _, e := range report.Errors {
+		log.Error(e)
+	}
+	if !report.OK() {
+		log.Fatal("Bundle is invalid")
 	}
-	name := c.Args().First()
+	log.Info("Bundle is valid")
+	return nil
+}
+
+// Has the group timestamp the files and writes their receipts to file.receipt.
+func cmdStamp(c *cli.Context) error {
+	if c.NArg() == 0 {
+		log.Fatal("Please give the files to timestamp")
+	}
+	group := readGroup(c)
+	hashes := make([]crypto.HashID, c.NArg())
+	for i, file := range c.Args() {
+		buf, err := ioutil.ReadFile(file)
+		log.ErrFatal(err, "Couldn't read file")
+		h := sha256.Sum256(buf)
+		hashes[i] = h[:]
+	}
+	receipts, cerr := certchain.NewClient().Stamp(group.Roster, hashes)
+	if cerr != nil {
+		log.Fatal("When timestamping:", cerr)
+	}
+	for i, file := range c.Args() {
+		buf, err := network.Marshal(receipts[i])
+		log.ErrFatal(err)
+		log.ErrFatal(writeFile(file+".receipt", buf))
+		log.Infof("%s existed at %s", file, receipts[i].Time().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Verifies the receipt of a file against the group without contacting it.
+func cmdVerifyReceipt(c *cli.Context) error {
+	if c.NArg() != 2 {
+		log.Fatal("Please give the file and its receipt")
+	}
+	group := readGroup(c)
+	doc, err := ioutil.ReadFile(c.Args().Get(0))
+	log.ErrFatal(err, "Couldn't read file")
+	buf, err := ioutil.ReadFile(c.Args().Get(1))
+	log.ErrFatal(err, "Couldn't read the receipt")
+	_, msg, err := network.Unmarshal(buf)
+	log.ErrFatal(err, "Couldn't unmarshal the receipt")
+	receipt, ok := msg.(*certchain.Receipt)
+	if !ok {
+		log.Fatal("File doesn't hold a receipt")
+	}
+	if h := sha256.Sum256(doc); !bytes.Equal(h[:], receipt.Hash) {
+		log.Fatal("Receipt is about another file")
+	}
+	log.ErrFatal(receipt.Verify(group.Roster), "Receipt is invalid")
+	log.Infof("File existed at %s", receipt.Time().Format(time.RFC3339))
+	return nil
+}
+
+// Serves the CertChain service of the group as JSON over HTTP.
+func cmdGateway(c *cli.Context) error {
+	group := readGroup(c)
+	log.ErrFatal(gateway.ListenAndServe(c.String("listen"), group.Roster), "Gateway stopped")
+	return nil
+}
+
+// lookupCert asks whether the certificate given as second argument is logged
+func lookupCert(c *cli.Context) (*certchain.InclusionProof, *certchain.CertAbsence) {
+	if c.NArg() != 2 {
+		log.Fatal("Please give the chain-id and the certificate")
+	}
+	group := readGroup(c)
+	client := certchain.NewClient()
+	client.MaxHeartbeatAge = c.Duration("fresh")
+	id := readChainID(c, client, group.Roster)
+	certs := readCerts(c.Args().Tail())
+	if len(certs) != 1 {
+		log.Fatal("Please give exactly one certificate")
+	}
+	inclusion, absence, cerr := client.LookupCert(group.Roster, id, certs[0])
+	if cerr != nil {
+		log.Fatal("When looking up the certificate:", cerr)
+	}
+	return inclusion, absence
+}
+
+// fetchHead returns the latest block of the CertChain, starting from the stored head
+func fetchHead(c *cli.Context, client *certchain.Client, roster *onet.Roster, id skipchain.SkipBlockID) *skipchain.SkipBlock {
+	trusted := id
+	if head, err := loadHead(c.GlobalString("state"), id); err == nil {
+		trusted = head.Hash
+	}
+	head, cerr := client.GetLatest(roster, trusted)
+	if cerr != nil {
+		log.Fatal("When fetching the head:", cerr)
+	}
+	return head
+}
+
+// readChainID returns the chain-id given as first argument. If it isn't a hex
+// genesis ID, it is resolved as the name of the CertChain.
+func readChainID(c *cli.Context, client *certchain.Client, roster *onet.Roster) skipchain.SkipBlockID {
+	if c.NArg() < 1 {
+		log.Fatal("Please give the chain-id")
+	}
+	arg := c.Args().First()
+	if id, err := hex.DecodeString(arg); err == nil && len(id) == sha256.Size {
+		return skipchain.SkipBlockID(id)
+	}
+	id, _, cerr := client.ResolveName(roster, arg)
+	if cerr != nil {
+		log.Fatal("When resolving", arg, ":", cerr)
+	}
+	return id
+}
+
+// readCerts returns the leaves of the certificates in the given files
+func readCerts(files []string) []crypto.HashID {
+	var certs []crypto.HashID
+	for _, file := range files {
+		ders, err := readCertFile(file)
+		log.ErrFatal(err, "Couldn't read certificate")
+		for _, der := range ders {
+			certs = append(certs, certchain.LeafHash(der))
+		}
+	}
+	return certs
+}
+
+// readCertBodies returns the certificates in the files with the issuing chain in the
+// given file, if any
+func readCertBodies(files []string, issuer string) []*certchain.Certificate {
+	var chain [][]byte
+	if issuer != "" {
+		var err error
+		chain, err = readCertFile(issuer)
+		log.ErrFatal(err, "Couldn't read the issuing chain")
+	}
+	var certs []*certchain.Certificate
+	for _, file := range files {
+		ders, err := readCertFile(file)
+		log.ErrFatal(err, "Couldn't read certificate")
+		for _, der := range ders {
+			certs = append(certs, &certchain.Certificate{Raw: der, Chain: chain})
+		}
+	}
+	return certs
+}
+
+// readRecords returns the content of the files, one record per file
+func readRecords(files []string) [][]byte {
+	var records [][]byte
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		log.ErrFatal(err, "Couldn't read record")
+		records = append(records, buf)
+	}
+	return records
+}
+
+// certBlock returns the CertBlock stored in a block
+func certBlock(sb *skipchain.SkipBlock) *certchain.CertBlock {
+	_, cb, err := network.Unmarshal(sb.Data)
+	log.ErrFatal(err, "Couldn't unmarshal CertBlock")
+	return cb.(*certchain.CertBlock)
+}
+
+func readGroup(c *cli.Context) *app.Group {
+	name := c.GlobalString("group")
 	f, err := os.Open(name)
 	log.ErrFatal(err, "Couldn't open group definition file")
 	group, err := app.ReadGroupDescToml(f)
@@ -0,0 +1,266 @@
+/*
+Package ctlog reads dumps of Certificate Transparency log entries, so that
+the certificates already public in CT can be logged in a CertChain.
+
+A dump is either JSON, as returned by the get-entries call of RFC 6962: one or
+more objects holding an "entries" list, or single entries, each with the
+base64 "leaf_input" and "extra_data"; or raw, where every entry is the
+leaf_input followed by the extra_data, each prefixed by its length on three
+bytes like the vectors of RFC 6962.
+*/
+package ctlog
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// EntryType is the type of a log entry
+type EntryType uint16
+
+// Types of the log entries, as in RFC 6962
+const (
+	X509Entry EntryType = iota
+	PrecertEntry
+)
+
+// Format of a dump
+const (
+	FormatJSON = "json"
+	FormatRaw  = "raw"
+)
+
+// Entry is a parsed log entry
+type Entry struct {
+	// Index is the position of the entry in the dump
+	Index     int
+	Type      EntryType
+	Timestamp uint64
+	// Cert is the DER encoding of the certificate of an X509Entry, or of the pre-certificate of
+	// a PrecertEntry. It is nil for a PrecertEntry whose extra data is missing.
+	Cert []byte
+	// TBS is the TBSCertificate of a PrecertEntry
+	TBS []byte
+	// Chain holds the DER encodings of the certificates of the issuing chain
+	Chain [][]byte
+}
+
+// jsonEntry is the JSON encoding of a log entry, alone or in the list of get-entries
+type jsonEntry struct {
+	LeafInput []byte       `json:"leaf_input"`
+	ExtraData []byte       `json:"extra_data"`
+	Entries   []*jsonEntry `json:"entries"`
+}
+
+// Read returns all the entries of a dump in the given format
+func Read(r io.Reader, format string) ([]*Entry, error) {
+	switch format {
+	case FormatJSON:
+		return readJSON(r)
+	case FormatRaw:
+		return readRaw(r)
+	}
+	return nil, errors.New("unknown format " + format)
+}
+
+// readJSON returns the entries of a JSON dump
+func readJSON(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	add := func(je *jsonEntry) error {
+		e, err := ParseEntry(je.LeafInput, je.ExtraData)
+		if err != nil {
+			return errors.New("entry " + strconv.Itoa(len(entries)) + ": " + err.Error())
+		}
+		e.Index = len(entries)
+		entries = append(entries, e)
+		return nil
+	}
+	dec := json.NewDecoder(r)
+	for {
+		je := &jsonEntry{}
+		if err := dec.Decode(je); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if je.LeafInput != nil {
+			if err := add(je); err != nil {
+				return nil, err
+			}
+		}
+		for _, sub := range je.Entries {
+			if err := add(sub); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readRaw returns the entries of a raw dump
+func readRaw(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	br := bufio.NewReader(r)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return entries, nil
+		}
+		leaf, err := readVector(br)
+		if err != nil {
+			return nil, errors.New("entry " + strconv.Itoa(len(entries)) + ": " + err.Error())
+		}
+		extra, err := readVector(br)
+		if err != nil {
+			return nil, errors.New("entry " + strconv.Itoa(len(entries)) + ": " + err.Error())
+		}
+		e, err := ParseEntry(leaf, extra)
+		if err != nil {
+			return nil, errors.New("entry " + strconv.Itoa(len(entries)) + ": " + err.Error())
+		}
+		e.Index = len(entries)
+		entries = append(entries, e)
+	}
+}
+
+// readVector reads a vector with a length on three bytes
+func readVector(r io.Reader) ([]byte, error) {
+	var l [3]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, int(l[0])<<16|int(l[1])<<8|int(l[2]))
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// ParseEntry parses the MerkleTreeLeaf of a log entry and its extra data
+func ParseEntry(leafInput, extraData []byte) (*Entry, error) {
+	p := &parser{buf: leafInput}
+	if version := p.next(1); version != nil && version[0] != 0 {
+		return nil, errors.New("unknown version")
+	}
+	if leafType := p.next(1); leafType != nil && leafType[0] != 0 {
+		return nil, errors.New("unknown leaf type")
+	}
+	e := &Entry{}
+	if ts := p.next(8); ts != nil {
+		e.Timestamp = binary.BigEndian.Uint64(ts)
+	}
+	if et := p.next(2); et != nil {
+		e.Type = EntryType(binary.BigEndian.Uint16(et))
+	}
+	switch e.Type {
+	case X509Entry:
+		e.Cert = p.vector(3)
+	case PrecertEntry:
+		p.next(32)
+		e.TBS = p.vector(3)
+	default:
+		return nil, errors.New("unknown entry type")
+	}
+	p.vector(2)
+	if p.err != nil {
+		return nil, errors.New("malformed leaf input: " + p.err.Error())
+	}
+	if len(p.buf) != 0 {
+		return nil, errors.New("trailing data in leaf input")
+	}
+	if len(extraData) == 0 {
+		return e, nil
+	}
+	p = &parser{buf: extraData}
+	if e.Type == PrecertEntry {
+		e.Cert = p.vector(3)
+	}
+	chain := &parser{buf: p.vector(3)}
+	for len(chain.buf) > 0 && chain.err == nil {
+		e.Chain = append(e.Chain, chain.vector(3))
+	}
+	if p.err != nil || chain.err != nil {
+		return nil, errors.New("malformed extra data")
+	}
+	return e, nil
+}
+
+// Certificate parses the certificate of the entry. For a PrecertEntry it is the pre-certificate.
+func (e *Entry) Certificate() (*x509.Certificate, error) {
+	if e.Cert == nil {
+		return nil, errors.New("pre-certificate is missing from the extra data")
+	}
+	return x509.ParseCertificate(e.Cert)
+}
+
+// DER returns the encoding under which the entry is logged: the certificate, the pre-certificate
+// or, if the pre-certificate is missing, the TBSCertificate
+func (e *Entry) DER() []byte {
+	if e.Cert == nil {
+		return e.TBS
+	}
+	return e.Cert
+}
+
+// MatchesDomain returns true if one of the names of the certificate is the domain or a name
+// under it. A wildcard name also matches if it covers the domain itself.
+func (e *Entry) MatchesDomain(domain string) bool {
+	cert, err := e.Certificate()
+	if err != nil {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	names := cert.DNSNames
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = []string{cert.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if strings.HasPrefix(name, "*.") {
+			zone := name[2:]
+			if i := strings.Index(domain, "."); i >= 0 && domain[i+1:] == zone {
+				return true
+			}
+			name = zone
+		}
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// parser reads the fields of a TLS structure, remembering the first error
+type parser struct {
+	buf []byte
+	err error
+}
+
+// next returns the next n bytes
+func (p *parser) next(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.buf) < n {
+		p.err = errors.New("structure is too short")
+		return nil
+	}
+	field := p.buf[:n]
+	p.buf = p.buf[n:]
+	return field
+}
+
+// vector returns the next vector, whose length is on size bytes
+func (p *parser) vector(size int) []byte {
+	l := p.next(size)
+	if l == nil {
+		return nil
+	}
+	n := 0
+	for _, b := range l {
+		n = n<<8 | int(b)
+	}
+	return p.next(n)
+}
@@ -0,0 +1,119 @@
+package ctlog
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadJSON(t *testing.T) {
+	www := newCert(t, "www.example.com")
+	other := newCert(t, "www.example.org")
+	dump, err := json.Marshal(&jsonEntry{Entries: []*jsonEntry{
+		{LeafInput: leafInput(X509Entry, www), ExtraData: vector(3, vector(3, other))},
+		{LeafInput: leafInput(X509Entry, other)},
+	}})
+	assert.Nil(t, err)
+	single, err := json.Marshal(&jsonEntry{LeafInput: leafInput(PrecertEntry, []byte("tbs")),
+		ExtraData: append(vector(3, www), vector(3, nil)...)})
+	assert.Nil(t, err)
+
+	entries, err := Read(bytes.NewReader(append(dump, single...)), FormatJSON)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, www, entries[0].Cert)
+	assert.Equal(t, [][]byte{other}, entries[0].Chain)
+	assert.Equal(t, uint64(1234), entries[0].Timestamp)
+	assert.Equal(t, 1, entries[1].Index)
+	assert.Equal(t, PrecertEntry, entries[2].Type)
+	assert.Equal(t, []byte("tbs"), entries[2].TBS)
+	assert.Equal(t, www, entries[2].Cert)
+
+	assert.True(t, entries[0].MatchesDomain("example.com"))
+	assert.True(t, entries[0].MatchesDomain("www.example.com."))
+	assert.False(t, entries[0].MatchesDomain("ww.example.com"))
+	assert.False(t, entries[1].MatchesDomain("example.com"))
+	assert.True(t, entries[2].MatchesDomain("example.com"))
+}
+
+func TestReadRaw(t *testing.T) {
+	wildcard := newCert(t, "*.example.com")
+	var dump []byte
+	dump = append(dump, vector(3, leafInput(X509Entry, wildcard))...)
+	dump = append(dump, vector(3, vector(3, nil))...)
+	dump = append(dump, vector(3, leafInput(PrecertEntry, []byte("tbs")))...)
+	dump = append(dump, vector(3, nil)...)
+
+	entries, err := Read(bytes.NewReader(dump), FormatRaw)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.True(t, entries[0].MatchesDomain("example.com"))
+	assert.True(t, entries[0].MatchesDomain("www.example.com"))
+	assert.False(t, entries[0].MatchesDomain("a.www.example.com"))
+	assert.Nil(t, entries[1].Cert)
+	assert.False(t, entries[1].MatchesDomain("example.com"))
+
+	_, err = Read(bytes.NewReader(dump[:len(dump)-5]), FormatRaw)
+	assert.NotNil(t, err)
+	_, err = Read(bytes.NewReader(dump), "xml")
+	assert.NotNil(t, err)
+}
+
+func TestParseEntry(t *testing.T) {
+	leaf := leafInput(X509Entry, []byte("cert"))
+	_, err := ParseEntry(leaf[:len(leaf)-1], nil)
+	assert.NotNil(t, err)
+	_, err = ParseEntry(append(leaf, 0), nil)
+	assert.NotNil(t, err)
+	leaf[0] = 1
+	_, err = ParseEntry(leaf, nil)
+	assert.NotNil(t, err)
+}
+
+// leafInput returns the MerkleTreeLeaf of an entry
+func leafInput(typ EntryType, der []byte) []byte {
+	buf := []byte{0, 0}
+	buf = append(buf, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(buf[2:], 1234)
+	buf = append(buf, byte(typ>>8), byte(typ))
+	if typ == PrecertEntry {
+		buf = append(buf, make([]byte, 32)...)
+	}
+	buf = append(buf, vector(3, der)...)
+	return append(buf, vector(2, nil)...)
+}
+
+// vector prefixes buf with its length on size bytes
+func vector(size int, buf []byte) []byte {
+	l := make([]byte, size)
+	for i, n := size-1, len(buf); i >= 0; i, n = i-1, n>>8 {
+		l[i] = byte(n)
+	}
+	return append(l, buf...)
+}
+
+// newCert returns the DER encoding of a self-signed certificate for the name
+func newCert(t *testing.T, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	return der
+}
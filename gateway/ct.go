@@ -0,0 +1,298 @@
+package gateway
+
+/*
+The ct.go serves every CertChain as a log with calls shaped after the read API
+of RFC 6962, section 4. The base URL of the log of a CertChain is /logs/{chain},
+for example
+
+	GET /logs/{chain}/ct/v1/get-sth
+	GET /logs/{chain}/ct/v1/get-sth-consistency?first=&second=
+	GET /logs/{chain}/ct/v1/get-proof-by-hash?hash=&tree_size=
+	GET /logs/{chain}/ct/v1/get-entries?start=&end=
+
+The tree and its proofs are computed with the Merkle tree hashing of RFC 6962,
+but the log is not a Certificate Transparency log and CT clients can't consume
+it: an entry is the leaf under which a certificate is logged, in the order it
+is logged, not a MerkleTreeLeaf, and the tree head is signed by a conode with
+its Schnorr key over SignedTreeHead.Hash, not as a TreeHeadSignature.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// ctPrefix of the paths of the CT logs
+const ctPrefix = "/logs/"
+
+// maxEntries is the largest number of entries returned by get-entries
+const maxEntries = 256
+
+// maxLogs is the largest number of logs whose entries are cached
+const maxLogs = 64
+
+// STH is the reply to get-sth. Signature is the Schnorr signature of the conode given by Signer
+// and PublicKey over SignedTreeHead.Hash, which also covers the CertChain and Index.
+type STH struct {
+	TreeSize  int    `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"`
+	RootHash  string `json:"sha256_root_hash"`
+	Signature string `json:"signature"`
+	Index     int    `json:"index"`
+	Signer    string `json:"signer"`
+	PublicKey string `json:"public_key"`
+}
+
+// ConsistencyProof is the reply to get-sth-consistency
+type ConsistencyProof struct {
+	Consistency []string `json:"consistency"`
+}
+
+// AuditProof is the reply to get-proof-by-hash
+type AuditProof struct {
+	LeafIndex int      `json:"leaf_index"`
+	AuditPath []string `json:"audit_path"`
+}
+
+// Entry is a log entry returned by get-entries: the leaf under which a certificate is logged
+type Entry struct {
+	Leaf string `json:"leaf"`
+}
+
+// Entries is the reply to get-entries
+type Entries struct {
+	Entries []*Entry `json:"entries"`
+}
+
+// serveCT dispatches a request to the CT log of a CertChain
+func (g *Gateway) serveCT(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, ctPrefix), "/")
+	if len(parts) != 4 || parts[1] != "ct" || parts[2] != "v1" || req.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, certchain.ErrorParameter, "unknown endpoint "+req.Method+" "+req.URL.Path)
+		return
+	}
+	id, cerr := g.chainID(parts[0])
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	switch parts[3] {
+	case "get-sth":
+		g.getSTH(w, id)
+	case "get-sth-consistency":
+		g.getConsistency(w, req, id)
+	case "get-proof-by-hash":
+		g.getProofByHash(w, req, id)
+	case "get-entries":
+		g.getEntries(w, req, id)
+	default:
+		writeError(w, http.StatusNotFound, certchain.ErrorParameter, "unknown endpoint "+parts[3])
+	}
+}
+
+// getSTH returns the signed tree head, after checking it against the entries of the CertChain
+func (g *Gateway) getSTH(w http.ResponseWriter, id skipchain.SkipBlockID) {
+	sth, cerr := g.client.GetSTH(g.roster, id)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	entries, cerr := g.entries(id)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	if sth.TreeSize > len(entries) ||
+		!bytes.Equal(crypto.RFC6962Root(certchain.CTLeaves(entries[:sth.TreeSize])), sth.RootHash) {
+		writeError(w, http.StatusBadGateway, certchain.ErrorVerification, "tree head doesn't match the CertChain")
+		return
+	}
+	reply := &STH{
+		TreeSize:  sth.TreeSize,
+		Timestamp: sth.Timestamp,
+		RootHash:  base64.StdEncoding.EncodeToString(sth.RootHash),
+		Signature: base64.StdEncoding.EncodeToString(sth.Signature),
+		Index:     sth.Index,
+		Signer:    string(sth.Signer.Address),
+	}
+	if buf, err := sth.Signer.Public.MarshalBinary(); err == nil {
+		reply.PublicKey = base64.StdEncoding.EncodeToString(buf)
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// getConsistency returns the consistency proof between two tree sizes
+func (g *Gateway) getConsistency(w http.ResponseWriter, req *http.Request, id skipchain.SkipBlockID) {
+	first, err := intParam(req, "first")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	second, err := intParam(req, "second")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	leaves, cerr := g.leaves(id, second)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	proof, err := crypto.RFC6962ConsistencyProof(leaves, first)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &ConsistencyProof{encodeBase64(proof)})
+}
+
+// getProofByHash returns the audit path of the first entry with the given leaf hash
+func (g *Gateway) getProofByHash(w http.ResponseWriter, req *http.Request, id skipchain.SkipBlockID) {
+	hash, err := base64.StdEncoding.DecodeString(req.URL.Query().Get("hash"))
+	if err != nil || len(hash) == 0 {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, "invalid hash")
+		return
+	}
+	size, err := intParam(req, "tree_size")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	leaves, cerr := g.leaves(id, size)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	for i, leaf := range leaves {
+		if bytes.Equal(leaf, hash) {
+			path, _ := crypto.RFC6962InclusionProof(leaves, i)
+			writeJSON(w, http.StatusOK, &AuditProof{i, encodeBase64(path)})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, certchain.ErrorParameter, "no entry with this hash in the tree")
+}
+
+// getEntries returns the entries from start to end, both included
+func (g *Gateway) getEntries(w http.ResponseWriter, req *http.Request, id skipchain.SkipBlockID) {
+	start, err := intParam(req, "start")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	end, err := intParam(req, "end")
+	if err != nil || end < start {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, "invalid end")
+		return
+	}
+	entries, cerr := g.entries(id)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	if start >= len(entries) {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, "start is past the last entry")
+		return
+	}
+	if end >= len(entries) {
+		end = len(entries) - 1
+	}
+	if end-start >= maxEntries {
+		end = start + maxEntries - 1
+	}
+	reply := &Entries{}
+	for _, entry := range entries[start : end+1] {
+		reply.Entries = append(reply.Entries, &Entry{Leaf: base64.StdEncoding.EncodeToString(entry)})
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// ctLog is the cached log of a CertChain: its entries up to the latest verified block
+type ctLog struct {
+	head    *skipchain.SkipBlock
+	entries []crypto.HashID
+	used    time.Time
+}
+
+// entries returns the entries of the log of a CertChain. The entries up to the latest verified
+// block are cached and only the new blocks are fetched, without holding the lock.
+func (g *Gateway) entries(id skipchain.SkipBlockID) ([]crypto.HashID, onet.ClientError) {
+	g.logsMutex.Lock()
+	cached := g.logs[string(id)]
+	g.logsMutex.Unlock()
+	from := id
+	var entries []crypto.HashID
+	if cached != nil {
+		from = cached.head.Hash
+		entries = cached.entries[:len(cached.entries):len(cached.entries)]
+	}
+	update, cerr := g.client.GetChain(g.roster, from)
+	if cerr != nil {
+		return nil, cerr
+	}
+	head := update[len(update)-1]
+	if cached != nil {
+		update = update[1:]
+	}
+	added, err := certchain.CTEntries(update)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(certchain.ErrorVerification, err.Error())
+	}
+	entries = append(entries, added...)
+	g.logsMutex.Lock()
+	defer g.logsMutex.Unlock()
+	if current := g.logs[string(id)]; current == nil || current.head.Index < head.Index {
+		g.logs[string(id)] = &ctLog{head: head, entries: entries}
+	}
+	g.logs[string(id)].used = time.Now()
+	if len(g.logs) > maxLogs {
+		var oldest string
+		for key, l := range g.logs {
+			if oldest == "" || l.used.Before(g.logs[oldest].used) {
+				oldest = key
+			}
+		}
+		delete(g.logs, oldest)
+	}
+	return entries, nil
+}
+
+// leaves returns the leaf hashes of the tree of the given size of a CertChain
+func (g *Gateway) leaves(id skipchain.SkipBlockID, size int) ([]crypto.HashID, onet.ClientError) {
+	entries, cerr := g.entries(id)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if size <= 0 || size > len(entries) {
+		return nil, onet.NewClientErrorCode(certchain.ErrorParameter, "tree size out of the log")
+	}
+	return certchain.CTLeaves(entries[:size]), nil
+}
+
+// intParam returns the non-negative integer of a query parameter
+func intParam(req *http.Request, name string) (int, error) {
+	i, err := strconv.Atoi(req.URL.Query().Get(name))
+	if err != nil || i < 0 {
+		return 0, errors.New("invalid " + name)
+	}
+	return i, nil
+}
+
+// encodeBase64 returns the base64 encodings of the hashes
+func encodeBase64(hashes []crypto.HashID) []string {
+	strs := make([]string, len(hashes))
+	for i, h := range hashes {
+		strs[i] = base64.StdEncoding.EncodeToString(h)
+	}
+	return strs
+}
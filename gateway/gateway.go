@@ -0,0 +1,279 @@
+/*
+Package gateway serves the CertChain service as JSON over HTTP, for clients
+that can't speak to the conodes directly. It is started by the certchain app
+or embedded in a conode with ListenAndServe.
+
+The endpoints are:
+
+	POST /v1/chains                          create a CertChain from a CreateRequest
+	POST /v1/chains/{chain}/blocks           append the CertBlock of an AppendRequest
+	GET  /v1/chains/{chain}/head             return the latest block
+	GET  /v1/chains/{chain}/certs/{leaf}     tell whether a certificate is logged
+	GET  /v1/chains/{chain}/certs/{leaf}/proof  return the inclusion proof of a certificate
+
+Every CertChain is also served as a log with calls shaped after the read API
+of Certificate Transparency under /logs/{chain}, see ct.go.
+
+A chain is given by the hex ID of its genesis block or by the name it is bound
+to, a leaf by the hex hash under which the certificate is logged.
+*/
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// prefix of all the paths served by the gateway
+const prefix = "/v1/chains"
+
+// maxBodySize is the largest request body accepted by the gateway
+const maxBodySize = 1 << 20
+
+// Gateway is an http.Handler forwarding the requests to the conodes of a roster
+type Gateway struct {
+	client *certchain.Client
+	roster *onet.Roster
+	// logs caches the entries of the CertChains served as logs
+	logs      map[string]*ctLog
+	logsMutex sync.Mutex
+}
+
+// New returns a gateway forwarding the requests to the given roster
+func New(r *onet.Roster) *Gateway {
+	return &Gateway{
+		client: certchain.NewClient(),
+		roster: r,
+		logs:   make(map[string]*ctLog),
+	}
+}
+
+// ListenAndServe serves the gateway for the roster on the given address
+func ListenAndServe(addr string, r *onet.Roster) error {
+	log.Lvl1("Serving the CertChain gateway on", addr)
+	return http.ListenAndServe(addr, New(r))
+}
+
+// ServeHTTP dispatches a request to its handler
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, ctPrefix) {
+		g.serveCT(w, req)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		writeError(w, http.StatusNotFound, certchain.ErrorParameter, "unknown path")
+		return
+	}
+	var parts []string
+	if rest := strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/"); rest != "" {
+		parts = strings.Split(rest, "/")
+	}
+	switch {
+	case len(parts) == 0 && req.Method == http.MethodPost:
+		g.create(w, req)
+	case len(parts) == 2 && parts[1] == "blocks" && req.Method == http.MethodPost:
+		g.append(w, req, parts[0])
+	case len(parts) == 2 && parts[1] == "head" && req.Method == http.MethodGet:
+		g.head(w, parts[0])
+	case len(parts) == 3 && parts[1] == "certs" && req.Method == http.MethodGet:
+		g.lookup(w, parts[0], parts[2])
+	case len(parts) == 4 && parts[1] == "certs" && parts[3] == "proof" && req.Method == http.MethodGet:
+		g.proof(w, parts[0], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, certchain.ErrorParameter, "unknown endpoint "+req.Method+" "+req.URL.Path)
+	}
+}
+
+// create creates a new CertChain
+func (g *Gateway) create(w http.ResponseWriter, req *http.Request) {
+	cr := &CreateRequest{}
+	if err := readJSON(w, req, cr); err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	if cr.CertBlock == nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, "cert_block is needed")
+		return
+	}
+	cb, err := cr.CertBlock.Decode()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	sb, cerr := g.client.CreateCustomSkipchain(g.roster, cr.Name, cr.BaseHeight, cr.MaximumHeight, cb)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	writeBlock(w, sb.Hash, sb)
+}
+
+// append adds a CertBlock on top of the latest block of a CertChain
+func (g *Gateway) append(w http.ResponseWriter, req *http.Request, chain string) {
+	ar := &AppendRequest{}
+	if err := readJSON(w, req, ar); err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	if ar.CertBlock == nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, "cert_block is needed")
+		return
+	}
+	cb, err := ar.CertBlock.Decode()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	id, latest, cerr := g.latest(chain)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	sb, cerr := g.client.AddNewTxn(latest.Roster, latest, cb)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	writeBlock(w, id, sb)
+}
+
+// head returns the latest block of a CertChain
+func (g *Gateway) head(w http.ResponseWriter, chain string) {
+	id, latest, cerr := g.latest(chain)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	writeBlock(w, id, latest)
+}
+
+// lookup tells whether a certificate is logged in a CertChain
+func (g *Gateway) lookup(w http.ResponseWriter, chain, leaf string) {
+	id, cerr := g.chainID(chain)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	cert, err := decodeHex("leaf", leaf)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	inclusion, absence, cerr := g.client.LookupCert(g.roster, id, cert)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	if inclusion != nil {
+		writeJSON(w, http.StatusOK, &LookupResponse{Logged: true, Index: inclusion.Block().Index, Position: inclusion.Position})
+		return
+	}
+	writeJSON(w, http.StatusOK, &LookupResponse{Absence: NewCertAbsence(absence)})
+}
+
+// proof returns the inclusion proof of a certificate logged in a CertChain
+func (g *Gateway) proof(w http.ResponseWriter, chain, leaf string) {
+	id, cerr := g.chainID(chain)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	cert, err := decodeHex("leaf", leaf)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, certchain.ErrorParameter, err.Error())
+		return
+	}
+	inclusion, _, cerr := g.client.LookupCert(g.roster, id, cert)
+	if cerr != nil {
+		writeClientError(w, cerr)
+		return
+	}
+	if inclusion == nil {
+		writeError(w, http.StatusNotFound, certchain.ErrorParameter, "certificate is not logged")
+		return
+	}
+	proof, err := NewInclusionProof(cert, inclusion)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, certchain.ErrorVerification, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, proof)
+}
+
+// chainID returns the ID of a CertChain given by its hex ID or by its name. Only hex strings
+// of the length of an ID are taken as IDs.
+func (g *Gateway) chainID(chain string) (skipchain.SkipBlockID, onet.ClientError) {
+	if id, err := hex.DecodeString(chain); err == nil && len(id) == sha256.Size {
+		return id, nil
+	}
+	id, _, cerr := g.client.ResolveName(g.roster, chain)
+	return id, cerr
+}
+
+// latest returns the ID and the verified latest block of a CertChain
+func (g *Gateway) latest(chain string) (skipchain.SkipBlockID, *skipchain.SkipBlock, onet.ClientError) {
+	id, cerr := g.chainID(chain)
+	if cerr != nil {
+		return nil, nil, cerr
+	}
+	latest, cerr := g.client.GetLatest(g.roster, id)
+	return id, latest, cerr
+}
+
+// readJSON decodes the body of the request into msg
+func readJSON(w http.ResponseWriter, req *http.Request, msg interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize)).Decode(msg); err != nil {
+		return errors.New("invalid JSON body: " + err.Error())
+	}
+	return nil
+}
+
+// writeBlock writes a block of a CertChain
+func writeBlock(w http.ResponseWriter, id skipchain.SkipBlockID, sb *skipchain.SkipBlock) {
+	block, err := NewSkipBlock(sb)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, certchain.ErrorVerification, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &BlockResponse{hex.EncodeToString(id), block})
+}
+
+// writeClientError writes an error returned by the conodes with a matching HTTP status
+func writeClientError(w http.ResponseWriter, err onet.ClientError) {
+	status := http.StatusBadGateway
+	switch err.ErrorCode() {
+	case certchain.ErrorParameter, certchain.ErrorSignature:
+		status = http.StatusBadRequest
+	case certchain.ErrorUnknownChain, certchain.ErrorUnknownName, certchain.ErrorUnknownMTR:
+		status = http.StatusNotFound
+	case certchain.ErrorNameTaken, certchain.ErrorSpent:
+		status = http.StatusConflict
+	case certchain.ErrorTimeout:
+		status = http.StatusGatewayTimeout
+	}
+	writeError(w, status, err.ErrorCode(), err.ErrorMsg())
+}
+
+// writeError writes an ErrorResponse
+func writeError(w http.ResponseWriter, status, code int, msg string) {
+	writeJSON(w, status, &ErrorResponse{code, msg})
+}
+
+// writeJSON writes msg as the JSON body of the response
+func writeJSON(w http.ResponseWriter, status int, msg interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		log.Error("Couldn't write response:", err)
+	}
+}
@@ -0,0 +1,164 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestGateway(t *testing.T) {
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	server := httptest.NewServer(New(roster))
+	defer server.Close()
+
+	client := certchain.NewClient()
+	kp := config.NewKeyPair(network.Suite)
+	certs := client.GenerateCertificates(3)
+	cb := client.CreateCertBlock(certs, make([]byte, 32), kp)
+	created := &BlockResponse{}
+	status := post(server.URL+"/v1/chains", &CreateRequest{CertBlock: NewCertBlock(cb), Name: "www.example.com"}, created)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 0, created.Block.Index)
+	assert.Equal(t, created.Chain, created.Block.Hash)
+	genesis, err := created.Block.Decode()
+	log.ErrFatal(err)
+	assert.Nil(t, certchain.VerifyGenesis(genesis))
+
+	// Appending on top of the genesis block, once
+	next := client.CreateCertBlock(client.GenerateCertificates(2), cb.LatestMTR, kp)
+	appended := &BlockResponse{}
+	status = post(server.URL+"/v1/chains/"+created.Chain+"/blocks", &AppendRequest{NewCertBlock(next)}, appended)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, appended.Block.Index)
+	assert.Equal(t, hex.EncodeToString(next.LatestMTR), appended.Block.CertBlock.LatestMTR)
+	failed := &ErrorResponse{}
+	status = post(server.URL+"/v1/chains/"+created.Chain+"/blocks", &AppendRequest{NewCertBlock(next)}, failed)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, certchain.ErrorSpent, failed.Code)
+
+	head := &BlockResponse{}
+	assert.Equal(t, http.StatusOK, get(server.URL+"/v1/chains/www.example.com/head", head))
+	assert.Equal(t, appended.Block.Hash, head.Block.Hash)
+
+	leaf := hex.EncodeToString(certs[1])
+	lookup := &LookupResponse{}
+	assert.Equal(t, http.StatusOK, get(server.URL+"/v1/chains/"+created.Chain+"/certs/"+leaf, lookup))
+	assert.True(t, lookup.Logged)
+	assert.Equal(t, 1, lookup.Position)
+	unknown := hex.EncodeToString(client.GenerateCertificates(1)[0])
+	lookup = &LookupResponse{}
+	assert.Equal(t, http.StatusOK, get(server.URL+"/v1/chains/"+created.Chain+"/certs/"+unknown, lookup))
+	assert.False(t, lookup.Logged)
+	assert.Equal(t, 1, lookup.Absence.Height)
+
+	proof := &InclusionProof{}
+	assert.Equal(t, http.StatusOK, get(server.URL+"/v1/chains/"+created.Chain+"/certs/"+leaf+"/proof", proof))
+	cert, inclusion, err := proof.Decode()
+	log.ErrFatal(err)
+	_, err = inclusion.Verify(genesis.Hash, crypto.HashID(cert))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, get(server.URL+"/v1/chains/"+created.Chain+"/certs/"+unknown+"/proof", &ErrorResponse{}))
+
+	assert.Equal(t, http.StatusBadRequest, post(server.URL+"/v1/chains", &CreateRequest{}, &ErrorResponse{}))
+	assert.Equal(t, http.StatusNotFound, get(server.URL+"/v1/chains/unknown.example.com/head", &ErrorResponse{}))
+	assert.Equal(t, http.StatusNotFound, get(server.URL+"/v1/other", &ErrorResponse{}))
+}
+
+func TestCT(t *testing.T) {
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	server := httptest.NewServer(New(roster))
+	defer server.Close()
+
+	client := certchain.NewClient()
+	kp := config.NewKeyPair(network.Suite)
+	certs := client.GenerateCertificates(5)
+	cb := client.CreateCertBlock(certs, make([]byte, 32), kp)
+	genesis, err := client.CreateSkipchain(roster, cb)
+	log.ErrFatal(err)
+	base := server.URL + "/logs/" + hex.EncodeToString(genesis.Hash) + "/ct/v1/"
+
+	first := &STH{}
+	assert.Equal(t, http.StatusOK, get(base+"get-sth", first))
+	assert.Equal(t, 5, first.TreeSize)
+	firstRoot := decodeBase64([]string{first.RootHash})[0]
+	assert.Equal(t, crypto.RFC6962Root(certchain.CTLeaves(certs)), firstRoot)
+
+	entries := &Entries{}
+	assert.Equal(t, http.StatusOK, get(base+"get-entries?start=1&end=10", entries))
+	assert.Equal(t, 4, len(entries.Entries))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(certs[1]), entries.Entries[0].Leaf)
+
+	leaf := crypto.RFC6962LeafHash(certs[3])
+	audit := &AuditProof{}
+	assert.Equal(t, http.StatusOK, get(base+"get-proof-by-hash?tree_size=5&hash="+
+		url.QueryEscape(base64.StdEncoding.EncodeToString(leaf)), audit))
+	assert.Equal(t, 3, audit.LeafIndex)
+	assert.Nil(t, crypto.RFC6962VerifyInclusion(leaf, 3, 5, firstRoot, decodeBase64(audit.AuditPath)))
+
+	cb = client.CreateCertBlock(client.GenerateCertificates(3), cb.LatestMTR, kp)
+	_, err = client.AddNewTxn(roster, genesis, cb)
+	log.ErrFatal(err)
+	second := &STH{}
+	assert.Equal(t, http.StatusOK, get(base+"get-sth", second))
+	assert.Equal(t, 8, second.TreeSize)
+	assert.Equal(t, 1, second.Index)
+	secondRoot := decodeBase64([]string{second.RootHash})[0]
+	consistency := &ConsistencyProof{}
+	assert.Equal(t, http.StatusOK, get(base+"get-sth-consistency?first=5&second=8", consistency))
+	assert.Nil(t, crypto.RFC6962VerifyConsistency(5, 8, firstRoot, secondRoot, decodeBase64(consistency.Consistency)))
+
+	assert.Equal(t, http.StatusBadRequest, get(base+"get-sth-consistency?first=5&second=9", &ErrorResponse{}))
+	assert.Equal(t, http.StatusNotFound, get(base+"get-roots", &ErrorResponse{}))
+}
+
+// decodeBase64 returns the hashes of the base64 encodings
+func decodeBase64(strs []string) []crypto.HashID {
+	hashes := make([]crypto.HashID, len(strs))
+	for i, str := range strs {
+		buf, err := base64.StdEncoding.DecodeString(str)
+		log.ErrFatal(err)
+		hashes[i] = buf
+	}
+	return hashes
+}
+
+// post sends msg as JSON and decodes the reply, returning the HTTP status
+func post(url string, msg, reply interface{}) int {
+	buf, err := json.Marshal(msg)
+	log.ErrFatal(err)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(buf))
+	log.ErrFatal(err)
+	defer resp.Body.Close()
+	log.ErrFatal(json.NewDecoder(resp.Body).Decode(reply))
+	return resp.StatusCode
+}
+
+// get decodes the reply to a GET request, returning the HTTP status
+func get(url string, reply interface{}) int {
+	resp, err := http.Get(url)
+	log.ErrFatal(err)
+	defer resp.Body.Close()
+	log.ErrFatal(json.NewDecoder(resp.Body).Decode(reply))
+	return resp.StatusCode
+}
@@ -0,0 +1,313 @@
+package gateway
+
+/*
+The json.go defines the stable JSON encodings used by the gateway. All byte
+strings, hashes and points are hex encoded. A block also carries its raw
+network encoding, so that clients linking the cothority libraries can check
+its hash and forward links.
+*/
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// CertBlock is the JSON encoding of a certchain.CertBlock
+type CertBlock struct {
+	LatestSignedMTR string   `json:"latest_signed_mtr"`
+	LatestMTR       string   `json:"latest_mtr"`
+	PrevMTR         string   `json:"prev_mtr"`
+	PublicKey       string   `json:"public_key"`
+	Certs           []string `json:"certs"`
+	// Timestamp is in milliseconds since the epoch
+	Timestamp      int64    `json:"timestamp,omitempty"`
+	Type           string   `json:"type,omitempty"`
+	Revoked        []string `json:"revoked,omitempty"`
+	RevocationRoot string   `json:"revocation_root,omitempty"`
+}
+
+// SkipBlock is the JSON encoding of a block of a CertChain
+type SkipBlock struct {
+	Hash          string     `json:"hash"`
+	Index         int        `json:"index"`
+	Height        int        `json:"height"`
+	BaseHeight    int        `json:"base_height"`
+	MaximumHeight int        `json:"maximum_height"`
+	GenesisID     string     `json:"genesis_id"`
+	BackLinks     []string   `json:"back_links"`
+	ForwardLinks  []string   `json:"forward_links"`
+	Roster        []string   `json:"roster"`
+	CertBlock     *CertBlock `json:"cert_block"`
+	Raw           string     `json:"raw"`
+}
+
+// InclusionProof is the JSON encoding of a certchain.InclusionProof. Blocks go from the
+// genesis block to the block holding the certificate.
+type InclusionProof struct {
+	Cert     string       `json:"cert"`
+	Blocks   []*SkipBlock `json:"blocks"`
+	Position int          `json:"position"`
+	Proof    []string     `json:"proof"`
+}
+
+// CertAbsence is the JSON encoding of a certchain.CertAbsence
+type CertAbsence struct {
+	Chain     string `json:"chain"`
+	Cert      string `json:"cert"`
+	Height    int    `json:"height"`
+	BlockID   string `json:"block_id"`
+	Signer    string `json:"signer"`
+	Public    string `json:"public"`
+	Signature string `json:"signature"`
+}
+
+// CreateRequest is the body of a request creating a CertChain
+type CreateRequest struct {
+	CertBlock     *CertBlock `json:"cert_block"`
+	Name          string     `json:"name,omitempty"`
+	BaseHeight    int        `json:"base_height,omitempty"`
+	MaximumHeight int        `json:"maximum_height,omitempty"`
+}
+
+// AppendRequest is the body of a request appending a CertBlock to a CertChain
+type AppendRequest struct {
+	CertBlock *CertBlock `json:"cert_block"`
+}
+
+// BlockResponse holds a block of a CertChain
+type BlockResponse struct {
+	Chain string     `json:"chain"`
+	Block *SkipBlock `json:"block"`
+}
+
+// LookupResponse tells whether a certificate is logged. If it is, Index and Position give
+// where, otherwise Absence is the signed statement of a node.
+type LookupResponse struct {
+	Logged   bool         `json:"logged"`
+	Index    int          `json:"index"`
+	Position int          `json:"position"`
+	Absence  *CertAbsence `json:"absence,omitempty"`
+}
+
+// ErrorResponse is returned with every failed request
+type ErrorResponse struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+// NewCertBlock returns the JSON encoding of a CertBlock
+func NewCertBlock(cb *certchain.CertBlock) *CertBlock {
+	c := &CertBlock{
+		LatestSignedMTR: hex.EncodeToString(cb.LatestSignedMTR),
+		LatestMTR:       hex.EncodeToString(cb.LatestMTR),
+		PrevMTR:         hex.EncodeToString(cb.PrevMTR),
+		Certs:           encodeHashes(cb.Certs),
+		Timestamp:       cb.Timestamp,
+		Revoked:         encodeHashes(cb.Revoked),
+		RevocationRoot:  hex.EncodeToString(cb.RevocationRoot),
+	}
+	if len(c.Revoked) == 0 {
+		c.Revoked = nil
+	}
+	if cb.Type != certchain.RecordX509 {
+		c.Type = cb.Type.String()
+	}
+	if cb.PublicKey != nil {
+		if buf, err := cb.PublicKey.MarshalBinary(); err == nil {
+			c.PublicKey = hex.EncodeToString(buf)
+		}
+	}
+	return c
+}
+
+// Decode returns the CertBlock of the JSON encoding
+func (c *CertBlock) Decode() (*certchain.CertBlock, error) {
+	cb := &certchain.CertBlock{}
+	var err error
+	if cb.LatestSignedMTR, err = decodeHex("latest_signed_mtr", c.LatestSignedMTR); err != nil {
+		return nil, err
+	}
+	if cb.LatestMTR, err = decodeHex("latest_mtr", c.LatestMTR); err != nil {
+		return nil, err
+	}
+	if cb.PrevMTR, err = decodeHex("prev_mtr", c.PrevMTR); err != nil {
+		return nil, err
+	}
+	buf, err := decodeHex("public_key", c.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	cb.PublicKey = network.Suite.Point()
+	if err := cb.PublicKey.UnmarshalBinary(buf); err != nil {
+		return nil, errors.New("invalid public_key: " + err.Error())
+	}
+	for _, cert := range c.Certs {
+		leaf, err := decodeHex("certs", cert)
+		if err != nil {
+			return nil, err
+		}
+		cb.Certs = append(cb.Certs, leaf)
+	}
+	cb.Timestamp = c.Timestamp
+	if c.Type != "" {
+		if cb.Type, err = certchain.ParseRecordType(c.Type); err != nil {
+			return nil, errors.New("invalid type: " + err.Error())
+		}
+	}
+	for _, cert := range c.Revoked {
+		leaf, err := decodeHex("revoked", cert)
+		if err != nil {
+			return nil, err
+		}
+		cb.Revoked = append(cb.Revoked, leaf)
+	}
+	if c.RevocationRoot != "" {
+		if cb.RevocationRoot, err = decodeHex("revocation_root", c.RevocationRoot); err != nil {
+			return nil, err
+		}
+	}
+	return cb, nil
+}
+
+// NewSkipBlock returns the JSON encoding of a block of a CertChain
+func NewSkipBlock(sb *skipchain.SkipBlock) (*SkipBlock, error) {
+	raw, err := network.Marshal(sb)
+	if err != nil {
+		return nil, err
+	}
+	cb, err := certchain.ExtractCertBlock(sb)
+	if err != nil {
+		return nil, err
+	}
+	b := &SkipBlock{
+		Hash:          hex.EncodeToString(sb.Hash),
+		Index:         sb.Index,
+		Height:        sb.Height,
+		BaseHeight:    sb.BaseHeight,
+		MaximumHeight: sb.MaximumHeight,
+		GenesisID:     hex.EncodeToString(sb.GenesisID),
+		CertBlock:     NewCertBlock(cb),
+		Raw:           hex.EncodeToString(raw),
+	}
+	for _, id := range sb.BackLinkIDs {
+		b.BackLinks = append(b.BackLinks, hex.EncodeToString(id))
+	}
+	for _, link := range sb.ForwardLink {
+		b.ForwardLinks = append(b.ForwardLinks, hex.EncodeToString(link.Hash))
+	}
+	if sb.Roster != nil {
+		for _, si := range sb.Roster.List {
+			b.Roster = append(b.Roster, string(si.Address))
+		}
+	}
+	return b, nil
+}
+
+// Decode returns the block of the JSON encoding, read from its raw encoding
+func (b *SkipBlock) Decode() (*skipchain.SkipBlock, error) {
+	raw, err := decodeHex("raw", b.Raw)
+	if err != nil {
+		return nil, err
+	}
+	_, msg, err := network.Unmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	sb, ok := msg.(*skipchain.SkipBlock)
+	if !ok {
+		return nil, errors.New("raw doesn't hold a skipblock")
+	}
+	return sb, nil
+}
+
+// NewInclusionProof returns the JSON encoding of an inclusion proof of a certificate
+func NewInclusionProof(cert crypto.HashID, p *certchain.InclusionProof) (*InclusionProof, error) {
+	blocks, err := newSkipBlocks(p.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	return &InclusionProof{
+		Cert:     hex.EncodeToString(cert),
+		Blocks:   blocks,
+		Position: p.Position,
+		Proof:    encodeHashes(p.Proof),
+	}, nil
+}
+
+// Decode returns the certificate and the inclusion proof of the JSON encoding
+func (p *InclusionProof) Decode() (crypto.HashID, *certchain.InclusionProof, error) {
+	cert, err := decodeHex("cert", p.Cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof := &certchain.InclusionProof{Position: p.Position}
+	for _, b := range p.Blocks {
+		sb, err := b.Decode()
+		if err != nil {
+			return nil, nil, err
+		}
+		proof.Blocks = append(proof.Blocks, sb)
+	}
+	for _, h := range p.Proof {
+		node, err := decodeHex("proof", h)
+		if err != nil {
+			return nil, nil, err
+		}
+		proof.Proof = append(proof.Proof, node)
+	}
+	return cert, proof, nil
+}
+
+// NewCertAbsence returns the JSON encoding of a statement that a certificate is not logged
+func NewCertAbsence(a *certchain.CertAbsence) *CertAbsence {
+	c := &CertAbsence{
+		Chain:     hex.EncodeToString(a.SkipchainID),
+		Cert:      hex.EncodeToString(a.Cert),
+		Height:    a.Height,
+		BlockID:   hex.EncodeToString(a.BlockID),
+		Signature: hex.EncodeToString(a.Signature),
+	}
+	if a.Signer != nil {
+		c.Signer = string(a.Signer.Address)
+		if buf, err := a.Signer.Public.MarshalBinary(); err == nil {
+			c.Public = hex.EncodeToString(buf)
+		}
+	}
+	return c
+}
+
+// newSkipBlocks returns the JSON encodings of the blocks
+func newSkipBlocks(sbs []*skipchain.SkipBlock) ([]*SkipBlock, error) {
+	blocks := make([]*SkipBlock, len(sbs))
+	for i, sb := range sbs {
+		b, err := NewSkipBlock(sb)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = b
+	}
+	return blocks, nil
+}
+
+// encodeHashes returns the hex encodings of the hashes
+func encodeHashes(hashes []crypto.HashID) []string {
+	strs := make([]string, len(hashes))
+	for i, h := range hashes {
+		strs[i] = hex.EncodeToString(h)
+	}
+	return strs
+}
+
+// decodeHex decodes the hex string of a field, naming the field in the error
+func decodeHex(field, str string) ([]byte, error) {
+	buf, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, errors.New("invalid " + field + ": " + err.Error())
+	}
+	return buf, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+/*
+The import.go seeds a CertChain with the certificates of a dump of CT log
+entries. The progress is kept in the state directory before every block is
+submitted, so that an interrupted import resumes without logging a batch twice.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/TinfoilHat0/certchain/ctlog"
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// importState is the progress of the import of a dump into a CertChain
+type importState struct {
+	// Next is the index of the first entry of the dump that isn't logged yet
+	Next int
+	// PendingNext and PendingMTR describe the block being submitted: once a block with
+	// PendingMTR is in the CertChain, Next becomes PendingNext
+	PendingNext int
+	PendingMTR  string
+}
+
+// Logs the certificates of a CT dump in a CertChain.
+func cmdImport(c *cli.Context) error {
+	if c.NArg() != 2 {
+		log.Fatal("Please give the chain-id and the dump file")
+	}
+	if c.Int("batch") < 1 {
+		log.Fatal("The batch size must be positive")
+	}
+	group := readGroup(c)
+	kp, err := loadKeyPair(c.GlobalString("keystore"))
+	log.ErrFatal(err, "Couldn't load the keystore")
+	client := certchain.NewClient()
+	id := readChainID(c, client, group.Roster)
+	dump := c.Args().Get(1)
+	f, err := os.Open(dump)
+	log.ErrFatal(err, "Couldn't open the dump")
+	entries, err := ctlog.Read(f, c.String("format"))
+	f.Close()
+	log.ErrFatal(err, "Couldn't read the dump")
+
+	file := importFile(c.GlobalString("state"), id, dump)
+	state := &importState{}
+	if _, err := os.Stat(file); err == nil {
+		_, err := toml.DecodeFile(file, state)
+		log.ErrFatal(err, "Couldn't read the import state")
+	}
+	head := fetchHead(c, client, group.Roster, id)
+	if state.PendingMTR != "" {
+		if hex.EncodeToString(certBlock(head).LatestMTR) == state.PendingMTR {
+			state.Next = state.PendingNext
+		}
+		state.PendingNext, state.PendingMTR = 0, ""
+	}
+	if state.Next > 0 {
+		log.Infof("Resuming the import at entry %d", state.Next)
+	}
+
+	// The CertChain may already log certificates of the dump, e.g. from another dump
+	blocks, cerr := client.GetChain(group.Roster, id)
+	if cerr != nil {
+		log.Fatal("When fetching the CertChain:", cerr)
+	}
+	chainEntries, err := certchain.CTEntries(blocks)
+	log.ErrFatal(err, "Couldn't read the CertChain")
+	inChain := make(map[string]bool, len(chainEntries))
+	for _, entry := range chainEntries {
+		inChain[string(entry)] = true
+	}
+
+	domain := c.String("domain")
+	seen := make(map[string]bool)
+	var batch []crypto.HashID
+	logged, skipped, present := 0, 0, 0
+	for i, e := range entries {
+		if domain != "" && !e.MatchesDomain(domain) {
+			continue
+		}
+		leaf := certchain.LeafHash(e.DER())
+		if seen[string(leaf)] {
+			skipped++
+			continue
+		}
+		seen[string(leaf)] = true
+		if i < state.Next {
+			continue
+		}
+		if inChain[string(leaf)] {
+			present++
+			continue
+		}
+		batch = append(batch, leaf)
+		if len(batch) == c.Int("batch") {
+			head = submitBatch(client, kp, head, batch, state, file, i+1)
+			logged += len(batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		head = submitBatch(client, kp, head, batch, state, file, len(entries))
+		logged += len(batch)
+	}
+	log.ErrFatal(saveHead(c.GlobalString("state"), id, head))
+	log.Infof("Logged %d certificates, skipped %d duplicates and %d already logged, head is block %d",
+		logged, skipped, present, head.Index)
+	return nil
+}
+
+// submitBatch logs a batch of certificates in a new block on top of head. The block is
+// recorded as pending before it is submitted and next is stored as the progress afterwards.
+func submitBatch(client *certchain.Client, kp *config.KeyPair, head *skipchain.SkipBlock, batch []crypto.HashID,
+	state *importState, file string, next int) *skipchain.SkipBlock {
+	cb := client.CreateCertBlock(batch, certBlock(head).LatestMTR, kp)
+	state.PendingNext, state.PendingMTR = next, hex.EncodeToString(cb.LatestMTR)
+	log.ErrFatal(saveImportState(file, state), "Couldn't save the import state")
+	sb, cerr := client.AddNewTxn(head.Roster, head, cb)
+	if cerr != nil {
+		log.Fatal("When logging the certificates:", cerr)
+	}
+	state.Next, state.PendingNext, state.PendingMTR = next, 0, ""
+	log.ErrFatal(saveImportState(file, state), "Couldn't save the import state")
+	log.Lvlf1("Logged %d certificates in block %d", len(batch), sb.Index)
+	return sb
+}
+
+// importFile returns the file keeping the progress of the import of a dump into a CertChain.
+// It depends on the content of the dump, so that another dump starts from scratch.
+func importFile(dir string, id []byte, dump string) string {
+	f, err := os.Open(dump)
+	log.ErrFatal(err, "Couldn't open the dump")
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	log.ErrFatal(err, "Couldn't read the dump")
+	return path.Join(dir, "import", hex.EncodeToString(id)+"-"+hex.EncodeToString(h.Sum(nil))[:16]+".toml")
+}
+
+// saveImportState stores the progress of an import
+func saveImportState(file string, state *importState) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(state); err != nil {
+		return err
+	}
+	return writeFile(file, buf.Bytes())
+}
@@ -0,0 +1,91 @@
+/*
+Package testutil holds the helpers shared by the tests of the CertChain
+packages: certificates to log, and nodes that sign heartbeats often enough
+for the proofs to be checked right away. It is only imported by tests.
+*/
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// MainTest runs the tests with nodes signing a heartbeat every 200ms, as the proofs need
+// heartbeats and the tests can't wait 30 seconds for them
+func MainTest(m *testing.M) {
+	os.Setenv("CERTCHAIN_HEARTBEAT_INTERVAL", "200ms")
+	log.MainTest(m)
+}
+
+// WaitHeartbeat waits until getHeartbeat, e.g. a GetHeartbeat of the CertChain by a client,
+// finds a heartbeat signed by the roster
+func WaitHeartbeat(t testing.TB, getHeartbeat func() error) {
+	for i := 0; i < 50; i++ {
+		if getHeartbeat() == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("no heartbeat")
+}
+
+// NewCA returns the DER encoding and the key of a self-signed CA certificate with the name,
+// valid for a day
+func NewCA(t testing.TB, name string) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
+
+// NewCertificate returns the DER encoding of a certificate for the names, valid for the
+// duration. It is issued by the CA given by its DER encoding and key, or self-signed if caKey
+// is nil.
+func NewCertificate(t testing.TB, caDER []byte, caKey *ecdsa.PrivateKey, validity time.Duration, names ...string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(validity),
+	}
+	issuer, signer := template, key
+	if caKey != nil {
+		if issuer, err = x509.ParseCertificate(caDER); err != nil {
+			t.Fatal(err)
+		}
+		signer = caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
@@ -0,0 +1,192 @@
+package crypto
+
+/*
+The rfc6962.go implements the position-aware Merkle tree of Certificate
+Transparency (RFC 6962, section 2.1). Unlike ProofTree it doesn't sort the
+children of a node and it separates leaves from nodes with a prefix, so that
+audit paths and consistency proofs can be checked by CT tooling.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// Prefixes separating the hashes of leaves and of nodes
+const (
+	rfc6962LeafPrefix = 0
+	rfc6962NodePrefix = 1
+)
+
+// RFC6962LeafHash returns the hash of a leaf holding data
+func RFC6962LeafHash(data []byte) HashID {
+	h := sha256.New()
+	h.Write([]byte{rfc6962LeafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// RFC6962NodeHash returns the hash of the node with the given children
+func RFC6962NodeHash(left, right HashID) HashID {
+	h := sha256.New()
+	h.Write([]byte{rfc6962NodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// RFC6962Root returns the root of the tree with the given leaf hashes
+func RFC6962Root(leaves []HashID) HashID {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return RFC6962NodeHash(RFC6962Root(leaves[:k]), RFC6962Root(leaves[k:]))
+}
+
+// RFC6962InclusionProof returns the audit path of the leaf at index in the tree with the
+// given leaf hashes, from the leaf to the root
+func RFC6962InclusionProof(leaves []HashID, index int) ([]HashID, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, errors.New("index out of the tree")
+	}
+	return auditPath(leaves, index), nil
+}
+
+// auditPath is PATH(m, D[n]) of RFC 6962
+func auditPath(leaves []HashID, m int) []HashID {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(auditPath(leaves[:k], m), RFC6962Root(leaves[k:]))
+	}
+	return append(auditPath(leaves[k:], m-k), RFC6962Root(leaves[:k]))
+}
+
+// RFC6962VerifyInclusion checks the audit path of the leaf at index in the tree of the given
+// size and root
+func RFC6962VerifyInclusion(leaf HashID, index, size int, root HashID, path []HashID) error {
+	if index < 0 || index >= size {
+		return errors.New("index out of the tree")
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return errors.New("audit path is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = RFC6962NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = RFC6962NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("audit path is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("audit path doesn't lead to the root")
+	}
+	return nil
+}
+
+// RFC6962ConsistencyProof returns the proof that the tree with the first size leaves is a
+// prefix of the tree with all the given leaf hashes
+func RFC6962ConsistencyProof(leaves []HashID, size int) ([]HashID, error) {
+	if size <= 0 || size > len(leaves) {
+		return nil, errors.New("size out of the tree")
+	}
+	return subProof(leaves, size, true), nil
+}
+
+// subProof is SUBPROOF(m, D[n], b) of RFC 6962
+func subProof(leaves []HashID, m int, complete bool) []HashID {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return nil
+		}
+		return []HashID{RFC6962Root(leaves)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(subProof(leaves[:k], m, complete), RFC6962Root(leaves[k:]))
+	}
+	return append(subProof(leaves[k:], m-k, false), RFC6962Root(leaves[:k]))
+}
+
+// RFC6962VerifyConsistency checks that the tree of size first with root firstRoot is a prefix
+// of the tree of size second with root secondRoot
+func RFC6962VerifyConsistency(first, second int, firstRoot, secondRoot HashID, proof []HashID) error {
+	switch {
+	case first <= 0 || first > second:
+		return errors.New("sizes are not increasing")
+	case first == second:
+		if len(proof) != 0 {
+			return errors.New("proof must be empty for equal sizes")
+		}
+		if !bytes.Equal(firstRoot, secondRoot) {
+			return errors.New("roots differ for equal sizes")
+		}
+		return nil
+	}
+	if first&(first-1) == 0 {
+		// The first tree is a complete subtree, so its root starts the proof
+		proof = append([]HashID{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return errors.New("proof is empty")
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New("proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = RFC6962NodeHash(c, fr)
+			sr = RFC6962NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = RFC6962NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("proof is too short")
+	}
+	if !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errors.New("proof doesn't lead to the roots")
+	}
+	return nil
+}
+
+// splitPoint returns the largest power of two smaller than n, for n > 1
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
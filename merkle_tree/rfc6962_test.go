@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Leaves and roots of the test vectors of the Certificate Transparency reference implementation
+var rfc6962Inputs = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657",
+	"606162636465666768696a6b6c6d6e6f"}
+
+var rfc6962Roots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func rfc6962Leaves(t *testing.T) []HashID {
+	leaves := make([]HashID, len(rfc6962Inputs))
+	for i, in := range rfc6962Inputs {
+		data, err := hex.DecodeString(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves[i] = RFC6962LeafHash(data)
+	}
+	return leaves
+}
+
+func TestRFC6962Root(t *testing.T) {
+	if root := hex.EncodeToString(RFC6962Root(nil)); root != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Error("wrong root of the empty tree:", root)
+	}
+	leaves := rfc6962Leaves(t)
+	for i, expected := range rfc6962Roots {
+		if root := hex.EncodeToString(RFC6962Root(leaves[:i+1])); root != expected {
+			t.Error("wrong root for", i+1, "leaves:", root)
+		}
+	}
+}
+
+func TestRFC6962InclusionProof(t *testing.T) {
+	leaves := rfc6962Leaves(t)
+	for size := 1; size <= len(leaves); size++ {
+		root := RFC6962Root(leaves[:size])
+		for index := 0; index < size; index++ {
+			path, err := RFC6962InclusionProof(leaves[:size], index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := RFC6962VerifyInclusion(leaves[index], index, size, root, path); err != nil {
+				t.Error("leaf", index, "of", size, ":", err)
+			}
+			if index > 0 && RFC6962VerifyInclusion(leaves[index], index-1, size, root, path) == nil {
+				t.Error("wrong index accepted for leaf", index, "of", size)
+			}
+		}
+	}
+	if _, err := RFC6962InclusionProof(leaves, len(leaves)); err == nil {
+		t.Error("index out of the tree accepted")
+	}
+}
+
+func TestRFC6962ConsistencyProof(t *testing.T) {
+	leaves := rfc6962Leaves(t)
+	for second := 1; second <= len(leaves); second++ {
+		secondRoot := RFC6962Root(leaves[:second])
+		for first := 1; first <= second; first++ {
+			firstRoot := RFC6962Root(leaves[:first])
+			proof, err := RFC6962ConsistencyProof(leaves[:second], first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := RFC6962VerifyConsistency(first, second, firstRoot, secondRoot, proof); err != nil {
+				t.Error("from", first, "to", second, ":", err)
+			}
+			if first < second && RFC6962VerifyConsistency(first, second, secondRoot, secondRoot, proof) == nil {
+				t.Error("wrong root accepted from", first, "to", second)
+			}
+		}
+	}
+}
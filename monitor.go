@@ -0,0 +1,271 @@
+package main
+
+/*
+The monitor.go follows a set of CertChains and audits every new block. The
+last audited block of every CertChain is kept as a checkpoint in the state
+directory, along with the equivocation evidence already reported, so that the
+monitor resumes where it stopped.
+*/
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Levels of the alerts
+const (
+	alertInfo     = "info"
+	alertWarning  = "warning"
+	alertCritical = "critical"
+)
+
+// alert is written as one JSON line for every event found by the monitor
+type alert struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Chain   string    `json:"chain"`
+	Domain  string    `json:"domain,omitempty"`
+	Index   int       `json:"index"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// monitor holds the state of the monitor while it runs
+type monitor struct {
+	client *certchain.Client
+	roster *onet.Roster
+	dir    string
+	out    *json.Encoder
+	// names are the watched domains, whose certificates are reported in every CertChain
+	names []string
+	// domains maps the hex ID of the CertChains bound to a watched domain to the domain
+	domains map[string]string
+	// evidence maps the hex ID of a CertChain to the hashes of the equivocation evidence that
+	// has been reported for it
+	evidence map[string]map[string]bool
+}
+
+// Follows CertChains and audits every new block.
+func cmdMonitor(c *cli.Context) error {
+	group := readGroup(c)
+	var out io.Writer = os.Stdout
+	if file := c.String("alerts"); file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		log.ErrFatal(err, "Couldn't open the alerts file")
+		defer f.Close()
+		out = f
+	}
+	m := &monitor{
+		client:   certchain.NewClient(),
+		roster:   group.Roster,
+		dir:      path.Join(c.GlobalString("state"), "monitor"),
+		out:      json.NewEncoder(out),
+		names:    c.StringSlice("domain"),
+		domains:  make(map[string]string),
+		evidence: make(map[string]map[string]bool),
+	}
+	var chains []skipchain.SkipBlockID
+	for _, arg := range c.StringSlice("chain") {
+		id, err := hex.DecodeString(arg)
+		log.ErrFatal(err, "Invalid chain-id", arg)
+		chains = append(chains, id)
+	}
+	if len(chains) == 0 && len(c.StringSlice("domain")) == 0 {
+		log.Fatal("Please give at least one chain or domain to watch")
+	}
+	for {
+		watched := append([]skipchain.SkipBlockID{}, chains...)
+		for _, domain := range c.StringSlice("domain") {
+			id, _, cerr := m.client.ResolveName(m.roster, domain)
+			if cerr != nil {
+				m.alert(alertWarning, nil, 0, "resolve", "Couldn't resolve "+domain+": "+cerr.Error())
+				continue
+			}
+			m.domains[hex.EncodeToString(id)] = domain
+			watched = append(watched, id)
+		}
+		for _, id := range watched {
+			m.audit(id)
+		}
+		if c.Bool("once") {
+			return nil
+		}
+		time.Sleep(c.Duration("interval"))
+	}
+}
+
+// audit checks all the blocks of a CertChain after the checkpoint and moves the checkpoint
+func (m *monitor) audit(id skipchain.SkipBlockID) {
+	trusted := id
+	checkpoint, err := loadHead(m.dir, id)
+	if err == nil {
+		trusted = checkpoint.Hash
+	}
+	blocks, cerr := m.client.GetChain(m.roster, trusted)
+	if cerr != nil {
+		m.alert(alertCritical, id, 0, "fetch", "Couldn't fetch a valid chain: "+cerr.Error())
+		return
+	}
+	if checkpoint == nil {
+		if err := certchain.VerifyGenesis(blocks[0]); err != nil {
+			m.alert(alertCritical, id, 0, "genesis", err.Error())
+			return
+		}
+		m.checkCerts(id, blocks[0])
+	}
+	for i := 1; i < len(blocks); i++ {
+		prev, sb := blocks[i-1], blocks[i]
+		if err := certchain.VerifyBlockLink(prev, sb); err != nil {
+			m.alert(alertCritical, id, sb.Index, "block", err.Error())
+			return
+		}
+		cbPrev, _ := certchain.ExtractCertBlock(prev)
+		cb, _ := certchain.ExtractCertBlock(sb)
+		if !cbPrev.PublicKey.Equal(cb.PublicKey) {
+			m.alert(alertWarning, id, sb.Index, "key-change", "Owner key changed to "+cb.PublicKey.String())
+		}
+		if prev.Roster.ID != sb.Roster.ID {
+			m.alert(alertWarning, id, sb.Index, "roster-change", "Roster of the CertChain changed")
+		}
+		m.checkCerts(id, sb)
+		if err := saveHead(m.dir, id, sb); err != nil {
+			log.Error("Couldn't save the checkpoint:", err)
+		}
+	}
+	if checkpoint == nil {
+		if err := saveHead(m.dir, id, blocks[len(blocks)-1]); err != nil {
+			log.Error("Couldn't save the checkpoint:", err)
+		}
+	}
+	m.checkEvidence(id)
+}
+
+// checkCerts reports the certificates of a block whose names are under a watched domain. The
+// certificates logged without their body can't be matched, they are only counted for the
+// CertChain bound to a watched domain.
+func (m *monitor) checkCerts(id skipchain.SkipBlockID, sb *skipchain.SkipBlock) {
+	if len(m.names) == 0 {
+		return
+	}
+	cb, err := certchain.ExtractCertBlock(sb)
+	if err != nil || len(cb.Certs) == 0 {
+		return
+	}
+	for i, c := range cb.Certificates {
+		if c == nil || i >= len(cb.Certs) {
+			continue
+		}
+		for _, name := range certchain.RecordNames(cb.Type, c.Raw) {
+			if m.watched(name) {
+				m.alert(alertInfo, id, sb.Index, "certificate", "Certificate "+hex.EncodeToString(cb.Certs[i])+
+					" logged for "+name)
+				break
+			}
+		}
+	}
+	_, bound := m.domains[hex.EncodeToString(id)]
+	if missing := len(cb.Certs) - len(cb.Certificates); bound && missing > 0 {
+		m.alert(alertInfo, id, sb.Index, "certificate", strconv.Itoa(missing)+
+			" certificates logged without their body, their names can't be checked")
+	}
+}
+
+// watched returns true if the name is a watched domain or under one
+func (m *monitor) watched(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range m.names {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEvidence reports the equivocation evidence that hasn't been reported yet
+func (m *monitor) checkEvidence(id skipchain.SkipBlockID) {
+	evidence, cerr := m.client.GetEvidence(m.roster, id)
+	if cerr != nil {
+		m.alert(alertWarning, id, 0, "evidence", "Couldn't fetch the evidence: "+cerr.Error())
+		return
+	}
+	reported := m.reportedEvidence(id)
+	for _, e := range evidence {
+		hash, err := e.Hash()
+		if err != nil {
+			continue
+		}
+		key := hex.EncodeToString(hash)
+		if reported[key] {
+			continue
+		}
+		reported[key] = true
+		m.alert(alertCritical, id, 0, "equivocation", "Owner signed two MTRs on top of "+
+			hex.EncodeToString(e.First.PrevMTR)+", reported by "+e.Reporter.String())
+		if err := m.saveEvidence(id, reported); err != nil {
+			log.Error("Couldn't save the reported evidence:", err)
+		}
+	}
+}
+
+// evidenceFile returns the file listing the evidence reported for a CertChain
+func (m *monitor) evidenceFile(id skipchain.SkipBlockID) string {
+	return path.Join(m.dir, hex.EncodeToString(id)+".evidence")
+}
+
+// reportedEvidence returns the hex hashes of the evidence reported for a CertChain, read from
+// the state directory the first time
+func (m *monitor) reportedEvidence(id skipchain.SkipBlockID) map[string]bool {
+	chain := hex.EncodeToString(id)
+	if reported, ok := m.evidence[chain]; ok {
+		return reported
+	}
+	reported := make(map[string]bool)
+	if buf, err := ioutil.ReadFile(m.evidenceFile(id)); err == nil {
+		for _, hash := range strings.Fields(string(buf)) {
+			reported[hash] = true
+		}
+	}
+	m.evidence[chain] = reported
+	return reported
+}
+
+// saveEvidence writes the hex hashes of the evidence reported for a CertChain, one per line
+func (m *monitor) saveEvidence(id skipchain.SkipBlockID, reported map[string]bool) error {
+	hashes := make([]string, 0, len(reported))
+	for hash := range reported {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return writeFile(m.evidenceFile(id), []byte(strings.Join(hashes, "\n")+"\n"))
+}
+
+// alert writes an alert as a JSON line
+func (m *monitor) alert(level string, id skipchain.SkipBlockID, index int, kind, message string) {
+	a := &alert{
+		Time:    time.Now(),
+		Level:   level,
+		Chain:   hex.EncodeToString(id),
+		Domain:  m.domains[hex.EncodeToString(id)],
+		Index:   index,
+		Kind:    kind,
+		Message: message,
+	}
+	if err := m.out.Encode(a); err != nil {
+		log.Error("Couldn't write alert:", err)
+	}
+}
@@ -11,12 +11,19 @@ This part of the service runs on the client or the app.
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/TinfoilHat0/certchain/merkle_tree"
 	"github.com/coniks-sys/coniks-go/crypto/vrf"
 	"github.com/coniks-sys/coniks-go/merkletree"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet/log"
+	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/config"
 	"gopkg.in/dedis/crypto.v0/random"
 	"gopkg.in/dedis/crypto.v0/sign"
@@ -30,6 +37,12 @@ var suite = network.Suite
 // 32 bytes
 var hashSize = sha256.New().Size()
 
+// Default number of retries and deadline of a single attempt of the Client
+const (
+	defaultRetries = 2
+	defaultTimeout = 20 * time.Second
+)
+
 // Client is a structure to communicate with the CoSi
 // service
 type Client struct {
@@ -37,6 +50,15 @@ type Client struct {
 	keyPair     *config.KeyPair
 	coniksKey   string
 	coniksIndex []byte
+	// Retries is how many other roster members are tried after a transient error
+	Retries int
+	// Timeout is the deadline of every single attempt, 0 means no deadline
+	Timeout time.Duration
+	// Preferred are the nodes that are tried first, in this order, if they are in the roster
+	Preferred []network.ServerIdentityID
+	// MaxHeartbeatAge is how old the heartbeat of a CertChain may be for the latest block, a
+	// lookup or a revocation status to be trusted, 0 means no heartbeat is needed
+	MaxHeartbeatAge time.Duration
 }
 
 // NewClient instantiates a new cosi.Client
@@ -47,7 +69,14 @@ func NewClient() *Client {
 		[]byte("deterministic tests need 32 byte")))
 	log.ErrFatal(err)
 	coniksIndex := vrfPrivKey.Compute([]byte(coniksKey))
-	return &Client{onet.NewClient(Name), kp, coniksKey, coniksIndex}
+	return &Client{
+		Client:      onet.NewClient(Name),
+		keyPair:     kp,
+		coniksKey:   coniksKey,
+		coniksIndex: coniksIndex,
+		Retries:     defaultRetries,
+		Timeout:     defaultTimeout,
+	}
 }
 
 // GenerateNewKeyPair generetes a new keypair for the client
@@ -65,21 +94,142 @@ func (c *Client) GenerateCertificates(n int) []crypto.HashID {
 	return leaves
 }
 
-// CreateCertBlock builds a new CertBlock from the supplied certificates
+// CreateCertBlock builds a new CertBlock from the supplied certificates, timestamped with the
+// current time
 func (c *Client) CreateCertBlock(certifs []crypto.HashID, prevMTR []byte, keyPair *config.KeyPair) *CertBlock {
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	latestMTR := computeMTR(prevLeaf(prevMTR, timestamp), certifs)
+	latestSignedMTR, err := sign.Schnorr(suite, keyPair.Secret, latestMTR)
+	if err != nil {
+		return nil
+	}
+	return &CertBlock{
+		LatestSignedMTR: latestSignedMTR,
+		LatestMTR:       latestMTR,
+		PrevMTR:         prevMTR,
+		PublicKey:       keyPair.Public,
+		Certs:           certifs,
+		Timestamp:       timestamp,
+	}
+}
+
+// CreateCertBlockWithBodies builds a new CertBlock from the bodies of the certificates, so that
+// the nodes can check them against a policy that needs them
+func (c *Client) CreateCertBlockWithBodies(certificates []*Certificate, prevMTR []byte, keyPair *config.KeyPair) *CertBlock {
+	leaves := make([]crypto.HashID, len(certificates))
+	for i, cert := range certificates {
+		leaves[i] = LeafHash(cert.Raw)
+	}
+	cb := c.CreateCertBlock(leaves, prevMTR, keyPair)
+	if cb != nil {
+		cb.Certificates = certificates
+	}
+	return cb
+}
+
+// CreateRecordBlock builds a new CertBlock logging records of the given type. The records are
+// put in canonical encoding and sent along as bodies, so that the nodes validate them.
+func (c *Client) CreateRecordBlock(t RecordType, records [][]byte, prevMTR []byte, keyPair *config.KeyPair) (*CertBlock, error) {
+	bodies := make([]*Certificate, len(records))
+	leaves := make([]crypto.HashID, len(records))
+	for i, raw := range records {
+		canonical, err := CanonicalRecord(t, raw)
+		if err != nil {
+			return nil, errors.New("record " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		bodies[i] = &Certificate{Raw: canonical}
+		leaves[i] = RecordLeafHash(t, canonical)
+	}
+	cb := c.CreateCertBlock(leaves, prevMTR, keyPair)
+	if cb == nil {
+		return nil, errors.New("couldn't sign the CertBlock")
+	}
+	cb.Type = t
+	cb.Certificates = bodies
+	return cb, nil
+}
+
+// LeafHash returns the leaf under which a certificate is logged, given its DER encoding
+func LeafHash(cert []byte) crypto.HashID {
+	h := sha256.Sum256(cert)
+	return crypto.HashID(h[:])
+}
+
+// computeMTR returns the root of the tree with the previous root and the root of the certificate tree as leaves
+func computeMTR(prevMTR []byte, certifs []crypto.HashID) crypto.HashID {
 	certMTR, _ := crypto.ProofTree(sha256.New, certifs)
 	leaves := make([]crypto.HashID, 2)
 	leaves[0] = prevMTR
 	leaves[1] = certMTR
 	latestMTR, _ := crypto.ProofTree(sha256.New, leaves)
-	latestSignedMTR, err := sign.Schnorr(suite, keyPair.Secret, latestMTR)
+	return latestMTR
+}
+
+// prevLeaf returns the leaf of the MTR next to the root of the certificate tree: the PrevMTR,
+// or the hash of the PrevMTR and the timestamp for a timestamped CertBlock. The inclusion
+// proofs of the certificates start with it.
+func prevLeaf(prevMTR []byte, timestamp int64) crypto.HashID {
+	if timestamp == 0 {
+		return prevMTR
+	}
+	h := sha256.New()
+	h.Write(prevMTR)
+	binary.Write(h, binary.BigEndian, timestamp)
+	return h.Sum(nil)
+}
+
+// blockMTR returns the MTR of a CertBlock: the root of the tree with prevLeaf and the root of
+// the certificate tree as leaves, and for a block revoking certificates the root of the tree
+// with that root and the revocation root as leaves
+func blockMTR(cb *CertBlock) crypto.HashID {
+	certRoot, _ := crypto.ProofTree(sha256.New, cb.Certs)
+	return rootsMTR(cb.PrevMTR, cb.Timestamp, certRoot, cb.RevocationRoot)
+}
+
+// rootsMTR returns the MTR of a CertBlock given its PrevMTR, its timestamp, the root of its
+// certificate tree and its revocation root, see blockMTR
+func rootsMTR(prevMTR []byte, timestamp int64, certRoot, revocationRoot crypto.HashID) crypto.HashID {
+	mtr, _ := crypto.ProofTree(sha256.New, []crypto.HashID{prevLeaf(prevMTR, timestamp), certRoot})
+	if len(revocationRoot) == 0 {
+		return mtr
+	}
+	root, _ := crypto.ProofTree(sha256.New, []crypto.HashID{mtr, revocationRoot})
+	return root
+}
+
+// validMTR returns false if the LatestMTR of a CertBlock isn't computed from its content. A block
+// without certificates, revocations nor timestamp, like the ones built by CreateCertBlockCONIKS,
+// holds an MTR the nodes can't recompute: it is only accepted without a policy, see Policy.Check.
+func validMTR(cb *CertBlock) bool {
+	if len(cb.Certs) == 0 && len(cb.Certificates) == 0 && len(cb.Revoked) == 0 &&
+		len(cb.RevocationRoot) == 0 && cb.Timestamp == 0 {
+		return true
+	}
+	return bytes.Equal(cb.LatestMTR, blockMTR(cb))
+}
+
+// CreateRevocationBlock builds a new CertBlock revoking the given certificates. revokedBefore
+// holds the certificates already revoked in the CertChain, as returned by RevokedSet.
+func (c *Client) CreateRevocationBlock(revoked, revokedBefore []crypto.HashID, prevMTR []byte, keyPair *config.KeyPair) *CertBlock {
+	root, _ := revocationRoot(append(append([]crypto.HashID{}, revokedBefore...), revoked...))
+	cb := &CertBlock{
+		PrevMTR:        prevMTR,
+		PublicKey:      keyPair.Public,
+		Revoked:        revoked,
+		RevocationRoot: root,
+		Timestamp:      time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	cb.LatestMTR = blockMTR(cb)
+	var err error
+	cb.LatestSignedMTR, err = sign.Schnorr(suite, keyPair.Secret, cb.LatestMTR)
 	if err != nil {
 		return nil
 	}
-	return &CertBlock{latestSignedMTR, latestMTR, prevMTR, keyPair.Public}
+	return cb
 }
 
-// CreateCertBlockCONIKS builds a new CertBlock from the supplied certificates using CONIKs Merkle Tree algorithm
+// CreateCertBlockCONIKS builds a new CertBlock from the supplied certificates using CONIKs Merkle Tree algorithm.
+// The nodes can't recompute its MTR from the block, so CertChains with a policy don't accept it.
 func (c *Client) CreateCertBlockCONIKS(certifs []crypto.HashID, prevMTR []byte, keyPair *config.KeyPair) *CertBlock {
 	// create a new merkle tree
 	m, err := merkletree.NewMerkleTree()
@@ -110,14 +260,29 @@ func (c *Client) CreateCertBlockCONIKS(certifs []crypto.HashID, prevMTR []byte,
 	if err != nil {
 		return nil
 	}
-	return &CertBlock{latestSignedMTR, latestMTR, prevMTR, keyPair.Public}
+	return &CertBlock{
+		LatestSignedMTR: latestSignedMTR,
+		LatestMTR:       latestMTR,
+		PrevMTR:         prevMTR,
+		PublicKey:       keyPair.Public,
+	}
 }
 
 // CreateSkipchain initializes the Skipchain which is the underlying blockchain service
 func (c *Client) CreateSkipchain(r *onet.Roster, genesisCertBlock *CertBlock) (*skipchain.SkipBlock, onet.ClientError) {
-	dst := r.RandomServerIdentity()
+	return c.CreateNamedSkipchain(r, "", genesisCertBlock)
+}
+
+// CreateNamedSkipchain initializes a Skipchain bound to a DNS name or a wildcard zone like *.example.com
+func (c *Client) CreateNamedSkipchain(r *onet.Roster, name string, genesisCertBlock *CertBlock) (*skipchain.SkipBlock, onet.ClientError) {
+	return c.CreateCustomSkipchain(r, name, 1, 1, genesisCertBlock)
+}
+
+// CreateCustomSkipchain initializes a Skipchain with the given base and maximum height of the
+// forward links, so that it can be traversed in logarithmic steps. The name is optional.
+func (c *Client) CreateCustomSkipchain(r *onet.Roster, name string, base, height int, genesisCertBlock *CertBlock) (*skipchain.SkipBlock, onet.ClientError) {
 	reply := &CreateSkipchainResponse{}
-	err := c.SendProtobuf(dst, &CreateSkipchainRequest{r, genesisCertBlock}, reply)
+	err := c.send(r, &CreateSkipchainRequest{r, genesisCertBlock, name, base, height}, reply)
 	if err != nil {
 		return nil, err
 	}
@@ -126,11 +291,745 @@ func (c *Client) CreateSkipchain(r *onet.Roster, genesisCertBlock *CertBlock) (*
 
 // AddNewTxn adds a new transaction to the underlying Skipchain service
 func (c *Client) AddNewTxn(r *onet.Roster, sb *skipchain.SkipBlock, cb *CertBlock) (*skipchain.SkipBlock, onet.ClientError) {
-	dst := sb.Roster.RandomServerIdentity()
 	reply := &AddNewTxnResponse{}
-	err := c.SendProtobuf(dst, &AddNewTxnRequest{r, sb, cb}, reply)
+	err := c.send(sb.Roster, &AddNewTxnRequest{r, sb, cb}, reply)
+	if err != nil {
+		if stored := c.storedAfter(sb, cb, err); stored != nil {
+			return stored, nil
+		}
+		return nil, err
+	}
+	return reply.SkipBlock, nil
+}
+
+// ChangeRoster moves the CertChain to a new roster. sb is the latest block, whose roster approves
+// the change, and cb is a CertBlock signed by the owner, usually without certificates.
+func (c *Client) ChangeRoster(r *onet.Roster, sb *skipchain.SkipBlock, cb *CertBlock) (*skipchain.SkipBlock, onet.ClientError) {
+	reply := &ChangeRosterResponse{}
+	err := c.send(sb.Roster, &ChangeRosterRequest{r, sb, cb}, reply)
 	if err != nil {
+		if stored := c.storedAfter(sb, cb, err); stored != nil {
+			return stored, nil
+		}
 		return nil, err
 	}
 	return reply.SkipBlock, nil
 }
+
+// storedAfter returns the block following sb if it holds cb and the request was refused because
+// the PrevMTR is spent: a request retried after a timeout is refused once the first attempt
+// stored the block. It returns nil otherwise.
+func (c *Client) storedAfter(sb *skipchain.SkipBlock, cb *CertBlock, err onet.ClientError) *skipchain.SkipBlock {
+	if err.ErrorCode() != ErrorSpent {
+		return nil
+	}
+	blocks, werr := c.WalkToIndex(sb.Roster, sb.Hash, sb.Index+1)
+	if werr != nil {
+		return nil
+	}
+	next := blocks[len(blocks)-1]
+	stored, eerr := ExtractCertBlock(next)
+	if eerr != nil || !bytes.Equal(stored.LatestMTR, cb.LatestMTR) || !bytes.Equal(stored.LatestSignedMTR, cb.LatestSignedMTR) {
+		return nil
+	}
+	return next
+}
+
+// GetLatest returns the latest block of the CertChain the trusted block belongs to. The
+// forward-link proof from the trusted block is verified before the block is returned.
+func (c *Client) GetLatest(r *onet.Roster, trusted skipchain.SkipBlockID) (*skipchain.SkipBlock, onet.ClientError) {
+	reply := &GetLatestResponse{}
+	err := c.send(r, &GetLatestRequest{r, trusted}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if verr := VerifyProof(trusted, reply.Proof); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	// The block of the verified proof is returned, not the one sent along
+	latest := reply.Proof[len(reply.Proof)-1]
+	if !bytes.Equal(latest.Hash, reply.SkipBlock.Hash) {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "proof doesn't end at the latest block")
+	}
+	if err := c.checkHeartbeat(r, latest.SkipChainID(), latest.Index); err != nil {
+		return nil, err
+	}
+	return latest, nil
+}
+
+// GetBlockByMTR returns the block holding the CertBlock with the given LatestMTR. The
+// forward-link proof from the trusted block is verified before the block is returned.
+func (c *Client) GetBlockByMTR(r *onet.Roster, trusted skipchain.SkipBlockID, mtr []byte) (*skipchain.SkipBlock, onet.ClientError) {
+	reply := &GetBlockByMTRResponse{}
+	err := c.send(r, &GetBlockByMTRRequest{r, trusted, mtr}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if verr := VerifyProof(trusted, reply.Proof); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	sb := reply.Proof[len(reply.Proof)-1]
+	_, cb, merr := network.Unmarshal(sb.Data)
+	if merr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, merr.Error())
+	}
+	if certBlock, ok := cb.(*CertBlock); !ok || !bytes.Equal(certBlock.LatestMTR, mtr) {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "returned block doesn't hold the MTR")
+	}
+	return sb, nil
+}
+
+// ResolveName returns the genesis ID of the CertChain bound to a name together with its latest
+// block. The forward-link proof from the genesis block is verified before the block is returned.
+func (c *Client) ResolveName(r *onet.Roster, name string) (skipchain.SkipBlockID, *skipchain.SkipBlock, onet.ClientError) {
+	reply := &ResolveNameResponse{}
+	err := c.send(r, &ResolveNameRequest{r, name}, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	if verr := VerifyProof(reply.SkipchainID, reply.Proof); verr != nil {
+		return nil, nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	// The roster has to vouch for the binding of the name to the genesis block
+	b := reply.Binding
+	if b == nil || (b.Name != name && b.Name != wildcardName(name)) {
+		return nil, nil, onet.NewClientErrorCode(ErrorVerification, "binding is about another name")
+	}
+	if verr := b.Verify(r); verr != nil {
+		return nil, nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	if verr := b.VerifyGenesis(reply.Proof[0]); verr != nil {
+		return nil, nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	latest := reply.Proof[len(reply.Proof)-1]
+	if err := c.checkHeartbeat(r, reply.SkipchainID, latest.Index); err != nil {
+		return nil, nil, err
+	}
+	return reply.SkipchainID, latest, nil
+}
+
+// WalkToLatest returns the blocks from the trusted block to the latest block of its CertChain,
+// following the highest forward link at each step. The links are verified.
+func (c *Client) WalkToLatest(r *onet.Roster, trusted skipchain.SkipBlockID) ([]*skipchain.SkipBlock, onet.ClientError) {
+	return walkVerified(r, trusted, -1)
+}
+
+// WalkToIndex returns the blocks from the trusted block to the block at index of its CertChain,
+// following the highest forward link that doesn't go past it at each step. The links are verified.
+func (c *Client) WalkToIndex(r *onet.Roster, trusted skipchain.SkipBlockID, index int) ([]*skipchain.SkipBlock, onet.ClientError) {
+	blocks, err := walkVerified(r, trusted, index)
+	if err != nil {
+		return nil, err
+	}
+	if blocks[len(blocks)-1].Index != index {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "no block at index "+strconv.Itoa(index))
+	}
+	return blocks, nil
+}
+
+// GetChain returns all the blocks of the CertChain from the trusted block to the latest one.
+// Every block is verified to be linked from the previous one.
+func (c *Client) GetChain(r *onet.Roster, trusted skipchain.SkipBlockID) ([]*skipchain.SkipBlock, onet.ClientError) {
+	client := skipchain.NewClient()
+	current, err := client.GetSingleBlock(r, trusted)
+	if err != nil {
+		return nil, err
+	}
+	blocks := []*skipchain.SkipBlock{current}
+	for len(current.ForwardLink) > 0 {
+		current, err = client.GetSingleBlock(r, current.ForwardLink[0].Hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, current)
+	}
+	if verr := VerifyProof(trusted, blocks); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	return blocks, nil
+}
+
+// walkEvery returns every block from the trusted block to the block at index, following the
+// forward links of the lowest level. The links are verified.
+func walkEvery(r *onet.Roster, trusted skipchain.SkipBlockID, index int) ([]*skipchain.SkipBlock, onet.ClientError) {
+	client := skipchain.NewClient()
+	current, err := client.GetSingleBlock(r, trusted)
+	if err != nil {
+		return nil, err
+	}
+	blocks := []*skipchain.SkipBlock{current}
+	for current.Index < index && len(current.ForwardLink) > 0 {
+		current, err = client.GetSingleBlock(r, current.ForwardLink[0].Hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, current)
+	}
+	if current.Index != index {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "no block at index "+strconv.Itoa(index))
+	}
+	if verr := VerifyProof(trusted, blocks); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	return blocks, nil
+}
+
+// walkVerified walks the forward links and verifies the resulting proof
+func walkVerified(r *onet.Roster, trusted skipchain.SkipBlockID, index int) ([]*skipchain.SkipBlock, onet.ClientError) {
+	blocks, err := walk(r, trusted, index)
+	if err != nil {
+		return nil, err
+	}
+	if verr := VerifyProof(trusted, blocks); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	return blocks, nil
+}
+
+// walk follows the forward links from the block with ID from. If index is negative, the highest
+// forward link is taken until the latest block is reached. Otherwise the highest forward link that
+// doesn't go past the block at index is taken until no such link exists.
+func walk(roster *onet.Roster, from skipchain.SkipBlockID, index int) ([]*skipchain.SkipBlock, onet.ClientError) {
+	client := skipchain.NewClient()
+	current, err := client.GetSingleBlock(roster, from)
+	if err != nil {
+		return nil, err
+	}
+	if index >= 0 && current.Index > index {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "trusted block is after the requested block")
+	}
+	blocks := []*skipchain.SkipBlock{current}
+	for {
+		var next skipchain.SkipBlockID
+		if index < 0 {
+			if len(current.ForwardLink) > 0 {
+				next = current.ForwardLink[len(current.ForwardLink)-1].Hash
+			}
+		} else {
+			next = nextHop(current, index)
+		}
+		if next == nil {
+			return blocks, nil
+		}
+		current, err = client.GetSingleBlock(roster, next)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, current)
+	}
+}
+
+// nextHop returns the ID of the block reached by the highest forward link of sb that doesn't
+// go past the block at index, or nil if there is none
+func nextHop(sb *skipchain.SkipBlock, index int) skipchain.SkipBlockID {
+	jump := 1
+	for h := 1; h < len(sb.ForwardLink); h++ {
+		jump *= sb.BaseHeight
+	}
+	for h := len(sb.ForwardLink) - 1; h >= 0; h-- {
+		if sb.Index+jump <= index {
+			return sb.ForwardLink[h].Hash
+		}
+		if sb.BaseHeight > 0 {
+			jump /= sb.BaseHeight
+		}
+	}
+	return nil
+}
+
+// IsRetryable returns false if the error is a final rejection by the CertChain service, like a
+// spent MTR, and true if it is transient, like a timeout, so that another node can be asked.
+func IsRetryable(err onet.ClientError) bool {
+	switch err.ErrorCode() {
+	case ErrorParameter, ErrorUnknownName, ErrorNameTaken, ErrorSpent, ErrorSignature, ErrorPolicy,
+		ErrorTimestamp, ErrorDomain, ErrorDelegation:
+		return false
+	}
+	return true
+}
+
+// send sends the request to the roster members until one of them answers. Final rejections
+// are returned right away, after a transient error the next member is tried, at most Retries times.
+func (c *Client) send(r *onet.Roster, msg interface{}, reply interface{}) onet.ClientError {
+	if r == nil || len(r.List) == 0 {
+		return onet.NewClientErrorCode(ErrorParameter, "empty roster")
+	}
+	var err onet.ClientError
+	for i, dst := range c.candidates(r) {
+		if i > c.Retries {
+			break
+		}
+		err = c.sendTo(dst, msg, reply)
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		log.Lvl2("Request to", dst, "failed:", err)
+	}
+	return err
+}
+
+// sendTo sends the request to one node and waits at most Timeout for the answer. Every attempt
+// gets its own reply, so that a late answer can't overwrite the one of a later attempt.
+func (c *Client) sendTo(dst *network.ServerIdentity, msg interface{}, reply interface{}) onet.ClientError {
+	fresh := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+	done := make(chan onet.ClientError, 1)
+	go func() {
+		done <- c.SendProtobuf(dst, msg, fresh)
+	}()
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		timeout = time.After(c.Timeout)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(fresh).Elem())
+		return nil
+	case <-timeout:
+		return onet.NewClientErrorCode(ErrorTimeout, "no answer from "+dst.String())
+	}
+}
+
+// candidates returns the preferred roster members followed by the others in random order
+func (c *Client) candidates(r *onet.Roster) []*network.ServerIdentity {
+	list := make([]*network.ServerIdentity, 0, len(r.List))
+	used := make(map[network.ServerIdentityID]bool)
+	for _, id := range c.Preferred {
+		if _, si := r.Search(id); si != nil && !used[id] {
+			list = append(list, si)
+			used[id] = true
+		}
+	}
+	for _, i := range rand.Perm(len(r.List)) {
+		if si := r.List[i]; !used[si.ID] {
+			list = append(list, si)
+		}
+	}
+	return list
+}
+
+// VerifyProof checks that proof is a chain of blocks starting at the trusted block where
+// every block is reached from the previous one through a correctly signed forward link
+func VerifyProof(trusted skipchain.SkipBlockID, proof []*skipchain.SkipBlock) error {
+	if len(proof) == 0 {
+		return errors.New("empty proof")
+	}
+	if !bytes.Equal(proof[0].Hash, trusted) {
+		return errors.New("proof doesn't start at the trusted block")
+	}
+	for i, sb := range proof {
+		if !bytes.Equal(sb.Hash, sb.CalculateHash()) {
+			return errors.New("wrong hash of block " + strconv.Itoa(sb.Index))
+		}
+		if i == 0 {
+			continue
+		}
+		prev := proof[i-1]
+		linked := false
+		for _, fl := range prev.ForwardLink {
+			if bytes.Equal(fl.Hash, sb.Hash) {
+				linked = true
+				break
+			}
+		}
+		if !linked {
+			return errors.New("no forward link from block " + strconv.Itoa(prev.Index))
+		}
+		if err := prev.VerifyForwardSignatures(); err != nil {
+			return errors.New("wrong forward link signature: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// LookupCert asks whether a certificate is logged in the CertChain with the given genesis
+// block. If it is, the verified inclusion proof is returned. Otherwise the verified statement
+// of a roster member that the certificate is not logged up to some height is returned.
+func (c *Client) LookupCert(r *onet.Roster, id skipchain.SkipBlockID, cert crypto.HashID) (*InclusionProof, *CertAbsence, onet.ClientError) {
+	reply := &LookupCertResponse{}
+	err := c.send(r, &LookupCertRequest{r, id, cert}, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case reply.Inclusion != nil:
+		if _, verr := reply.Inclusion.Verify(id, cert); verr != nil {
+			return nil, nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+		}
+		if err := c.checkHeartbeat(r, id, -1); err != nil {
+			return nil, nil, err
+		}
+		return reply.Inclusion, nil, nil
+	case reply.Absence != nil:
+		if verr := reply.Absence.Verify(r); verr != nil {
+			return nil, nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+		}
+		if !bytes.Equal(reply.Absence.SkipchainID, id) || !bytes.Equal(reply.Absence.Cert, cert) {
+			return nil, nil, onet.NewClientErrorCode(ErrorVerification, "statement is about another certificate")
+		}
+		if err := c.checkHeartbeat(r, id, reply.Absence.Height); err != nil {
+			return nil, nil, err
+		}
+		return nil, reply.Absence, nil
+	}
+	return nil, nil, onet.NewClientErrorCode(ErrorVerification, "empty reply")
+}
+
+// FirstSeen returns the inclusion proof of a certificate in the earliest block of a CertChain
+// logging it, and the timestamp of that block. The time is zero for a block without timestamp.
+// The node isn't trusted: every earlier block is fetched and checked not to log the certificate.
+func (c *Client) FirstSeen(r *onet.Roster, id skipchain.SkipBlockID, cert crypto.HashID) (*InclusionProof, time.Time, onet.ClientError) {
+	reply := &FirstSeenResponse{}
+	if err := c.send(r, &FirstSeenRequest{r, id, cert}, reply); err != nil {
+		return nil, time.Time{}, err
+	}
+	if reply.Inclusion == nil {
+		return nil, time.Time{}, onet.NewClientErrorCode(ErrorVerification, "empty reply")
+	}
+	cb, verr := reply.Inclusion.Verify(id, cert)
+	if verr != nil {
+		return nil, time.Time{}, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	block := reply.Inclusion.Block()
+	blocks, err := walkEvery(r, id, block.Index)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !bytes.Equal(blocks[len(blocks)-1].Hash, block.Hash) {
+		return nil, time.Time{}, onet.NewClientErrorCode(ErrorVerification, "block isn't part of the CertChain")
+	}
+	for _, sb := range blocks[:len(blocks)-1] {
+		earlier, eerr := ExtractCertBlock(sb)
+		if eerr != nil {
+			return nil, time.Time{}, onet.NewClientErrorCode(ErrorVerification, eerr.Error())
+		}
+		for _, logged := range earlier.Certs {
+			if bytes.Equal(logged, cert) {
+				return nil, time.Time{}, onet.NewClientErrorCode(ErrorVerification, "certificate is logged in the earlier block "+
+					strconv.Itoa(sb.Index))
+			}
+		}
+	}
+	return reply.Inclusion, cb.Time(), nil
+}
+
+// Time returns the timestamp of the CertBlock, or the zero time if it has none
+func (cb *CertBlock) Time() time.Time {
+	if cb.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, cb.Timestamp*int64(time.Millisecond))
+}
+
+// Block returns the block holding the certificate
+func (p *InclusionProof) Block() *skipchain.SkipBlock {
+	return p.Blocks[len(p.Blocks)-1]
+}
+
+// Verify checks that the blocks are linked from the trusted block and that the certificate
+// is committed in the CertBlock of the last block. It returns this CertBlock.
+func (p *InclusionProof) Verify(trusted skipchain.SkipBlockID, cert crypto.HashID) (*CertBlock, error) {
+	if err := VerifyProof(trusted, p.Blocks); err != nil {
+		return nil, err
+	}
+	_, cb, err := network.Unmarshal(p.Block().Data)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, ok := cb.(*CertBlock)
+	if !ok {
+		return nil, errors.New("block doesn't hold a CertBlock")
+	}
+	if p.Position < 0 || p.Position >= len(certBlock.Certs) || !bytes.Equal(certBlock.Certs[p.Position], cert) {
+		return nil, errors.New("certificate is not at the given position")
+	}
+	if !p.Proof.Check(sha256.New, certBlock.LatestMTR, cert) {
+		return nil, errors.New("wrong Merkle proof")
+	}
+	return certBlock, nil
+}
+
+// Hash returns the hash of the statement that is signed by the node
+func (a *CertAbsence) Hash() []byte {
+	h := sha256.New()
+	h.Write(a.SkipchainID)
+	h.Write(a.Cert)
+	binary.Write(h, binary.LittleEndian, int64(a.Height))
+	h.Write(a.BlockID)
+	return h.Sum(nil)
+}
+
+// Verify checks that the statement is signed with the key the roster holds for the signer
+func (a *CertAbsence) Verify(r *onet.Roster) error {
+	if a.Signer == nil {
+		return errors.New("statement is not signed")
+	}
+	i, signer := r.Search(a.Signer.ID)
+	if i < 0 {
+		return errors.New("signer is not part of the roster")
+	}
+	return sign.VerifySchnorr(suite, signer.Public, a.Hash(), a.Signature)
+}
+
+// GetEvidence returns the verified equivocation evidence the cothority holds for a CertChain
+func (c *Client) GetEvidence(r *onet.Roster, id skipchain.SkipBlockID) ([]*EquivocationEvidence, onet.ClientError) {
+	reply := &GetEvidenceResponse{}
+	err := c.send(r, &GetEvidenceRequest{id}, reply)
+	if err != nil {
+		return nil, err
+	}
+	evidence := make([]*EquivocationEvidence, 0, len(reply.Evidence))
+	for _, e := range reply.Evidence {
+		if verr := e.Verify(r); verr != nil {
+			log.Warn("Dropping invalid evidence:", verr)
+			continue
+		}
+		evidence = append(evidence, e)
+	}
+	return evidence, nil
+}
+
+// GetSTH returns the RFC 6962 tree head of a CertChain, checked to be signed by a member of the roster
+func (c *Client) GetSTH(r *onet.Roster, id skipchain.SkipBlockID) (*SignedTreeHead, onet.ClientError) {
+	reply := &GetSTHResponse{}
+	if err := c.send(r, &GetSTHRequest{id}, reply); err != nil {
+		return nil, err
+	}
+	if reply.STH == nil || !bytes.Equal(reply.STH.SkipchainID, id) {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "tree head is about another CertChain")
+	}
+	if verr := reply.STH.Verify(r); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	return reply.STH, nil
+}
+
+// RevocationStatus returns whether a certificate of a CertChain is revoked as of the latest
+// block known by a node. The status is checked to be signed by a member of the roster less than
+// maxStatusAge ago, to be as recent as the verified latest block, its revocation block to be the
+// latest one of the CertChain up to the status and its proof or revocation set to match the
+// revocation root of that block.
+func (c *Client) RevocationStatus(r *onet.Roster, id skipchain.SkipBlockID, cert crypto.HashID) (*RevocationStatus, onet.ClientError) {
+	head, err := c.GetLatest(r, id)
+	if err != nil {
+		return nil, err
+	}
+	reply := &RevocationStatusResponse{}
+	if err := c.send(r, &RevocationStatusRequest{id, cert}, reply); err != nil {
+		return nil, err
+	}
+	rs := reply.Status
+	if rs == nil || !bytes.Equal(rs.SkipchainID, id) || !bytes.Equal(rs.Cert, cert) {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "revocation status is about another certificate")
+	}
+	if verr := rs.Verify(r); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	age := time.Since(time.Unix(0, rs.Timestamp*int64(time.Millisecond)))
+	if age > maxStatusAge || age < -maxStatusAge {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "revocation status isn't fresh")
+	}
+	if rs.Index < head.Index {
+		return nil, onet.NewClientErrorCode(ErrorStale, "revocation status is older than block "+strconv.Itoa(head.Index))
+	}
+	// Every block after the revocation block up to Index is fetched, none may revoke certificates
+	from := id
+	if rs.Block != nil {
+		blocks, err := c.WalkToIndex(r, id, rs.Block.Index)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(blocks[len(blocks)-1].Hash, rs.Block.Hash) {
+			return nil, onet.NewClientErrorCode(ErrorVerification, "revocation block isn't part of the CertChain")
+		}
+		from = rs.Block.Hash
+	}
+	blocks, err := walkEvery(r, from, rs.Index)
+	if err != nil {
+		return nil, err
+	}
+	if rs.Block != nil {
+		blocks = blocks[1:]
+	}
+	for _, sb := range blocks {
+		if cb, err := ExtractCertBlock(sb); err != nil || len(cb.RevocationRoot) > 0 {
+			return nil, onet.NewClientErrorCode(ErrorVerification, "revocation status misses the revocation block "+
+				strconv.Itoa(sb.Index))
+		}
+	}
+	return rs, nil
+}
+
+// Subscribe sends every new block of the CertChains to updates, starting at the given heights,
+// until stop is closed or the cothority can't be reached anymore. Every block is checked to be
+// reached through a forward link signed by the roster from the previous block of its CertChain,
+// which is reached from the genesis block for the first block after a resumed height. To resume
+// after an error, call Subscribe again with the heights following the last blocks received.
+func (c *Client) Subscribe(r *onet.Roster, chains []skipchain.SkipBlockID, heights []int,
+	updates chan<- *BlockUpdate, stop <-chan struct{}) onet.ClientError {
+	if len(chains) != len(heights) {
+		return onet.NewClientErrorCode(ErrorParameter, "one height per CertChain is needed")
+	}
+	heights = append([]int{}, heights...)
+	positions := make(map[string]int)
+	for i, id := range chains {
+		positions[string(id)] = i
+	}
+	previous := make(map[string]*skipchain.SkipBlock)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		reply := &SubscribeResponse{}
+		if err := c.send(r, &SubscribeRequest{chains, heights}, reply); err != nil {
+			return err
+		}
+		for _, sb := range reply.Blocks {
+			key := string(sb.SkipChainID())
+			i, subscribed := positions[key]
+			if !subscribed || sb.Index != heights[i] {
+				return onet.NewClientErrorCode(ErrorVerification, "unexpected block "+strconv.Itoa(sb.Index))
+			}
+			cb, verr := c.verifyUpdate(r, chains[i], previous[key], sb)
+			if verr != nil {
+				return verr
+			}
+			select {
+			case updates <- &BlockUpdate{sb, cb}:
+			case <-stop:
+				return nil
+			}
+			previous[key] = sb
+			heights[i]++
+		}
+	}
+}
+
+// verifyUpdate checks a block of the CertChain id received by a subscription and returns its
+// CertBlock. The block before it is fetched again, as it only has the forward link to the
+// block now: prev if it was received before, otherwise it is reached from the genesis block.
+func (c *Client) verifyUpdate(r *onet.Roster, id skipchain.SkipBlockID, prev, sb *skipchain.SkipBlock) (*CertBlock, onet.ClientError) {
+	if !bytes.Equal(sb.Hash, sb.CalculateHash()) {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "wrong hash of block "+strconv.Itoa(sb.Index))
+	}
+	if sb.Index == 0 {
+		if !bytes.Equal(sb.Hash, id) {
+			return nil, onet.NewClientErrorCode(ErrorVerification, "genesis block of another CertChain")
+		}
+		if err := VerifyGenesis(sb); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorVerification, err.Error())
+		}
+	} else {
+		var linked *skipchain.SkipBlock
+		if prev != nil {
+			var err onet.ClientError
+			linked, err = skipchain.NewClient().GetSingleBlock(r, prev.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(linked.Hash, prev.Hash) {
+				return nil, onet.NewClientErrorCode(ErrorVerification, "previous block changed")
+			}
+		} else {
+			blocks, err := c.WalkToIndex(r, id, sb.Index-1)
+			if err != nil {
+				return nil, err
+			}
+			linked = blocks[len(blocks)-1]
+		}
+		if err := VerifyBlockLink(linked, sb); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorVerification, err.Error())
+		}
+	}
+	cb, err := ExtractCertBlock(sb)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, err.Error())
+	}
+	return cb, nil
+}
+
+// newSignedMTR returns the signed part of a CertBlock verified with the key
+func newSignedMTR(cb *CertBlock, key abstract.Point) *SignedMTR {
+	certRoot, _ := crypto.ProofTree(sha256.New, cb.Certs)
+	return &SignedMTR{
+		LatestSignedMTR: cb.LatestSignedMTR,
+		LatestMTR:       cb.LatestMTR,
+		PrevMTR:         cb.PrevMTR,
+		PublicKey:       key,
+		Timestamp:       cb.Timestamp,
+		CertRoot:        certRoot,
+		RevocationRoot:  cb.RevocationRoot,
+	}
+}
+
+// Hash returns the hash of the evidence that is signed by the reporter
+func (e *EquivocationEvidence) Hash() ([]byte, error) {
+	h := sha256.New()
+	h.Write(e.SkipchainID)
+	for _, m := range []*SignedMTR{e.First, e.Second} {
+		h.Write(m.PrevMTR)
+		h.Write(m.LatestMTR)
+		h.Write(m.LatestSignedMTR)
+		binary.Write(h, binary.BigEndian, m.Timestamp)
+		h.Write(m.CertRoot)
+		h.Write(m.RevocationRoot)
+		buf, err := m.PublicKey.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		h.Write(buf)
+	}
+	return h.Sum(nil), nil
+}
+
+// Verify checks that both MTRs are computed from their PrevMTR, spend the same PrevMTR and
+// are correctly signed by the same key, and that the reporter signed the evidence with the key
+// the roster holds for it
+func (e *EquivocationEvidence) Verify(r *onet.Roster) error {
+	if e.First == nil || e.Second == nil || e.Reporter == nil {
+		return errors.New("incomplete evidence")
+	}
+	if e.First.PublicKey == nil || e.Second.PublicKey == nil || !e.First.PublicKey.Equal(e.Second.PublicKey) {
+		return errors.New("MTRs are not signed by the same key")
+	}
+	if !bytes.Equal(e.First.PrevMTR, e.Second.PrevMTR) {
+		return errors.New("MTRs don't spend the same PrevMTR")
+	}
+	for _, m := range []*SignedMTR{e.First, e.Second} {
+		if !bytes.Equal(m.LatestMTR, rootsMTR(m.PrevMTR, m.Timestamp, m.CertRoot, m.RevocationRoot)) {
+			return errors.New("MTR isn't computed from the PrevMTR")
+		}
+		if err := sign.VerifySchnorr(suite, m.PublicKey, m.LatestMTR, m.LatestSignedMTR); err != nil {
+			return errors.New("wrong owner signature: " + err.Error())
+		}
+	}
+	if bytes.Equal(e.First.LatestMTR, e.Second.LatestMTR) {
+		return errors.New("MTRs are not conflicting")
+	}
+	i, reporter := r.Search(e.Reporter.ID)
+	if i < 0 {
+		return errors.New("reporter is not part of the roster")
+	}
+	hash, err := e.Hash()
+	if err != nil {
+		return err
+	}
+	if err := sign.VerifySchnorr(suite, reporter.Public, hash, e.Signature); err != nil {
+		return errors.New("wrong reporter signature: " + err.Error())
+	}
+	return nil
+}
+
+// sameEquivocation returns true if both evidences are about the same pair of MTRs
+func (e *EquivocationEvidence) sameEquivocation(other *EquivocationEvidence) bool {
+	if !bytes.Equal(e.First.PrevMTR, other.First.PrevMTR) {
+		return false
+	}
+	a, b := e.First.LatestMTR, e.Second.LatestMTR
+	x, y := other.First.LatestMTR, other.Second.LatestMTR
+	return (bytes.Equal(a, x) && bytes.Equal(b, y)) || (bytes.Equal(a, y) && bytes.Equal(b, x))
+}
@@ -1,9 +1,23 @@
 package certchain
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/TinfoilHat0/certchain/internal/testutil"
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/crypto.v0/sign"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
@@ -103,3 +117,901 @@ func TestAddNewTxnCONIKS(t *testing.T) {
 	assert.True(t, cb.PublicKey.Equal(sbRawData.(*CertBlock).PublicKey))
 
 }
+
+// Spend the same MTR twice and check that the equivocation evidence is served
+func TestEquivocationEvidence(t *testing.T) {
+	client := NewClient()
+	genesis := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	local, roster, sb := newTestChain(t, client, genesis)
+	defer local.CloseAll()
+
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), genesis.LatestMTR, client.keyPair)
+	latest, err := client.AddNewTxn(roster, sb, cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	// A competing block on top of the same PrevMTR
+	competing := client.CreateCertBlock(client.GenerateCertificates(5), genesis.LatestMTR, client.keyPair)
+	_, err = client.AddNewTxn(roster, latest, competing)
+	assert.NotNil(t, err)
+
+	var evidence []*EquivocationEvidence
+	for i := 0; i < 10 && len(evidence) == 0; i++ {
+		evidence, err = client.GetEvidence(roster, sb.Hash)
+		log.ErrFatal(err)
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(evidence))
+	assert.Nil(t, evidence[0].Verify(roster))
+	assert.Equal(t, cb.LatestMTR, evidence[0].First.LatestMTR)
+	assert.Equal(t, competing.LatestMTR, evidence[0].Second.LatestMTR)
+
+	// The evidence only holds for the roster of the reporter and MTRs computed from the PrevMTR
+	_, other, _ := local.GenTree(1, false)
+	assert.NotNil(t, evidence[0].Verify(other))
+	forged := *evidence[0]
+	second := *forged.Second
+	second.CertRoot = genesis.LatestMTR
+	forged.Second = &second
+	assert.NotNil(t, forged.Verify(roster))
+}
+
+// Ask for the head of a CertChain starting from its genesis block
+func TestGetLatest(t *testing.T) {
+	client := NewClient()
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	local, roster, genesis := newTestChain(t, client, cb)
+	defer local.CloseAll()
+	sb := genesis
+	var err onet.ClientError
+	for i := 0; i < 2; i++ {
+		cb = client.CreateCertBlock(client.GenerateCertificates(5), cb.LatestMTR, client.keyPair)
+		sb, err = client.AddNewTxn(roster, sb, cb)
+		log.ErrFatal(err, "Couldn't send")
+	}
+
+	latest, err := client.GetLatest(roster, genesis.Hash)
+	log.ErrFatal(err)
+	assert.Equal(t, sb.Hash, latest.Hash)
+	assert.Equal(t, 2, latest.Index)
+}
+
+// Ask for the block holding a given MTR
+func TestGetBlockByMTR(t *testing.T) {
+	client := NewClient()
+	genesisCB := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	local, roster, genesis := newTestChain(t, client, genesisCB)
+	defer local.CloseAll()
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), genesisCB.LatestMTR, client.keyPair)
+	sb, err := client.AddNewTxn(roster, genesis, cb)
+	log.ErrFatal(err, "Couldn't send")
+	_, err = client.AddNewTxn(roster, sb, client.CreateCertBlock(client.GenerateCertificates(5), cb.LatestMTR, client.keyPair))
+	log.ErrFatal(err, "Couldn't send")
+
+	found, err := client.GetBlockByMTR(roster, genesis.Hash, cb.LatestMTR)
+	log.ErrFatal(err)
+	assert.Equal(t, sb.Hash, found.Hash)
+
+	_, err = client.GetBlockByMTR(roster, genesis.Hash, make([]byte, hashSize))
+	assert.NotNil(t, err)
+}
+
+// Look up a logged and a missing certificate
+func TestLookupCert(t *testing.T) {
+	client := NewClient()
+	genesisCB := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	local, roster, genesis := newTestChain(t, client, genesisCB)
+	defer local.CloseAll()
+	certifs := client.GenerateCertificates(5)
+	cb := client.CreateCertBlock(certifs, genesisCB.LatestMTR, client.keyPair)
+	_, err := client.AddNewTxn(roster, genesis, cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	inclusion, absence, err := client.LookupCert(roster, genesis.Hash, certifs[2])
+	log.ErrFatal(err)
+	assert.Nil(t, absence)
+	assert.Equal(t, 1, inclusion.Block().Index)
+	assert.Equal(t, 2, inclusion.Position)
+
+	inclusion, absence, err = client.LookupCert(roster, genesis.Hash, client.GenerateCertificates(1)[0])
+	log.ErrFatal(err)
+	assert.Nil(t, inclusion)
+	assert.Equal(t, 1, absence.Height)
+}
+
+// Bind names to CertChains and resolve them
+func TestNamedSkipchain(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	servers, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	sb, err := client.CreateNamedSkipchain(roster, "*.example.com", cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	id, latest, err := client.ResolveName(roster, "www.example.com")
+	log.ErrFatal(err)
+	assert.Equal(t, sb.Hash, id)
+	assert.Equal(t, sb.Hash, latest.Hash)
+
+	// First come, first served
+	_, err = client.CreateNamedSkipchain(roster, "*.example.com", cb)
+	assert.NotNil(t, err)
+	_, err = client.CreateNamedSkipchain(roster, "Not a name", cb)
+	assert.NotNil(t, err)
+	_, _, err = client.ResolveName(roster, "example.org")
+	assert.NotNil(t, err)
+
+	// A name reserved by a member for another genesis block can't be bound
+	service := local.GetServices(servers, onet.ServiceFactory.ServiceID(Name))[1].(*Service)
+	other := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	_, err = service.ReserveName(&ReserveNameRequest{"www.example.org", other})
+	log.ErrFatal(err)
+	_, err = client.CreateNamedSkipchain(roster, "www.example.org", cb)
+	assert.Equal(t, ErrorNameTaken, err.ErrorCode())
+	_, err = client.CreateNamedSkipchain(roster, "www.example.org", other)
+	log.ErrFatal(err, "Couldn't send")
+}
+
+// Traverse a CertChain with higher forward links in logarithmic steps
+func TestWalkSkipchain(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	genesis, err := client.CreateCustomSkipchain(roster, "", 2, 4, cb)
+	log.ErrFatal(err, "Couldn't send")
+	sb := genesis
+	for i := 0; i < 8; i++ {
+		cb = client.CreateCertBlock(client.GenerateCertificates(5), cb.LatestMTR, client.keyPair)
+		sb, err = client.AddNewTxn(roster, sb, cb)
+		log.ErrFatal(err, "Couldn't send")
+	}
+
+	blocks, err := client.WalkToLatest(roster, genesis.Hash)
+	log.ErrFatal(err)
+	assert.Equal(t, sb.Hash, blocks[len(blocks)-1].Hash)
+	assert.Equal(t, 2, len(blocks))
+
+	blocks, err = client.WalkToIndex(roster, genesis.Hash, 5)
+	log.ErrFatal(err)
+	assert.Equal(t, 3, len(blocks))
+	assert.Equal(t, 5, blocks[2].Index)
+}
+
+// Final rejections are not retried and requests fail over to the other nodes
+func TestClientFailover(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	servers, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+
+	genesisCB := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	genesis, err := client.CreateSkipchain(roster, genesisCB)
+	log.ErrFatal(err, "Couldn't send")
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), genesisCB.LatestMTR, client.keyPair)
+	sb, err := client.AddNewTxn(roster, genesis, cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	_, err = client.AddNewTxn(roster, sb, client.CreateCertBlock(client.GenerateCertificates(5), genesisCB.LatestMTR, client.keyPair))
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorSpent, err.ErrorCode())
+	assert.False(t, IsRetryable(err))
+
+	// A block sent again once it is stored, e.g. after a timeout, is reported as stored
+	again, err := client.AddNewTxn(roster, genesis, cb)
+	log.ErrFatal(err)
+	assert.Equal(t, sb.Hash, again.Hash)
+
+	log.ErrFatal(servers[2].Close())
+	client.Preferred = []network.ServerIdentityID{servers[2].ServerIdentity.ID}
+	client.Timeout = time.Second
+	_, err = client.GetEvidence(roster, genesis.Hash)
+	assert.Nil(t, err)
+}
+
+// Move a CertChain to another roster and keep using it
+func TestChangeRoster(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	servers, _, _ := local.GenTree(4, true)
+	defer local.CloseAll()
+	roster := local.GenRosterFromHost(servers[0], servers[1], servers[2])
+	newRoster := local.GenRosterFromHost(servers[1], servers[2], servers[3])
+
+	certifs := client.GenerateCertificates(5)
+	cb := client.CreateCertBlock(certifs, make([]byte, hashSize), client.keyPair)
+	genesis, err := client.CreateSkipchain(roster, cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	_, err = client.AddNewTxn(newRoster, genesis, client.CreateCertBlock(client.GenerateCertificates(5), cb.LatestMTR, client.keyPair))
+	assert.NotNil(t, err)
+
+	cb = client.CreateCertBlock(nil, cb.LatestMTR, client.keyPair)
+	sb, err := client.ChangeRoster(newRoster, genesis, cb)
+	log.ErrFatal(err, "Couldn't change roster")
+	assert.Equal(t, newRoster.ID, sb.Roster.ID)
+
+	cb = client.CreateCertBlock(client.GenerateCertificates(5), cb.LatestMTR, client.keyPair)
+	sb, err = client.AddNewTxn(newRoster, sb, cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	// The joining node knows the certificates of the genesis block
+	client.Preferred = []network.ServerIdentityID{servers[3].ServerIdentity.ID}
+	inclusion, _, err := client.LookupCert(newRoster, genesis.Hash, certifs[0])
+	log.ErrFatal(err)
+	assert.Equal(t, 0, inclusion.Block().Index)
+
+	// It also knows which MTRs are spent, and only stores blocks linked from the genesis block
+	joined := local.GetServices(servers, onet.ServiceFactory.ServiceID(Name))[3].(*Service)
+	first, eerr := ExtractCertBlock(genesis)
+	log.ErrFatal(eerr)
+	joined.storageMutex.Lock()
+	_, spent := joined.spentTxnMap[string(first.LatestMTR)]
+	joined.storageMutex.Unlock()
+	assert.True(t, spent)
+	assert.NotNil(t, verifyChain([]*skipchain.SkipBlock{sb}))
+}
+
+// Export a CertChain as a bundle and verify it offline
+func TestBundle(t *testing.T) {
+	client := NewClient()
+	bodies := [][]byte{[]byte("first certificate"), []byte("second certificate")}
+	certifs := []crypto.HashID{LeafHash(bodies[0]), LeafHash(bodies[1])}
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	local, roster, genesis := newTestChain(t, client, cb)
+	defer local.CloseAll()
+	cb = client.CreateCertBlock(certifs, cb.LatestMTR, client.keyPair)
+	_, err := client.AddNewTxn(roster, genesis, cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	blocks, err := client.GetChain(roster, genesis.Hash)
+	log.ErrFatal(err)
+	bundle, berr := NewBundle(roster, blocks, bodies)
+	log.ErrFatal(berr)
+	report := bundle.Verify(genesis.Hash, nil)
+	assert.True(t, report.OK(), report.Errors)
+	assert.True(t, bundle.Verify(nil, roster).OK())
+	assert.False(t, bundle.Verify(nil, nil).OK())
+	_, other, _ := local.GenTree(3, false)
+	assert.False(t, bundle.Verify(nil, other).OK())
+	assert.Equal(t, 2, report.Blocks)
+	assert.Equal(t, 7, report.Proofs)
+
+	bundle.Certificates = append(bundle.Certificates, []byte("unknown certificate"))
+	bundle.Proofs[0].Proof = bundle.Proofs[1].Proof
+	assert.Equal(t, 2, len(bundle.Verify(genesis.Hash, nil).Errors))
+}
+
+// Follow the new blocks of a CertChain, checked to be linked, and resume at a given height
+func TestSubscribe(t *testing.T) {
+	client := NewClient()
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	local, roster, genesis := newTestChain(t, client, cb)
+	defer local.CloseAll()
+
+	updates := make(chan *BlockUpdate)
+	stop := make(chan struct{})
+	go client.Subscribe(roster, []skipchain.SkipBlockID{genesis.Hash}, []int{0}, updates, stop)
+	update := <-updates
+	assert.Equal(t, genesis.Hash, update.SkipBlock.Hash)
+	assert.Equal(t, cb.LatestMTR, update.CertBlock.LatestMTR)
+
+	sb := genesis
+	var err onet.ClientError
+	for i := 1; i <= 2; i++ {
+		cb = client.CreateCertBlock(client.GenerateCertificates(5), cb.LatestMTR, client.keyPair)
+		sb, err = client.AddNewTxn(roster, sb, cb)
+		log.ErrFatal(err, "Couldn't send")
+		update = <-updates
+		assert.Equal(t, i, update.SkipBlock.Index)
+		assert.Equal(t, cb.LatestMTR, update.CertBlock.LatestMTR)
+	}
+	close(stop)
+
+	// Resuming delivers the blocks from the given height
+	resumed := make(chan *BlockUpdate)
+	stop = make(chan struct{})
+	defer close(stop)
+	go client.Subscribe(roster, []skipchain.SkipBlockID{genesis.Hash}, []int{2}, resumed, stop)
+	update = <-resumed
+	assert.Equal(t, sb.Hash, update.SkipBlock.Hash)
+
+	// A block that isn't linked from the previous one is refused
+	_, verr := client.verifyUpdate(roster, genesis.Hash, genesis, sb)
+	assert.NotNil(t, verr)
+
+	err = client.Subscribe(roster, []skipchain.SkipBlockID{genesis.Hash}, []int{0, 1}, resumed, stop)
+	assert.NotNil(t, err)
+}
+
+func TestGetSTH(t *testing.T) {
+	client := NewClient()
+	cb := client.CreateCertBlock(client.GenerateCertificates(5), make([]byte, hashSize), client.keyPair)
+	local, roster, genesis := newTestChain(t, client, cb)
+	defer local.CloseAll()
+	cb = client.CreateCertBlock(client.GenerateCertificates(3), cb.LatestMTR, client.keyPair)
+	_, err := client.AddNewTxn(roster, genesis, cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	sth, err := client.GetSTH(roster, genesis.Hash)
+	log.ErrFatal(err)
+	assert.Equal(t, 1, sth.Index)
+	assert.Equal(t, 8, sth.TreeSize)
+	blocks, err := client.GetChain(roster, genesis.Hash)
+	log.ErrFatal(err)
+	entries, verr := CTEntries(blocks)
+	log.ErrFatal(verr)
+	assert.Equal(t, crypto.RFC6962Root(CTLeaves(entries)), sth.RootHash)
+
+	sth.TreeSize++
+	assert.NotNil(t, sth.Verify(roster))
+	_, err = client.GetSTH(roster, cb.LatestMTR)
+	assert.NotNil(t, err)
+}
+
+// Blocks breaking the policy of the genesis block are rejected with the broken rule
+func TestPolicy(t *testing.T) {
+	client := NewClient()
+	cb := client.CreateCertBlock(client.GenerateCertificates(2), make([]byte, hashSize), client.keyPair)
+	cb.Policy = &Policy{MaxBatch: 2, MinInterval: 3600}
+	local, roster, sb := newTestChain(t, client, cb)
+	defer local.CloseAll()
+
+	next := func(n int) func(*CertBlock) *CertBlock {
+		return func(prev *CertBlock) *CertBlock {
+			return client.CreateCertBlock(client.GenerateCertificates(n), prev.LatestMTR, client.keyPair)
+		}
+	}
+	appendBlocks(t, client, roster, sb, cb, []blockCase{
+		{"large batch", next(3), RuleBatch},
+		{"new policy", func(prev *CertBlock) *CertBlock {
+			withPolicy := next(1)(prev)
+			withPolicy.Policy = &Policy{}
+			return withPolicy
+		}, RulePolicy},
+		// The genesis block has just been created, so the interval isn't over
+		{"too soon", next(1), RuleInterval},
+	})
+	_, err := client.AddNewTxn(roster, sb, next(1)(cb))
+	assert.False(t, IsRetryable(err))
+
+	invalid := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	invalid.Policy = &Policy{IssuerPins: [][]byte{{1, 2, 3}}}
+	_, err = client.CreateSkipchain(roster, invalid)
+	assert.Equal(t, RulePolicy, AsPolicyError(err).Rule)
+}
+
+// CertChains with a policy don't accept blocks without timestamp, like CONIKS ones, as they
+// may hide leaves behind their MTR
+func TestPolicyCONIKS(t *testing.T) {
+	client := NewClient()
+	cb := client.CreateCertBlock(client.GenerateCertificates(2), make([]byte, hashSize), client.keyPair)
+	cb.Policy = &Policy{MaxBatch: 2}
+	local, roster, sb := newTestChain(t, client, cb)
+	defer local.CloseAll()
+
+	coniks := client.CreateCertBlockCONIKS(client.GenerateCertificates(1), cb.LatestMTR, client.keyPair)
+	assert.True(t, validMTR(coniks))
+	_, err := client.AddNewTxn(roster, sb, coniks)
+	assert.Equal(t, ErrorTimestamp, err.ErrorCode())
+
+	genesis := client.CreateCertBlockCONIKS(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	genesis.Policy = &Policy{}
+	assert.Equal(t, RulePolicy, genesis.Policy.Check(genesis).(*PolicyError).Rule)
+	_, err = client.CreateSkipchain(roster, genesis)
+	assert.Equal(t, RulePolicy, AsPolicyError(err).Rule)
+
+	// A block with certificates can't skip the recomputation of its MTR by leaving out its timestamp
+	untimestamped := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	untimestamped.Timestamp = 0
+	assert.False(t, validMTR(untimestamped))
+}
+
+// The rules about the certificates are checked against their bodies
+func TestPolicyCheck(t *testing.T) {
+	caDER, caKey := testutil.NewCA(t, "CA")
+	ca, err := x509.ParseCertificate(caDER)
+	log.ErrFatal(err)
+	issue := func(validity time.Duration, names ...string) *Certificate {
+		return &Certificate{Raw: testutil.NewCertificate(t, caDER, caKey, validity, names...), Chain: [][]byte{caDER}}
+	}
+	pin := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	policy := &Policy{IssuerPins: [][]byte{pin[:]}, MaxValidity: 3600, SANPatterns: []string{"*.example.com"}}
+	assert.Nil(t, policy.Validate())
+
+	client := NewClient()
+	check := func(certs ...*Certificate) string {
+		cb := client.CreateCertBlockWithBodies(certs, make([]byte, hashSize), client.keyPair)
+		if err := policy.Check(cb); err != nil {
+			return err.(*PolicyError).Rule
+		}
+		return ""
+	}
+	assert.Equal(t, "", check(issue(time.Hour, "www.example.com")))
+	assert.Equal(t, RuleValidity, check(issue(2*time.Hour, "www.example.com")))
+	assert.Equal(t, RuleSAN, check(issue(time.Hour, "www.example.com", "a.www.example.com")))
+	assert.Equal(t, RuleSAN, check(issue(time.Hour, "example.org")))
+	unpinned := issue(time.Hour, "www.example.com")
+	unpinned.Chain = nil
+	assert.Equal(t, RuleIssuer, check(unpinned))
+
+	cb := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	assert.Equal(t, RuleBodies, policy.Check(cb).(*PolicyError).Rule)
+	assert.NotNil(t, (&Policy{MinInterval: 60}).CheckInterval(time.Now().Add(-time.Second), time.Now()))
+	assert.Nil(t, (&Policy{MinInterval: 60}).CheckInterval(time.Now().Add(-time.Hour), time.Now()))
+}
+
+// Revoke a logged certificate and get its signed revocation status
+func TestRevocation(t *testing.T) {
+	client := NewClient()
+	certs := client.GenerateCertificates(3)
+	cb := client.CreateCertBlock(certs, make([]byte, hashSize), client.keyPair)
+	local, roster, sb := newTestChain(t, client, cb)
+	defer local.CloseAll()
+	id := sb.Hash
+
+	status, err := client.RevocationStatus(roster, id, certs[0])
+	log.ErrFatal(err)
+	assert.False(t, status.Revoked)
+	assert.Nil(t, status.Block)
+
+	unknown := client.CreateRevocationBlock(client.GenerateCertificates(1), nil, cb.LatestMTR, client.keyPair)
+	_, err = client.AddNewTxn(roster, sb, unknown)
+	assert.NotNil(t, err)
+
+	revocation := client.CreateRevocationBlock(certs[:1], nil, cb.LatestMTR, client.keyPair)
+	sb, err = client.AddNewTxn(roster, sb, revocation)
+	log.ErrFatal(err, "Couldn't revoke")
+
+	status, err = client.RevocationStatus(roster, id, certs[0])
+	log.ErrFatal(err)
+	assert.True(t, status.Revoked)
+	assert.Equal(t, sb.Index, status.Index)
+	assert.Equal(t, sb.Index, status.Block.Index)
+
+	status, err = client.RevocationStatus(roster, id, certs[1])
+	log.ErrFatal(err)
+	assert.False(t, status.Revoked)
+	assert.Equal(t, 1, len(status.Set))
+
+	// A revoked certificate can't be revoked again and the set grows
+	again := client.CreateRevocationBlock(certs[:1], certs[:1], revocation.LatestMTR, client.keyPair)
+	_, err = client.AddNewTxn(roster, sb, again)
+	assert.NotNil(t, err)
+	more := client.CreateRevocationBlock(certs[1:2], certs[:1], revocation.LatestMTR, client.keyPair)
+	_, err = client.AddNewTxn(roster, sb, more)
+	log.ErrFatal(err, "Couldn't revoke")
+	status, err = client.RevocationStatus(roster, id, certs[1])
+	log.ErrFatal(err)
+	assert.True(t, status.Revoked)
+
+	// A tampered status doesn't verify
+	status.Revoked = false
+	assert.NotNil(t, status.Verify(roster))
+}
+
+// Records of every type have a canonical encoding and a leaf of their own
+func TestRecords(t *testing.T) {
+	rrset := []byte("WWW.Example.com. 300 in a 192.0.2.2\n; comment\nwww.example.com 300 IN A   192.0.2.1\n")
+	canonical, err := CanonicalRecord(RecordDNS, rrset)
+	log.ErrFatal(err)
+	assert.Equal(t, "www.example.com. 300 IN A 192.0.2.1\nwww.example.com. 300 IN A 192.0.2.2\n", string(canonical))
+	assert.Nil(t, ValidateRecord(RecordDNS, canonical))
+	assert.NotNil(t, ValidateRecord(RecordDNS, rrset))
+	assert.Equal(t, []string{"www.example.com"}, RecordNames(RecordDNS, canonical))
+	_, err = CanonicalRecord(RecordDNS, []byte("www.example.com. 300 IN A 192.0.2.1\nwww.example.com. 300 IN AAAA ::1\n"))
+	assert.NotNil(t, err)
+
+	blob := []byte{0, 0, 0, 11}
+	blob = append(blob, "ssh-ed25519"...)
+	blob = append(blob, 0, 0, 0, 2, 1, 2)
+	key, err := CanonicalRecord(RecordSSH, []byte("ssh-ed25519 "+base64.StdEncoding.EncodeToString(blob)+" root@host\n"))
+	log.ErrFatal(err)
+	assert.Equal(t, blob, key)
+	_, err = CanonicalRecord(RecordSSH, []byte("ssh-rsa "+base64.StdEncoding.EncodeToString(blob)))
+	assert.NotNil(t, err)
+
+	packet := []byte{0x99, 0, 3, 4, 5, 6}
+	armored := "-----BEGIN PGP PUBLIC KEY BLOCK-----\nVersion: test\n\n" +
+		base64.StdEncoding.EncodeToString(packet) + "\n=" + base64.StdEncoding.EncodeToString([]byte{
+		byte(crc24(packet) >> 16), byte(crc24(packet) >> 8), byte(crc24(packet))}) +
+		"\n-----END PGP PUBLIC KEY BLOCK-----\n"
+	pgp, err := CanonicalRecord(RecordPGP, []byte(armored))
+	log.ErrFatal(err)
+	assert.Equal(t, []byte{0xc6, 3, 4, 5, 6}, pgp)
+	// The same key with a new format header and a needlessly long length is the same record
+	long, err := CanonicalRecord(RecordPGP, []byte{0xc6, 255, 0, 0, 0, 3, 4, 5, 6})
+	log.ErrFatal(err)
+	assert.Equal(t, pgp, long)
+	assert.Nil(t, ValidateRecord(RecordPGP, pgp))
+	_, err = CanonicalRecord(RecordPGP, []byte{0xb4, 1, 'a'})
+	assert.NotNil(t, err)
+
+	assert.NotEqual(t, RecordLeafHash(RecordDNS, canonical), RecordLeafHash(RecordSSH, canonical))
+	assert.Equal(t, LeafHash(canonical), RecordLeafHash(RecordX509, canonical))
+
+	AddRecordValidator(RecordSSH, func(canonical []byte) error {
+		return errors.New("no SSH keys")
+	})
+	defer delete(recordValidators, RecordSSH)
+	assert.NotNil(t, ValidateRecord(RecordSSH, key))
+
+	client := NewClient()
+	cb, err := client.CreateRecordBlock(RecordDNS, [][]byte{rrset}, make([]byte, hashSize), client.keyPair)
+	log.ErrFatal(err)
+	assert.Equal(t, RecordDNS, cb.Type)
+	assert.Nil(t, checkRecords(cb))
+	cb.Certificates[0].Raw = rrset
+	assert.NotNil(t, checkRecords(cb))
+	cb.Certificates[0].Raw = canonical
+	assert.Nil(t, (&Policy{SANPatterns: []string{"*.example.com"}}).Check(cb))
+	assert.Equal(t, RuleSAN, (&Policy{SANPatterns: []string{"*.example.org"}}).Check(cb).(*PolicyError).Rule)
+	assert.Equal(t, RuleValidity, (&Policy{MaxValidity: 60}).Check(cb).(*PolicyError).Rule)
+}
+
+// Timestamps have to be close to the clock of the nodes and monotonic, and the first block
+// logging a certificate tells when it was first seen
+func TestTimestamp(t *testing.T) {
+	client := NewClient()
+	certs := client.GenerateCertificates(2)
+	cb := client.CreateCertBlock(certs, make([]byte, hashSize), client.keyPair)
+	assert.NotEqual(t, int64(0), cb.Timestamp)
+	local, roster, sb := newTestChain(t, client, cb)
+	defer local.CloseAll()
+	id := sb.Hash
+
+	// The timestamp is signed by the owner as part of the MTR
+	forged := client.CreateCertBlock(certs[:1], cb.LatestMTR, client.keyPair)
+	forged.Timestamp += 1000
+	_, err := client.AddNewTxn(roster, sb, forged)
+	assert.NotNil(t, err)
+
+	// A timestamp far in the future or older than the previous one is rejected
+	future := &CertBlock{PrevMTR: cb.LatestMTR, PublicKey: client.keyPair.Public, Certs: certs[:1],
+		Timestamp: cb.Timestamp + int64(time.Hour/time.Millisecond)}
+	assert.NotNil(t, checkTimestamp(cb, future, time.Now(), defaultTimestampSkew))
+	past := &CertBlock{Timestamp: cb.Timestamp - 1}
+	assert.NotNil(t, checkTimestamp(cb, past, past.Time(), defaultTimestampSkew))
+	assert.NotNil(t, checkTimestamp(cb, &CertBlock{}, time.Now(), defaultTimestampSkew))
+	assert.Nil(t, checkTimestamp(&CertBlock{}, &CertBlock{}, time.Now(), defaultTimestampSkew))
+
+	next := client.CreateCertBlock(certs[:1], cb.LatestMTR, client.keyPair)
+	sb, err = client.AddNewTxn(roster, sb, next)
+	log.ErrFatal(err, "Couldn't send")
+
+	// The certificate logged again is first seen in the genesis block
+	inclusion, seen, err := client.FirstSeen(roster, id, certs[0])
+	log.ErrFatal(err)
+	assert.Equal(t, 0, inclusion.Block().Index)
+	assert.Equal(t, cb.Time(), seen)
+	inclusion, _, err = client.LookupCert(roster, id, certs[1])
+	log.ErrFatal(err)
+	_, verr := inclusion.Verify(id, certs[1])
+	assert.Nil(t, verr)
+	_, _, err = client.FirstSeen(roster, id, client.GenerateCertificates(1)[0])
+	assert.NotNil(t, err)
+}
+
+// Hashes submitted during the same round get receipts for the same signed root, which verify
+// without contacting the roster
+func TestStamp(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	servers, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+
+	// Rounds are collected by each node, so both clients ask the same one
+	second := NewClient()
+	client.Preferred = []network.ServerIdentityID{roster.List[0].ID}
+	second.Preferred = client.Preferred
+	hashes := client.GenerateCertificates(3)
+	others := make(chan []*Receipt)
+	go func() {
+		receipts, err := second.Stamp(roster, hashes[2:])
+		log.ErrFatal(err)
+		others <- receipts
+	}()
+	receipts, err := client.Stamp(roster, hashes[:2])
+	log.ErrFatal(err)
+	assert.Equal(t, 2, len(receipts))
+	other := <-others
+	for _, rc := range append(receipts, other...) {
+		assert.Nil(t, rc.Verify(roster))
+		assert.Equal(t, receipts[0].Root, rc.Root)
+		assert.True(t, time.Since(rc.Time()) < time.Minute)
+	}
+	assert.Equal(t, hashes[2], other[0].Hash)
+
+	forged := *receipts[0]
+	forged.Hash = hashes[2]
+	assert.NotNil(t, forged.Verify(roster))
+	forged = *receipts[0]
+	forged.Timestamp -= 1000
+	assert.NotNil(t, forged.Verify(roster))
+
+	// The members refuse to sign a round backdated beyond their clock skew
+	service := local.GetServices(servers, onet.ServiceFactory.ServiceID(Name))[1].(*Service)
+	past := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+	_, err = service.SignStamp(&SignStampRequest{receipts[0].Root, past})
+	assert.Equal(t, ErrorTimestamp, err.ErrorCode())
+
+	_, err = client.Stamp(roster, nil)
+	assert.NotNil(t, err)
+}
+
+// The leader has the heads of all the CertChains of its roster signed, and a client requiring a
+// fresh heartbeat rejects results older than the head it states
+func TestHeartbeat(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	servers, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(Name))
+
+	cb := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	sb, err := client.CreateSkipchain(roster, cb)
+	log.ErrFatal(err, "Couldn't send")
+	id := sb.Hash
+	other := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	_, err = client.CreateSkipchain(roster, other)
+	log.ErrFatal(err, "Couldn't send")
+
+	_, err = client.GetHeartbeat(roster, id)
+	assert.NotNil(t, err)
+	services[0].(*Service).sendHeartbeats()
+	hb, err := client.GetHeartbeat(roster, id)
+	log.ErrFatal(err)
+	assert.Equal(t, 0, hb.Head.Index)
+	assert.Equal(t, sb.Hash, hb.Head.BlockID)
+	assert.Nil(t, hb.Verify(roster))
+	forged := *hb
+	forged.Head = &HeartbeatHead{id, 1, sb.Hash}
+	assert.NotNil(t, forged.Verify(roster))
+	forged = *hb
+	forged.Signatures = [][]byte{hb.Signatures[0], nil, nil}
+	assert.NotNil(t, forged.Verify(roster))
+
+	// A member doesn't sign a head older than the latest block it knows
+	cb = client.CreateCertBlock(client.GenerateCertificates(1), cb.LatestMTR, client.keyPair)
+	_, err = client.AddNewTxn(roster, sb, cb)
+	log.ErrFatal(err, "Couldn't send")
+	_, err = services[1].(*Service).SignHeartbeat(&SignHeartbeatRequest{roster, []*HeartbeatHead{hb.Head},
+		time.Now().UnixNano() / int64(time.Millisecond)})
+	assert.NotNil(t, err)
+
+	services[0].(*Service).sendHeartbeats()
+	client.MaxHeartbeatAge = time.Minute
+	latest, err := client.GetLatest(roster, id)
+	log.ErrFatal(err)
+	assert.Equal(t, 1, latest.Index)
+	assert.Nil(t, client.checkHeartbeat(roster, id, 1))
+	assert.NotNil(t, client.checkHeartbeat(roster, id, 0))
+
+	// A round dated in the future isn't stored, even if the roster signed it
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	heads := []*HeartbeatHead{{id, latest.Index, latest.Hash}}
+	root, _ := heartbeatTree(heads)
+	sigs := make([][]byte, len(services))
+	for i, s := range services {
+		sigs[i], _ = sign.Schnorr(suite, s.(*Service).Private(), heartbeatMessage(root, future))
+	}
+	services[0].(*Service).propagateHeartbeatMap(&HeartbeatRound{Roster: roster, Heads: heads, Timestamp: future, Signatures: sigs})
+	reply, err := services[0].(*Service).GetHeartbeat(&GetHeartbeatRequest{id})
+	log.ErrFatal(err)
+	assert.True(t, reply.Heartbeat.Timestamp < future)
+	client.MaxHeartbeatAge = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	_, err = client.GetLatest(roster, id)
+	assert.NotNil(t, err)
+}
+
+// A policy requiring CA attestations only accepts certificates their CA signed the batch of
+func TestAttestation(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	caDER, caKey := testutil.NewCA(t, "CA")
+	otherDER, otherKey := testutil.NewCA(t, "Other CA")
+	issue := func(name string) *Certificate {
+		return &Certificate{Raw: testutil.NewCertificate(t, caDER, caKey, time.Hour, name), Chain: [][]byte{caDER}}
+	}
+
+	genesis := client.CreateCertBlockWithBodies([]*Certificate{issue("www.example.com")}, make([]byte, hashSize), client.keyPair)
+	assert.NotNil(t, (&Policy{RequireCAAttestation: true}).Validate())
+	ca, perr := x509.ParseCertificate(caDER)
+	log.ErrFatal(perr)
+	pin := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	genesis.Policy = &Policy{IssuerPins: [][]byte{pin[:]}, RequireCAAttestation: true}
+	_, err := client.CreateSkipchain(roster, genesis)
+	assert.Equal(t, RuleAttestation, AsPolicyError(err).Rule)
+	attestation, aerr := NewCAAttestation(genesis, caDER, caKey)
+	log.ErrFatal(aerr)
+	genesis.Attestations = []*CAAttestation{attestation}
+	sb, err := client.CreateSkipchain(roster, genesis)
+	log.ErrFatal(err, "Couldn't send")
+
+	// Another CA can't attest certificates it didn't issue, nor sign for the CA
+	next := client.CreateCertBlockWithBodies([]*Certificate{issue("a.example.com"), issue("b.example.com")}, genesis.LatestMTR, client.keyPair)
+	_, aerr = NewCAAttestation(next, otherDER, otherKey)
+	assert.NotNil(t, aerr)
+	forged, aerr := NewCAAttestation(next, caDER, otherKey)
+	log.ErrFatal(aerr)
+	next.Attestations = []*CAAttestation{forged}
+	_, err = client.AddNewTxn(roster, sb, next)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorParameter, err.ErrorCode())
+	attestation, aerr = NewCAAttestation(next, caDER, caKey)
+	log.ErrFatal(aerr)
+	next.Attestations = []*CAAttestation{attestation}
+	_, err = client.AddNewTxn(roster, sb, next)
+	log.ErrFatal(err, "Couldn't send")
+
+	// Attestations are checked even without a policy requiring them, and only hold on top of
+	// the PrevMTR they were made for
+	cb := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	cb.Attestations = []*CAAttestation{attestation}
+	assert.NotNil(t, checkRecords(cb))
+	replay := client.CreateCertBlockWithBodies(next.Certificates, make([]byte, hashSize), client.keyPair)
+	replay.Attestations = []*CAAttestation{attestation}
+	assert.NotNil(t, checkRecords(replay))
+}
+
+// Sub-keys append blocks under the delegations published by the owner, within their constraints
+func TestDelegation(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	owner := client.keyPair
+	delegate := config.NewKeyPair(suite)
+	d := client.CreateDelegation(delegate.Public, []string{"example.com"}, time.Now().Add(time.Hour), 2, owner)
+	genesis := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), owner)
+	genesis.Delegations = []*Delegation{d}
+	sb, err := client.CreateSkipchain(roster, genesis)
+	log.ErrFatal(err, "Couldn't send")
+	first := sb
+
+	delegated := func(prevMTR []byte, d *Delegation, names ...string) *CertBlock {
+		certs := make([]*Certificate, len(names))
+		for i, name := range names {
+			certs[i] = &Certificate{Raw: testutil.NewCertificate(t, nil, nil, time.Hour, name)}
+		}
+		return DelegateBlock(client.CreateCertBlockWithBodies(certs, prevMTR, delegate), owner.Public, d)
+	}
+	cb := delegated(genesis.LatestMTR, d, "www.example.com")
+	sb, err = client.AddNewTxn(roster, sb, cb)
+	log.ErrFatal(err, "Couldn't send")
+	assert.Nil(t, verifyBackLink(first, sb))
+
+	// Names outside of the suffixes and certificates beyond the maximum are rejected
+	_, err = client.AddNewTxn(roster, sb, delegated(cb.LatestMTR, d, "www.example.org"))
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorDelegation, err.ErrorCode())
+	assert.False(t, IsRetryable(err))
+	_, err = client.AddNewTxn(roster, sb, delegated(cb.LatestMTR, d, "a.example.com", "b.example.com"))
+	assert.Equal(t, ErrorDelegation, err.ErrorCode())
+
+	// Only published delegations count, and a delegate can't take over the CertChain
+	unpublished := client.CreateDelegation(delegate.Public, nil, time.Time{}, 0, owner)
+	_, err = client.AddNewTxn(roster, sb, delegated(cb.LatestMTR, unpublished, "a.example.com"))
+	assert.Equal(t, ErrorDelegation, err.ErrorCode())
+	takeover := delegated(cb.LatestMTR, d, "a.example.com")
+	takeover.PublicKey = delegate.Public
+	assert.NotNil(t, checkDelegation(owner.Public, takeover))
+	expired := client.CreateDelegation(delegate.Public, nil, time.Now().Add(-time.Hour), 0, owner)
+	assert.NotNil(t, checkDelegation(owner.Public, delegated(cb.LatestMTR, expired, "a.example.com")))
+	forged := client.CreateDelegation(delegate.Public, nil, time.Time{}, 0, delegate)
+	assert.NotNil(t, checkDelegation(owner.Public, delegated(cb.LatestMTR, forged, "a.example.com")))
+
+	_, err = client.AddNewTxn(roster, sb, delegated(cb.LatestMTR, d, "a.example.com"))
+	log.ErrFatal(err, "Couldn't send")
+}
+
+// A named CertChain is only created, and its key only changed, if the domain publishes the key
+func TestDomainValidation(t *testing.T) {
+	client := NewClient()
+	local := onet.NewTCPTest()
+	servers, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	for _, s := range local.GetServices(servers, onet.ServiceFactory.ServiceID(Name)) {
+		s.(*Service).domainValidation = []string{"dns", "http"}
+	}
+	records := fakeResolver{}
+	files := make(map[string]string)
+	dns, web := domainValidators["dns"], domainValidators["http"]
+	RegisterDomainValidator("dns", &DNSValidator{records})
+	RegisterDomainValidator("http", &HTTPValidator{&http.Client{Transport: fakeTransport(files)}})
+	defer func() {
+		RegisterDomainValidator("dns", dns)
+		RegisterDomainValidator("http", web)
+	}()
+
+	cb := client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, hashSize), client.keyPair)
+	_, err := client.CreateNamedSkipchain(roster, "www.example.com", cb)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorDomain, err.ErrorCode())
+	assert.False(t, IsRetryable(err))
+	records["_certchain.www.example.com"] = []string{"v=other", "certchain-key=" + KeyString(client.keyPair.Public)}
+	sb, err := client.CreateNamedSkipchain(roster, "www.example.com", cb)
+	log.ErrFatal(err, "Couldn't send")
+
+	// A block handing the CertChain to a new key needs the new key to be published
+	kp := config.NewKeyPair(suite)
+	next := client.CreateCertBlock(client.GenerateCertificates(1), cb.LatestMTR, client.keyPair)
+	next.PublicKey = kp.Public
+	_, err = client.AddNewTxn(roster, sb, next)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorDomain, err.ErrorCode())
+	files["www.example.com"] = "# owner keys\n" + KeyString(kp.Public) + "\n"
+	sb, err = client.AddNewTxn(roster, sb, next)
+	log.ErrFatal(err, "Couldn't send")
+
+	// The key stays the same, so the domain isn't asked again
+	delete(files, "www.example.com")
+	_, err = client.AddNewTxn(roster, sb, client.CreateCertBlock(client.GenerateCertificates(1), next.LatestMTR, kp))
+	log.ErrFatal(err, "Couldn't send")
+
+	records["_certchain.example.org"] = []string{"certchain-key=" + KeyString(kp.Public)}
+	assert.Nil(t, validateDomain([]string{"dns"}, "*.example.org", kp.Public))
+	assert.NotNil(t, validateDomain([]string{"dns"}, "*.example.org", client.keyPair.Public))
+	assert.Nil(t, validateDomain(nil, "www.example.net", kp.Public))
+}
+
+// fakeResolver answers TXT lookups from a map
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := r[name]; ok {
+		return records, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+// fakeTransport serves the well-known files of the domains from a map
+type fakeTransport map[string]string
+
+func (f fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := f[req.URL.Host]
+	if !ok || req.URL.Path != "/.well-known/certchain" {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found",
+			Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK",
+		Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+// newTestChain starts a roster of 3 nodes and creates a CertChain with the genesis block on it.
+// The caller has to close local.
+func newTestChain(t *testing.T, client *Client, genesis *CertBlock) (*onet.LocalTest, *onet.Roster, *skipchain.SkipBlock) {
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(3, true)
+	sb, err := client.CreateSkipchain(roster, genesis)
+	if err != nil {
+		local.CloseAll()
+		t.Fatal("Couldn't send:", err)
+	}
+	return local, roster, sb
+}
+
+// blockCase is a block built on top of the latest block of a test CertChain and the policy rule
+// it breaks
+type blockCase struct {
+	name  string
+	block func(prev *CertBlock) *CertBlock
+	rule  string
+}
+
+// appendBlocks appends the block of each case to the CertChain, whose latest block is sb holding
+// prev, and checks that it is rejected with its rule
+func appendBlocks(t *testing.T, client *Client, r *onet.Roster, sb *skipchain.SkipBlock, prev *CertBlock, cases []blockCase) {
+	for _, c := range cases {
+		_, err := client.AddNewTxn(r, sb, c.block(prev))
+		if assert.NotNil(t, AsPolicyError(err), c.name) {
+			assert.Equal(t, c.rule, AsPolicyError(err).Rule, c.name)
+		}
+	}
+}
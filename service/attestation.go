@@ -0,0 +1,143 @@
+package certchain
+
+/*
+The attestation.go lets the CA that issued the certificates of a CertBlock
+attest them. The CA signs the PrevMTR of the block and the root of the tree of
+the leaves of the certificates it issued in it, so that the attestation can't
+be replayed in another block, and the nodes check the signature against
+the key of the issuing certificate sent along with the bodies. A policy can
+require every certificate to be attested by one of its pinned issuers, so that
+both the owner and the CA have to agree before a certificate is logged.
+*/
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"strconv"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+)
+
+// AttestationMessage returns the message a CA signs to attest the certificates with the given
+// leaves in the CertBlock on top of prevMTR: a prefix, the PrevMTR and the root of their tree
+func AttestationMessage(prevMTR []byte, leaves []crypto.HashID) []byte {
+	root, _ := crypto.ProofTree(sha256.New, leaves)
+	msg := append([]byte("certchain ca attestation"), prevMTR...)
+	return append(msg, root...)
+}
+
+// issuedBy returns the positions of the certificates of a CertBlock whose chain starts with the
+// issuing certificate, given its DER encoding
+func issuedBy(cb *CertBlock, issuer []byte) []int {
+	var positions []int
+	for i, c := range cb.Certificates {
+		if c != nil && len(c.Chain) > 0 && bytes.Equal(c.Chain[0], issuer) {
+			positions = append(positions, i)
+		}
+	}
+	return positions
+}
+
+// attestationAlgorithm returns the signature algorithm of an attestation by a CA with the key
+func attestationAlgorithm(key interface{}) x509.SignatureAlgorithm {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// NewCAAttestation signs the certificates of a CertBlock issued by the CA, given the DER
+// encoding of its certificate and its private key. The bodies of the certificates have to be
+// in the CertBlock with their chain, and its PrevMTR has to be set.
+func NewCAAttestation(cb *CertBlock, issuer []byte, key gocrypto.Signer) (*CAAttestation, error) {
+	positions := issuedBy(cb, issuer)
+	if len(positions) == 0 {
+		return nil, errors.New("no certificate of the block is issued by the CA")
+	}
+	leaves := make([]crypto.HashID, len(positions))
+	for i, pos := range positions {
+		leaves[i] = cb.Certs[pos]
+	}
+	msg := AttestationMessage(cb.PrevMTR, leaves)
+	var sig []byte
+	var err error
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		sig, err = key.Sign(rand.Reader, msg, gocrypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(msg)
+		sig, err = key.Sign(rand.Reader, digest[:], gocrypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CAAttestation{Issuer: issuer, Signature: sig}, nil
+}
+
+// verifyAttestation checks an attestation of a CertBlock and returns the positions of the
+// certificates it attests. They have to be issued by the CA and signed by its key.
+func verifyAttestation(cb *CertBlock, a *CAAttestation) ([]int, error) {
+	if a == nil {
+		return nil, errors.New("empty attestation")
+	}
+	issuer, err := x509.ParseCertificate(a.Issuer)
+	if err != nil {
+		return nil, errors.New("issuing certificate can't be parsed")
+	}
+	positions := issuedBy(cb, a.Issuer)
+	if len(positions) == 0 {
+		return nil, errors.New("attestation of " + issuer.Subject.CommonName + " covers no certificate")
+	}
+	leaves := make([]crypto.HashID, len(positions))
+	for i, pos := range positions {
+		cert, err := x509.ParseCertificate(cb.Certificates[pos].Raw)
+		if err != nil {
+			return nil, errors.New("certificate " + strconv.Itoa(pos) + " can't be parsed")
+		}
+		if err := cert.CheckSignatureFrom(issuer); err != nil {
+			return nil, errors.New("certificate " + strconv.Itoa(pos) + " isn't issued by the CA: " + err.Error())
+		}
+		leaves[i] = cb.Certs[pos]
+	}
+	algorithm := attestationAlgorithm(issuer.PublicKey)
+	if err := issuer.CheckSignature(algorithm, AttestationMessage(cb.PrevMTR, leaves), a.Signature); err != nil {
+		return nil, errors.New("wrong attestation of " + issuer.Subject.CommonName + ": " + err.Error())
+	}
+	return positions, nil
+}
+
+// checkAttestations checks the CA attestations of a CertBlock and returns which of its
+// certificates are attested
+func checkAttestations(cb *CertBlock) ([]bool, error) {
+	attested := make([]bool, len(cb.Certs))
+	if len(cb.Attestations) == 0 {
+		return attested, nil
+	}
+	if cb.Type != RecordX509 {
+		return nil, errors.New(cb.Type.String() + " records can't be attested by a CA")
+	}
+	if len(cb.Certificates) != len(cb.Certs) {
+		return nil, errors.New("attested certificates need their bodies")
+	}
+	for _, a := range cb.Attestations {
+		positions, err := verifyAttestation(cb, a)
+		if err != nil {
+			return nil, err
+		}
+		for _, pos := range positions {
+			attested[pos] = true
+		}
+	}
+	return attested, nil
+}
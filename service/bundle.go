@@ -0,0 +1,217 @@
+package certchain
+
+/*
+The bundle.go defines a self-contained export of a CertChain that can be
+verified without access to the cothority.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/sign"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// NewBundle creates the bundle of a CertChain from all its blocks, starting with the
+// genesis block, and the optional DER encodings of the logged certificates
+func NewBundle(r *onet.Roster, blocks []*skipchain.SkipBlock, certificates [][]byte) (*Bundle, error) {
+	b := &Bundle{Roster: r, Blocks: blocks, Certificates: certificates}
+	for _, sb := range blocks {
+		cb, err := ExtractCertBlock(sb)
+		if err != nil {
+			return nil, err
+		}
+		_, proofs := crypto.ProofTree(sha256.New, cb.Certs)
+		for i, p := range proofs {
+			b.Proofs = append(b.Proofs, &BundleProof{sb.Index, i, append(crypto.Proof{prevLeaf(cb.PrevMTR, cb.Timestamp)}, p...)})
+		}
+	}
+	return b, nil
+}
+
+// Verify checks the whole bundle offline: the hashes and forward links of the blocks,
+// the owner signatures, the PrevMTR linkage, the Merkle proofs and that every
+// certificate body is logged. The bundle is anchored in the ID of the genesis block or
+// in the roster the caller trusts, at least one of them is needed; the roster has to hold
+// the same keys as the genesis block. All problems found are listed in the report.
+func (b *Bundle) Verify(trusted skipchain.SkipBlockID, r *onet.Roster) *BundleReport {
+	report := &BundleReport{}
+	if len(b.Blocks) == 0 || b.Roster == nil {
+		report.addError(errors.New("bundle has no roster or no blocks"))
+		return report
+	}
+	if len(trusted) == 0 && r == nil {
+		report.addError(errors.New("the trusted genesis block or roster is needed"))
+		return report
+	}
+	genesis := b.Blocks[0]
+	if genesis.Index != 0 {
+		report.addError(errors.New("first block is not a genesis block"))
+	} else if !sameKeys(genesis.Roster, b.Roster) {
+		report.addError(errors.New("genesis block has another roster"))
+	}
+	if len(trusted) > 0 && !bytes.Equal(genesis.Hash, trusted) {
+		report.addError(errors.New("bundle is about another CertChain"))
+	}
+	if r != nil && !sameKeys(genesis.Roster, r) {
+		report.addError(errors.New("genesis block isn't signed by the trusted roster"))
+	}
+	report.addError(VerifyGenesis(genesis))
+	leaves := make(map[string]bool)
+	for i, sb := range b.Blocks {
+		if i > 0 {
+			report.addError(VerifyBlockLink(b.Blocks[i-1], sb))
+		}
+		if cb, err := ExtractCertBlock(sb); err == nil {
+			for _, cert := range cb.Certs {
+				leaves[string(cert)] = true
+			}
+		}
+		report.Blocks++
+	}
+	report.Certificates = len(leaves)
+	for _, p := range b.Proofs {
+		report.addError(b.verifyProof(p))
+		report.Proofs++
+	}
+	for _, body := range b.Certificates {
+		if !leaves[string(LeafHash(body))] {
+			report.addError(errors.New("certificate body " + hex.EncodeToString(LeafHash(body)) + " is not logged"))
+		}
+		report.Bodies++
+	}
+	return report
+}
+
+// sameKeys returns true if both rosters list the same members with the same keys
+func sameKeys(a, b *onet.Roster) bool {
+	if a == nil || b == nil || len(a.List) != len(b.List) {
+		return false
+	}
+	for i, si := range a.List {
+		if !si.ID.Equal(b.List[i].ID) || !si.Public.Equal(b.List[i].Public) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyProof checks a Merkle proof against the block it refers to
+func (b *Bundle) verifyProof(p *BundleProof) error {
+	if p.Index < 0 || p.Index >= len(b.Blocks) {
+		return errors.New("proof for unknown block " + strconv.Itoa(p.Index))
+	}
+	cb, err := ExtractCertBlock(b.Blocks[p.Index])
+	if err != nil {
+		return err
+	}
+	if p.Position < 0 || p.Position >= len(cb.Certs) {
+		return errors.New("proof for unknown position in block " + strconv.Itoa(p.Index))
+	}
+	if !p.Proof.Check(sha256.New, cb.LatestMTR, cb.Certs[p.Position]) {
+		return errors.New("wrong Merkle proof in block " + strconv.Itoa(p.Index))
+	}
+	return nil
+}
+
+// OK returns true if no problem has been found
+func (r *BundleReport) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// addError adds err to the report, unless it is nil
+func (r *BundleReport) addError(err error) {
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// ExtractCertBlock returns the CertBlock stored in a block
+func ExtractCertBlock(sb *skipchain.SkipBlock) (*CertBlock, error) {
+	_, msg, err := network.Unmarshal(sb.Data)
+	if err != nil {
+		return nil, err
+	}
+	cb, ok := msg.(*CertBlock)
+	if !ok {
+		return nil, errors.New("block " + strconv.Itoa(sb.Index) + " doesn't hold a CertBlock")
+	}
+	return cb, nil
+}
+
+// VerifyGenesis checks the hash of the genesis block and the signature and MTR of its CertBlock
+func VerifyGenesis(genesis *skipchain.SkipBlock) error {
+	if !bytes.Equal(genesis.Hash, genesis.CalculateHash()) {
+		return errors.New("wrong hash of the genesis block")
+	}
+	cb, err := ExtractCertBlock(genesis)
+	if err != nil {
+		return err
+	}
+	if err := sign.VerifySchnorr(suite, cb.PublicKey, cb.LatestMTR, cb.LatestSignedMTR); err != nil {
+		return errors.New("wrong owner signature in the genesis block")
+	}
+	if !validMTR(cb) {
+		return errors.New("wrong MTR in the genesis block")
+	}
+	return nil
+}
+
+// VerifyBlockLink checks that next is the block following prev: the hash of next, the signed
+// forward link of prev to it, that the CertBlock of next extends the MTR of prev and that it is
+// signed with the owner key of prev, or by a delegate of it
+func VerifyBlockLink(prev, next *skipchain.SkipBlock) error {
+	index := strconv.Itoa(next.Index)
+	if !bytes.Equal(next.Hash, next.CalculateHash()) {
+		return errors.New("wrong hash of block " + index)
+	}
+	if len(prev.ForwardLink) == 0 || !bytes.Equal(prev.ForwardLink[0].Hash, next.Hash) {
+		return errors.New("missing forward link to block " + index)
+	}
+	if err := prev.VerifyForwardSignatures(); err != nil {
+		return errors.New("wrong forward link signature to block " + index + ": " + err.Error())
+	}
+	return verifyBackLink(prev, next)
+}
+
+// verifyBackLink checks that next points back to prev, that the CertBlock of next extends the
+// MTR of prev and that it is signed with the owner key of prev, or by a delegate of it. Unlike
+// VerifyBlockLink it doesn't need the forward link of prev, which is only added once next is
+// stored.
+func verifyBackLink(prev, next *skipchain.SkipBlock) error {
+	index := strconv.Itoa(next.Index)
+	if next.Index != prev.Index+1 {
+		return errors.New("block " + index + " doesn't follow block " + strconv.Itoa(prev.Index))
+	}
+	if len(next.BackLinkIDs) == 0 || !bytes.Equal(next.BackLinkIDs[0], prev.Hash) {
+		return errors.New("wrong back link of block " + index)
+	}
+	cbPrev, err := ExtractCertBlock(prev)
+	if err != nil {
+		return err
+	}
+	cb, err := ExtractCertBlock(next)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cb.PrevMTR, cbPrev.LatestMTR) {
+		return errors.New("PrevMTR of block " + index + " isn't the MTR of the previous block")
+	}
+	if err := sign.VerifySchnorr(suite, signingKey(cbPrev.PublicKey, cb), cb.LatestMTR, cb.LatestSignedMTR); err != nil {
+		return errors.New("wrong owner signature in block " + index)
+	}
+	if err := checkDelegation(cbPrev.PublicKey, cb); err != nil {
+		return errors.New("block " + index + ": " + err.Error())
+	}
+	if !validMTR(cb) {
+		return errors.New("wrong MTR in block " + index)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package certchain
+
+/*
+The ct.go maps a CertChain to a log with the Merkle tree hashing of RFC 6962:
+every logged certificate is an entry, in the order it is logged, and the
+entries are the leaves of a position-aware Merkle tree whose head is signed by
+a node. It isn't a Certificate Transparency log, the entries are leaf hashes
+and the head is signed with the Schnorr key of the node.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/sign"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// CTEntries returns the entries of the log of a CertChain, given all its blocks from the
+// genesis block on. An entry is the leaf under which a certificate is logged.
+func CTEntries(blocks []*skipchain.SkipBlock) ([]crypto.HashID, error) {
+	var entries []crypto.HashID
+	for _, sb := range blocks {
+		cb, err := ExtractCertBlock(sb)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, cb.Certs...)
+	}
+	return entries, nil
+}
+
+// CTLeaves returns the RFC 6962 leaf hashes of the entries
+func CTLeaves(entries []crypto.HashID) []crypto.HashID {
+	leaves := make([]crypto.HashID, len(entries))
+	for i, entry := range entries {
+		leaves[i] = crypto.RFC6962LeafHash(entry)
+	}
+	return leaves
+}
+
+// TreeHeadSignature returns the TreeHeadSignature structure of RFC 6962 (section 3.5) for the
+// tree head: version v1, signature type tree_hash, timestamp, tree size and root hash
+func (sth *SignedTreeHead) TreeHeadSignature() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 1})
+	binary.Write(&buf, binary.BigEndian, uint64(sth.Timestamp))
+	binary.Write(&buf, binary.BigEndian, uint64(sth.TreeSize))
+	buf.Write(sth.RootHash)
+	return buf.Bytes()
+}
+
+// Hash returns the hash of the tree head that is signed by the node. It binds the
+// TreeHeadSignature to the CertChain and to the block the tree goes up to.
+func (sth *SignedTreeHead) Hash() []byte {
+	h := sha256.New()
+	h.Write(sth.SkipchainID)
+	binary.Write(h, binary.LittleEndian, int64(sth.Index))
+	h.Write(sth.TreeHeadSignature())
+	return h.Sum(nil)
+}
+
+// Verify checks that the tree head is signed with the key the roster holds for the signer
+func (sth *SignedTreeHead) Verify(r *onet.Roster) error {
+	if sth.Signer == nil {
+		return errors.New("tree head is not signed")
+	}
+	i, signer := r.Search(sth.Signer.ID)
+	if i < 0 {
+		return errors.New("signer is not part of the roster")
+	}
+	return sign.VerifySchnorr(suite, signer.Public, sth.Hash(), sth.Signature)
+}
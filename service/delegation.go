@@ -0,0 +1,220 @@
+package certchain
+
+/*
+The delegation.go lets the owner of a CertChain keep its key offline. The
+owner signs a Delegation authorizing a sub-key under constraints, name
+suffixes, an expiry and a maximum number of certificates, and publishes it in
+a block it signs. A block signed by the sub-key carries the Delegation and may
+only log records within its constraints: it can't change the owner key, the
+policy or the delegations, nor revoke certificates. The nodes only accept
+delegations published in the CertChain, and count the certificates logged
+under each of them. Changing the owner key ends all the delegations.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/crypto.v0/sign"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// Hash returns the hash of the delegation that is signed by the owner
+func (d *Delegation) Hash() []byte {
+	h := sha256.New()
+	if d.Key != nil {
+		if buf, err := d.Key.MarshalBinary(); err == nil {
+			h.Write(buf)
+		}
+	}
+	for _, suffix := range d.Suffixes {
+		h.Write([]byte(suffix))
+		h.Write([]byte{0})
+	}
+	binary.Write(h, binary.BigEndian, d.Expiry)
+	binary.Write(h, binary.BigEndian, int64(d.MaxCerts))
+	return h.Sum(nil)
+}
+
+// Verify checks that the delegation is well-formed and signed by the owner key
+func (d *Delegation) Verify(owner abstract.Point) error {
+	if d.Key == nil {
+		return errors.New("delegation without key")
+	}
+	if d.MaxCerts < 0 || d.Expiry < 0 {
+		return errors.New("delegation limits must not be negative")
+	}
+	for _, suffix := range d.Suffixes {
+		if strings.Trim(suffix, ".") == "" {
+			return errors.New("empty name suffix in delegation")
+		}
+	}
+	if err := sign.VerifySchnorr(suite, owner, d.Hash(), d.Signature); err != nil {
+		return errors.New("delegation is not signed by the owner")
+	}
+	return nil
+}
+
+// allowedName returns true if the name is one of the suffixes or under one of them
+func (d *Delegation) allowedName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, suffix := range d.Suffixes {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateDelegation builds a delegation to the key, signed by the key pair of the owner. A zero
+// expiry or maxCerts and no suffixes leave the delegate unconstrained in that respect.
+func (c *Client) CreateDelegation(key abstract.Point, suffixes []string, expiry time.Time, maxCerts int, owner *config.KeyPair) *Delegation {
+	d := &Delegation{Key: key, Suffixes: suffixes, MaxCerts: maxCerts}
+	if !expiry.IsZero() {
+		d.Expiry = expiry.UnixNano() / int64(time.Millisecond)
+	}
+	sig, err := sign.Schnorr(suite, owner.Secret, d.Hash())
+	if err != nil {
+		return nil
+	}
+	d.Signature = sig
+	return d
+}
+
+// DelegateBlock turns a CertBlock built and signed with the key pair of a delegate, e.g. by
+// CreateCertBlockWithBodies, into a block appended under the delegation. owner is the current
+// key of the owner, which the block keeps.
+func DelegateBlock(cb *CertBlock, owner abstract.Point, d *Delegation) *CertBlock {
+	cb.PublicKey = owner
+	cb.Delegation = d
+	return cb
+}
+
+// signingKey returns the key the CertBlock has to be signed with, given the key of the owner:
+// the key of its delegation, if any, or the key of the owner
+func signingKey(owner abstract.Point, cb *CertBlock) abstract.Point {
+	if cb.Delegation != nil && cb.Delegation.Key != nil {
+		return cb.Delegation.Key
+	}
+	return owner
+}
+
+// checkDelegation checks the delegations of a CertBlock signed by the given key of the owner:
+// the ones it publishes have to be signed by the owner, and a block appended under a delegation
+// has to stay within its constraints. The number of certificates logged under the delegation
+// in the previous blocks isn't known here, see Service.verifyDelegation.
+func checkDelegation(owner abstract.Point, cb *CertBlock) error {
+	for i, d := range cb.Delegations {
+		if d == nil {
+			return errors.New("empty delegation " + strconv.Itoa(i))
+		}
+		if err := d.Verify(owner); err != nil {
+			return errors.New("delegation " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	d := cb.Delegation
+	if d == nil {
+		return nil
+	}
+	if err := d.Verify(owner); err != nil {
+		return err
+	}
+	switch {
+	case cb.PublicKey == nil || !cb.PublicKey.Equal(owner):
+		return errors.New("a delegate can't change the owner key")
+	case cb.Policy != nil:
+		return errors.New("a delegate can't set the policy")
+	case len(cb.Delegations) > 0:
+		return errors.New("a delegate can't publish delegations")
+	case len(cb.Revoked) > 0 || len(cb.RevocationRoot) > 0:
+		return errors.New("a delegate can't revoke certificates")
+	}
+	if cb.Timestamp == 0 || (d.Expiry > 0 && cb.Timestamp > d.Expiry) {
+		return errors.New("delegation has expired")
+	}
+	if d.MaxCerts > 0 && len(cb.Certs) > d.MaxCerts {
+		return errors.New(strconv.Itoa(len(cb.Certs)) + " certificates, the delegation allows " +
+			strconv.Itoa(d.MaxCerts))
+	}
+	if len(d.Suffixes) == 0 {
+		return nil
+	}
+	if len(cb.Certificates) != len(cb.Certs) {
+		return errors.New("the delegation needs the bodies of all the records")
+	}
+	for i, c := range cb.Certificates {
+		names := RecordNames(cb.Type, c.Raw)
+		if len(names) == 0 {
+			return errors.New("record " + strconv.Itoa(i) + " has no names")
+		}
+		for _, name := range names {
+			if !d.allowedName(name) {
+				return errors.New(strconv.Quote(name) + " is outside of the delegation")
+			}
+		}
+	}
+	return nil
+}
+
+// verifyDelegation checks that the delegation of a CertBlock appended after latest is
+// published in the CertChain and that the certificates logged under it stay within its
+// maximum. storageMutex must be held by the caller.
+func (s *Service) verifyDelegation(latest *skipchain.SkipBlock, cb *CertBlock) error {
+	if cb.Delegation == nil {
+		return nil
+	}
+	chain := s.chainMap[string(latest.SkipChainID())]
+	if len(chain) != latest.Index+1 {
+		return errors.New("delegated blocks have to follow the latest block")
+	}
+	hash := cb.Delegation.Hash()
+	published := false
+	used := 0
+	for _, sb := range chain {
+		previous, err := ExtractCertBlock(sb)
+		if err != nil {
+			return err
+		}
+		for _, d := range previous.Delegations {
+			if d != nil && bytes.Equal(d.Hash(), hash) {
+				published = true
+			}
+		}
+		if previous.Delegation != nil && bytes.Equal(previous.Delegation.Hash(), hash) {
+			used += len(previous.Certs)
+		}
+	}
+	if !published {
+		return errors.New("delegation is not published in the CertChain")
+	}
+	if max := cb.Delegation.MaxCerts; max > 0 && used+len(cb.Certs) > max {
+		return errors.New("the delegation allows " + strconv.Itoa(max-used) + " more certificates")
+	}
+	return nil
+}
+
+// checkDelegatedBlock checks the delegations of a CertBlock appended after latest
+func (s *Service) checkDelegatedBlock(latest *skipchain.SkipBlock, cb *CertBlock) onet.ClientError {
+	prev, err := ExtractCertBlock(latest)
+	if err != nil {
+		return onet.NewClientErrorCode(ErrorParameter, err.Error())
+	}
+	if err := checkDelegation(prev.PublicKey, cb); err != nil {
+		return onet.NewClientErrorCode(ErrorDelegation, err.Error())
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if err := s.verifyDelegation(latest, cb); err != nil {
+		return onet.NewClientErrorCode(ErrorDelegation, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package certchain
+
+/*
+The domain.go checks that whoever binds a CertChain to a name controls the
+domain. The domain publishes the key of the owner, either in a DNS TXT record
+or in an HTTP well-known file, and every member of the roster checks it when
+it reserves a name for a new CertChain and when it verifies a block changing
+the owner key of a CertChain bound to names. The validators a node runs are
+chosen by the CERTCHAIN_DOMAIN_VALIDATION environment variable, and one of
+them has to succeed.
+*/
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// DomainValidator checks that a domain authorizes a key to own the CertChains bound to it
+type DomainValidator interface {
+	// Validate returns an error unless the domain publishes the key
+	Validate(domain string, key abstract.Point) error
+}
+
+// TXTResolver looks up TXT records, like net.Resolver
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// How long a domain validator waits for an answer
+const domainTimeout = 10 * time.Second
+
+// The domain validators a node can run, by name. They are only changed by
+// RegisterDomainValidator, which has to be called before the service is started.
+var domainValidators = map[string]DomainValidator{
+	"dns":  &DNSValidator{net.DefaultResolver},
+	"http": &HTTPValidator{&http.Client{Timeout: domainTimeout}},
+}
+
+// RegisterDomainValidator adds a domain validator, or replaces an existing one
+func RegisterDomainValidator(name string, v DomainValidator) {
+	domainValidators[name] = v
+}
+
+// KeyString returns the hex encoding of a key, as published by a domain
+func KeyString(key abstract.Point) string {
+	buf, err := key.MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// domainName returns the domain of a name or a wildcard zone
+func domainName(name string) string {
+	return strings.TrimPrefix(name, "*.")
+}
+
+// validateDomain checks the key against the domain of a name with the named validators. It
+// succeeds if there are none, or if one of them succeeds.
+func validateDomain(validators []string, name string, key abstract.Point) error {
+	if len(validators) == 0 {
+		return nil
+	}
+	if key == nil {
+		return errors.New("no key to validate")
+	}
+	var errs []string
+	for _, v := range validators {
+		validator, ok := domainValidators[v]
+		if !ok {
+			return errors.New("unknown domain validator " + v)
+		}
+		err := validator.Validate(domainName(name), key)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, v+": "+err.Error())
+	}
+	return errors.New(name + " doesn't publish the key: " + strings.Join(errs, ", "))
+}
+
+// DNSValidator looks for the key in a TXT record "certchain-key=<KeyString>" at _certchain.<domain>
+type DNSValidator struct {
+	Resolver TXTResolver
+}
+
+// Validate returns an error unless a TXT record of the domain holds the key
+func (v *DNSValidator) Validate(domain string, key abstract.Point) error {
+	ctx, cancel := context.WithTimeout(context.Background(), domainTimeout)
+	defer cancel()
+	records, err := v.Resolver.LookupTXT(ctx, "_certchain."+domain)
+	if err != nil {
+		return err
+	}
+	want := "certchain-key=" + KeyString(key)
+	for _, record := range records {
+		if strings.TrimSpace(record) == want {
+			return nil
+		}
+	}
+	return errors.New("no TXT record with the key")
+}
+
+// HTTPValidator looks for the key in http://<domain>/.well-known/certchain, which lists one
+// KeyString per line
+type HTTPValidator struct {
+	Client *http.Client
+}
+
+// Validate returns an error unless the well-known file of the domain lists the key
+func (v *HTTPValidator) Validate(domain string, key abstract.Point) error {
+	resp, err := v.Client.Get("http://" + domain + "/.well-known/certchain")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("well-known file answers " + resp.Status)
+	}
+	want := KeyString(key)
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<16))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == want {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("well-known file doesn't list the key")
+}
@@ -0,0 +1,306 @@
+package certchain
+
+/*
+The heartbeat.go has the roster periodically state the latest block of every
+CertChain it runs. The leader of a roster, its first member, puts the heads of
+all the CertChains of the roster in a Merkle tree and asks every member to sign
+the root with the time. A member only signs heads that are the latest blocks it
+knows; if a CertChain changes during a round, the leader states every head in
+a round of its own. The signed round is propagated, so that every node answers with the
+heartbeat of a CertChain: its head, the Merkle proof and the signatures.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/sign"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Hash returns the leaf of the head in the tree of a heartbeat round
+func (h *HeartbeatHead) Hash() crypto.HashID {
+	hash := sha256.New()
+	hash.Write(h.SkipchainID)
+	hash.Write(h.BlockID)
+	binary.Write(hash, binary.LittleEndian, int64(h.Index))
+	return hash.Sum(nil)
+}
+
+// heartbeatTree returns the root of the tree of the heads and their Merkle proofs, in the
+// order of the heads
+func heartbeatTree(heads []*HeartbeatHead) (crypto.HashID, []crypto.Proof) {
+	leaves := make([]crypto.HashID, len(heads))
+	for i, h := range heads {
+		leaves[i] = h.Hash()
+	}
+	return crypto.ProofTree(sha256.New, leaves)
+}
+
+// heartbeatMessage returns the message signed by the members of the roster for a round
+func heartbeatMessage(root crypto.HashID, timestamp int64) []byte {
+	msg := append([]byte("certchain heartbeat"), root...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(timestamp))
+	return append(msg, ts[:]...)
+}
+
+// heartbeatThreshold returns how many members of a roster of n have to sign a heartbeat
+func heartbeatThreshold(n int) int {
+	return n - (n-1)/3
+}
+
+// verifySignatures checks that at least heartbeatThreshold members of the roster signed the
+// message. The signatures are in the order of the roster, nil for a member that didn't sign.
+func verifySignatures(r *onet.Roster, msg []byte, signatures [][]byte) error {
+	if r == nil || len(signatures) != len(r.List) {
+		return errors.New("one signature slot per roster member is needed")
+	}
+	signed := 0
+	for i, sig := range signatures {
+		if sig != nil && sign.VerifySchnorr(suite, r.List[i].Public, msg, sig) == nil {
+			signed++
+		}
+	}
+	if signed < heartbeatThreshold(len(r.List)) {
+		return errors.New("only " + strconv.Itoa(signed) + " of " + strconv.Itoa(len(r.List)) +
+			" roster members signed")
+	}
+	return nil
+}
+
+// Time returns when the roster stated the head
+func (hb *Heartbeat) Time() time.Time {
+	return time.Unix(0, hb.Timestamp*int64(time.Millisecond))
+}
+
+// Verify checks that the head is part of a round signed by enough members of the roster
+func (hb *Heartbeat) Verify(r *onet.Roster) error {
+	if hb.Head == nil || !hb.Proof.Check(sha256.New, hb.Root, hb.Head.Hash()) {
+		return errors.New("head isn't part of the heartbeat round")
+	}
+	return verifySignatures(r, heartbeatMessage(hb.Root, hb.Timestamp), hb.Signatures)
+}
+
+// scheduleHeartbeats starts the periodic heartbeats unless they are running.
+// storageMutex must be held by the caller.
+func (s *Service) scheduleHeartbeats() {
+	if s.heartbeatTimer == nil && s.heartbeatInterval > 0 {
+		s.heartbeatTimer = time.AfterFunc(s.heartbeatInterval, func() {
+			s.sendHeartbeats()
+			s.storageMutex.Lock()
+			s.heartbeatTimer = nil
+			if len(s.latestMap) > 0 {
+				s.scheduleHeartbeats()
+			}
+			s.storageMutex.Unlock()
+		})
+	}
+}
+
+// sendHeartbeats has the heads of the CertChains this node leads signed by their rosters
+func (s *Service) sendHeartbeats() {
+	rosters := make(map[onet.RosterID]*onet.Roster)
+	heads := make(map[onet.RosterID][]*HeartbeatHead)
+	s.storageMutex.Lock()
+	for id, latest := range s.latestMap {
+		if !latest.Roster.List[0].Equal(s.ServerIdentity()) {
+			continue
+		}
+		rosters[latest.Roster.ID] = latest.Roster
+		heads[latest.Roster.ID] = append(heads[latest.Roster.ID],
+			&HeartbeatHead{skipchain.SkipBlockID(id), latest.Index, latest.Hash})
+	}
+	s.storageMutex.Unlock()
+	for rid, roster := range rosters {
+		err := s.heartbeat(roster, heads[rid])
+		if err == nil {
+			continue
+		}
+		log.Lvl2("Heartbeat of all the heads failed:", err)
+		// A CertChain that changed during the round makes the members refuse the whole
+		// round, so every head is stated again in a round of its own, as of now
+		for _, head := range heads[rid] {
+			if err := s.heartbeat(roster, []*HeartbeatHead{s.currentHead(head)}); err != nil {
+				log.Error("Couldn't send heartbeat:", err)
+			}
+		}
+	}
+}
+
+// currentHead returns the head of its CertChain as of the latest block the node knows
+func (s *Service) currentHead(head *HeartbeatHead) *HeartbeatHead {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	latest, known := s.latestMap[string(head.SkipchainID)]
+	if !known {
+		return head
+	}
+	return &HeartbeatHead{head.SkipchainID, latest.Index, latest.Hash}
+}
+
+// heartbeat collects the signatures of the roster members on the heads and propagates the round
+func (s *Service) heartbeat(roster *onet.Roster, heads []*HeartbeatHead) error {
+	sort.Slice(heads, func(i, j int) bool { return bytes.Compare(heads[i].SkipchainID, heads[j].SkipchainID) < 0 })
+	round := &HeartbeatRound{
+		Roster:     roster,
+		Heads:      heads,
+		Timestamp:  time.Now().UnixNano() / int64(time.Millisecond),
+		Signatures: make([][]byte, len(roster.List)),
+	}
+	client := onet.NewClient(Name)
+	for i, si := range roster.List {
+		reply := &SignHeartbeatResponse{}
+		if err := client.SendProtobuf(si, &SignHeartbeatRequest{roster, heads, round.Timestamp}, reply); err != nil {
+			log.Lvl2(si, "doesn't sign the heartbeat:", err)
+			continue
+		}
+		round.Signatures[i] = reply.Signature
+	}
+	root, _ := heartbeatTree(heads)
+	if err := verifySignatures(roster, heartbeatMessage(root, round.Timestamp), round.Signatures); err != nil {
+		return err
+	}
+	replies, err := s.propagateHeartbeat(roster, round, propagateTimeout)
+	if err != nil {
+		return err
+	}
+	if replies != len(roster.List) {
+		log.Warn("Did only get", replies, "out of", len(roster.List))
+	}
+	return nil
+}
+
+// SignHeartbeat signs the heads of a heartbeat round if they are the latest blocks of their
+// CertChains known by the node and the time is close to its clock
+func (s *Service) SignHeartbeat(req *SignHeartbeatRequest) (*SignHeartbeatResponse, onet.ClientError) {
+	if req.Roster == nil || len(req.Heads) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster and heads are needed")
+	}
+	if d := time.Since(time.Unix(0, req.Timestamp*int64(time.Millisecond))); d > s.timestampSkew || d < -s.timestampSkew {
+		return nil, onet.NewClientErrorCode(ErrorTimestamp, "time is too far from the clock of the node")
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	for _, head := range req.Heads {
+		if head == nil {
+			return nil, onet.NewClientErrorCode(ErrorParameter, "empty head")
+		}
+		latest, known := s.latestMap[string(head.SkipchainID)]
+		if !known || latest.Roster.ID != req.Roster.ID {
+			return nil, onet.NewClientErrorCode(ErrorUnknownChain, "unknown CertChain")
+		}
+		if latest.Index != head.Index || !bytes.Equal(latest.Hash, head.BlockID) {
+			return nil, onet.NewClientErrorCode(ErrorStale, "head isn't the latest block known by the node")
+		}
+	}
+	root, _ := heartbeatTree(req.Heads)
+	sig, err := sign.Schnorr(suite, s.Private(), heartbeatMessage(root, req.Timestamp))
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return &SignHeartbeatResponse{sig}, nil
+}
+
+// GetHeartbeat returns the latest heartbeat of a CertChain known by the node
+func (s *Service) GetHeartbeat(req *GetHeartbeatRequest) (*GetHeartbeatResponse, onet.ClientError) {
+	if len(req.SkipchainID) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "no skipchain ID given")
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if _, known := s.latestMap[string(req.SkipchainID)]; !known {
+		return nil, onet.NewClientErrorCode(ErrorUnknownChain, "unknown CertChain")
+	}
+	hb, exists := s.heartbeatMap[string(req.SkipchainID)]
+	if !exists {
+		return nil, onet.NewClientErrorCode(ErrorStale, "no heartbeat yet")
+	}
+	return &GetHeartbeatResponse{hb}, nil
+}
+
+// propagateHeartbeatMap stores the heartbeats of a signed round for the CertChains of the
+// node that are run by the roster of the round, unless the round is dated in the future
+func (s *Service) propagateHeartbeatMap(msg network.Message) {
+	round, ok := msg.(*HeartbeatRound)
+	if !ok {
+		log.Error("Couldn't convert to HeartbeatRound")
+		return
+	}
+	if time.Until(time.Unix(0, round.Timestamp*int64(time.Millisecond))) > s.timestampSkew {
+		log.Error("Received heartbeat from the future")
+		return
+	}
+	root, proofs := heartbeatTree(round.Heads)
+	signed := heartbeatMessage(root, round.Timestamp)
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	for i, head := range round.Heads {
+		latest, known := s.latestMap[string(head.SkipchainID)]
+		if !known || latest.Roster.ID != round.Roster.ID {
+			continue
+		}
+		// The round is checked against the keys of the roster of the CertChain the node knows
+		if err := verifySignatures(latest.Roster, signed, round.Signatures); err != nil {
+			log.Error("Received invalid heartbeat:", err)
+			continue
+		}
+		if hb, exists := s.heartbeatMap[string(head.SkipchainID)]; exists && hb.Timestamp >= round.Timestamp {
+			continue
+		}
+		s.heartbeatMap[string(head.SkipchainID)] = &Heartbeat{
+			Head:       head,
+			Timestamp:  round.Timestamp,
+			Root:       root,
+			Proof:      proofs[i],
+			Signatures: round.Signatures,
+		}
+	}
+}
+
+// GetHeartbeat returns the latest heartbeat of a CertChain, checked to be signed by enough
+// members of the roster
+func (c *Client) GetHeartbeat(r *onet.Roster, id skipchain.SkipBlockID) (*Heartbeat, onet.ClientError) {
+	reply := &GetHeartbeatResponse{}
+	if err := c.send(r, &GetHeartbeatRequest{id}, reply); err != nil {
+		return nil, err
+	}
+	hb := reply.Heartbeat
+	if hb == nil || hb.Head == nil || !bytes.Equal(hb.Head.SkipchainID, id) {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "heartbeat is about another CertChain")
+	}
+	if verr := hb.Verify(r); verr != nil {
+		return nil, onet.NewClientErrorCode(ErrorVerification, verr.Error())
+	}
+	return hb, nil
+}
+
+// checkHeartbeat fetches the heartbeat of a CertChain if the Client requires one and checks
+// that it is younger than MaxHeartbeatAge and that a result as of the block at index isn't
+// older than its head. A negative index only checks the age.
+func (c *Client) checkHeartbeat(r *onet.Roster, id skipchain.SkipBlockID, index int) onet.ClientError {
+	if c.MaxHeartbeatAge <= 0 {
+		return nil
+	}
+	hb, err := c.GetHeartbeat(r, id)
+	if err != nil {
+		return err
+	}
+	if time.Since(hb.Time()) > c.MaxHeartbeatAge {
+		return onet.NewClientErrorCode(ErrorStale, "heartbeat is older than "+c.MaxHeartbeatAge.String())
+	}
+	if index >= 0 && index < hb.Head.Index {
+		return onet.NewClientErrorCode(ErrorStale, "result is older than block "+strconv.Itoa(hb.Head.Index)+
+			" stated by the heartbeat")
+	}
+	return nil
+}
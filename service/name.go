@@ -0,0 +1,139 @@
+package certchain
+
+/*
+The name.go reserves a name across the roster before the genesis block of a
+named CertChain is stored. The node creating the CertChain asks every member
+to reserve the name for the genesis CertBlock, identified by its MTR. A member
+refuses if the name is bound, or reserved for another genesis block, or if the
+domain doesn't publish the key of the owner, and otherwise signs the binding.
+Two creations racing for a name can't both get the signatures of enough
+members, and the signed binding lets a client check which CertChain a name
+resolves to.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/sign"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// How long a member keeps a name reserved for a genesis block that isn't bound yet
+const reservationTimeout = time.Minute
+
+// nameReservation is a name reserved by a member for the genesis block with the MTR
+type nameReservation struct {
+	mtr     []byte
+	expires time.Time
+}
+
+// nameMessage returns the message signed by the members of the roster for a binding
+func nameMessage(name string, mtr []byte) []byte {
+	msg := append([]byte("certchain name"), []byte(name)...)
+	return append(append(msg, 0), mtr...)
+}
+
+// Verify checks that enough members of the roster signed the binding. The binding is signed by
+// the roster that created the CertChain, only its members that are still in r count.
+func (b *NameBinding) Verify(r *onet.Roster) error {
+	if r == nil || b.Roster == nil || len(b.Signatures) != len(b.Roster.List) {
+		return errors.New("one signature slot per roster member is needed")
+	}
+	msg := nameMessage(b.Name, b.MTR)
+	signed := 0
+	for _, si := range r.List {
+		i, signer := b.Roster.Search(si.ID)
+		if i < 0 || !signer.Public.Equal(si.Public) || b.Signatures[i] == nil {
+			continue
+		}
+		if sign.VerifySchnorr(suite, si.Public, msg, b.Signatures[i]) == nil {
+			signed++
+		}
+	}
+	if signed < heartbeatThreshold(len(r.List)) {
+		return errors.New("only " + strconv.Itoa(signed) + " of " + strconv.Itoa(len(r.List)) +
+			" roster members signed the binding of " + b.Name)
+	}
+	return nil
+}
+
+// VerifyGenesis checks that the binding is about the genesis block
+func (b *NameBinding) VerifyGenesis(genesis *skipchain.SkipBlock) error {
+	cb, err := ExtractCertBlock(genesis)
+	if err != nil {
+		return err
+	}
+	if genesis.Index != 0 || !bytes.Equal(cb.LatestMTR, b.MTR) {
+		return errors.New(b.Name + " is bound to another CertChain")
+	}
+	return nil
+}
+
+// ReserveName reserves a name for a genesis CertBlock and signs the binding, unless the name is
+// bound or reserved for another genesis block
+func (s *Service) ReserveName(req *ReserveNameRequest) (*ReserveNameResponse, onet.ClientError) {
+	if err := checkName(req.Name); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, err.Error())
+	}
+	cb := req.CertBlock
+	if cb == nil || cb.PublicKey == nil || !validMTR(cb) {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "valid genesis CertBlock is needed")
+	}
+	if err := sign.VerifySchnorr(suite, cb.PublicKey, cb.LatestMTR, cb.LatestSignedMTR); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorSignature, "CertBlock is not signed by the owner")
+	}
+	// Every member checks itself that the domain publishes the key of the owner
+	if err := validateDomain(s.domainValidation, req.Name, cb.PublicKey); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorDomain, err.Error())
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if _, taken := s.nameMap[req.Name]; taken {
+		return nil, onet.NewClientErrorCode(ErrorNameTaken, req.Name+" is already bound to a CertChain")
+	}
+	if r, exists := s.nameReservations[req.Name]; exists && time.Now().Before(r.expires) && !bytes.Equal(r.mtr, cb.LatestMTR) {
+		return nil, onet.NewClientErrorCode(ErrorNameTaken, req.Name+" is reserved for another CertChain")
+	}
+	sig, err := sign.Schnorr(suite, s.Private(), nameMessage(req.Name, cb.LatestMTR))
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	s.nameReservations[req.Name] = &nameReservation{cb.LatestMTR, time.Now().Add(reservationTimeout)}
+	return &ReserveNameResponse{sig}, nil
+}
+
+// reserveName has the members of the roster reserve the name for the genesis CertBlock and
+// returns the signed binding
+func (s *Service) reserveName(roster *onet.Roster, name string, cb *CertBlock) (*NameBinding, onet.ClientError) {
+	binding := &NameBinding{
+		Name:       name,
+		MTR:        cb.LatestMTR,
+		Roster:     roster,
+		Signatures: make([][]byte, len(roster.List)),
+	}
+	client := onet.NewClient(Name)
+	var refusal onet.ClientError
+	for i, si := range roster.List {
+		reply := &ReserveNameResponse{}
+		if err := client.SendProtobuf(si, &ReserveNameRequest{name, cb}, reply); err != nil {
+			log.Lvl2(si, "doesn't reserve", name+":", err)
+			if !IsRetryable(err) {
+				refusal = err
+			}
+			continue
+		}
+		binding.Signatures[i] = reply.Signature
+	}
+	if err := binding.Verify(roster); err != nil {
+		if refusal != nil {
+			return nil, refusal
+		}
+		return nil, onet.NewClientErrorCode(ErrorTimeout, err.Error())
+	}
+	return binding, nil
+}
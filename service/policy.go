@@ -0,0 +1,263 @@
+package certchain
+
+/*
+The policy.go evaluates the policy set in the genesis block of a CertChain
+against the CertBlocks appended to it. Every rule that is broken is reported
+as a PolicyError, whose rule is machine-readable.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+)
+
+// Rules of a policy, as reported in a PolicyError
+const (
+	RulePolicy      = "policy"
+	RuleBatch       = "batch"
+	RuleBodies      = "bodies"
+	RuleIssuer      = "issuer"
+	RuleValidity    = "validity"
+	RuleSAN         = "san"
+	RuleInterval    = "interval"
+	RuleAttestation = "attestation"
+)
+
+// PolicyError tells which rule of the policy a CertBlock breaks
+type PolicyError struct {
+	Rule   string
+	Detail string
+}
+
+// Error returns "rule: detail"
+func (e *PolicyError) Error() string {
+	return e.Rule + ": " + e.Detail
+}
+
+// policyError returns a PolicyError for the rule
+func policyError(rule, detail string) *PolicyError {
+	return &PolicyError{rule, detail}
+}
+
+// AsPolicyError returns the PolicyError carried by an error of the service, or nil if the
+// error isn't a policy rejection
+func AsPolicyError(err onet.ClientError) *PolicyError {
+	if err == nil || err.ErrorCode() != ErrorPolicy {
+		return nil
+	}
+	parts := strings.SplitN(err.ErrorMsg(), ": ", 2)
+	if len(parts) != 2 {
+		return policyError(RulePolicy, err.ErrorMsg())
+	}
+	return policyError(parts[0], parts[1])
+}
+
+// Validate checks that the policy is well-formed
+func (p *Policy) Validate() error {
+	for _, pin := range p.IssuerPins {
+		if len(pin) != sha256.Size {
+			return policyError(RulePolicy, "issuer pins must be SHA-256 hashes")
+		}
+	}
+	for _, pattern := range p.SANPatterns {
+		if pattern == "" || strings.Contains(pattern, "**") {
+			return policyError(RulePolicy, "invalid SAN pattern "+strconv.Quote(pattern))
+		}
+	}
+	if p.MaxValidity < 0 || p.MaxBatch < 0 || p.MinInterval < 0 {
+		return policyError(RulePolicy, "limits must not be negative")
+	}
+	// Otherwise any CA could attest the certificates it issues itself
+	if p.RequireCAAttestation && len(p.IssuerPins) == 0 {
+		return policyError(RulePolicy, "CA attestations need issuer pins")
+	}
+	return nil
+}
+
+// NeedsBodies returns true if the policy checks the certificates themselves, so that their
+// bodies have to be in the CertBlocks
+func (p *Policy) NeedsBodies() bool {
+	return len(p.IssuerPins) > 0 || p.MaxValidity > 0 || len(p.SANPatterns) > 0 || p.RequireCAAttestation
+}
+
+// Check returns a PolicyError if the CertBlock breaks a rule of the policy about its content
+func (p *Policy) Check(cb *CertBlock) error {
+	if cb.Timestamp == 0 {
+		// Such blocks, like CONIKS ones, may hide leaves behind their MTR
+		return policyError(RulePolicy, "blocks of a CertChain with a policy need a timestamp")
+	}
+	if p.MaxBatch > 0 && len(cb.Certs) > p.MaxBatch {
+		return policyError(RuleBatch, strconv.Itoa(len(cb.Certs))+" certificates, at most "+
+			strconv.Itoa(p.MaxBatch)+" are allowed")
+	}
+	if !p.NeedsBodies() {
+		return nil
+	}
+	if len(cb.Certificates) != len(cb.Certs) {
+		return policyError(RuleBodies, "the bodies of all the certificates are needed")
+	}
+	if cb.Type != RecordX509 {
+		return p.checkOtherRecords(cb)
+	}
+	for i, c := range cb.Certificates {
+		if c == nil || !bytes.Equal(LeafHash(c.Raw), cb.Certs[i]) {
+			return policyError(RuleBodies, "body of certificate "+strconv.Itoa(i)+" doesn't match its leaf")
+		}
+		cert, err := x509.ParseCertificate(c.Raw)
+		if err != nil {
+			return policyError(RuleBodies, "certificate "+strconv.Itoa(i)+" can't be parsed: "+err.Error())
+		}
+		if err := p.checkCertificate(cert, c.Chain); err != nil {
+			return &PolicyError{err.Rule, "certificate " + strconv.Itoa(i) + ": " + err.Detail}
+		}
+	}
+	if p.RequireCAAttestation {
+		attested, err := checkAttestations(cb)
+		if err != nil {
+			return policyError(RuleAttestation, err.Error())
+		}
+		for i, ok := range attested {
+			if !ok {
+				return policyError(RuleAttestation, "certificate "+strconv.Itoa(i)+" isn't attested by its CA")
+			}
+		}
+	}
+	return nil
+}
+
+// checkOtherRecords checks the rules about records that aren't certificates. They have no
+// issuer nor validity, the SAN patterns apply to the names they are about.
+func (p *Policy) checkOtherRecords(cb *CertBlock) error {
+	if len(p.IssuerPins) > 0 {
+		return policyError(RuleIssuer, cb.Type.String()+" records have no issuer")
+	}
+	if p.MaxValidity > 0 {
+		return policyError(RuleValidity, cb.Type.String()+" records have no validity")
+	}
+	if p.RequireCAAttestation {
+		return policyError(RuleAttestation, cb.Type.String()+" records have no CA")
+	}
+	for i, c := range cb.Certificates {
+		if c == nil || !bytes.Equal(RecordLeafHash(cb.Type, c.Raw), cb.Certs[i]) {
+			return policyError(RuleBodies, "body of record "+strconv.Itoa(i)+" doesn't match its leaf")
+		}
+		if len(p.SANPatterns) == 0 {
+			continue
+		}
+		names := RecordNames(cb.Type, c.Raw)
+		if len(names) == 0 {
+			return policyError(RuleSAN, "record "+strconv.Itoa(i)+" has no names")
+		}
+		if err := p.checkNames(names); err != nil {
+			return &PolicyError{err.Rule, "record " + strconv.Itoa(i) + ": " + err.Detail}
+		}
+	}
+	return nil
+}
+
+// CheckInterval returns a PolicyError if a block comes too soon after the previous one, given
+// their timestamps
+func (p *Policy) CheckInterval(previous, next time.Time) error {
+	min := time.Duration(p.MinInterval) * time.Second
+	if p.MinInterval > 0 && next.Sub(previous) < min {
+		return policyError(RuleInterval, "at most one block every "+min.String())
+	}
+	return nil
+}
+
+// checkCertificate checks the rules about a single certificate
+func (p *Policy) checkCertificate(cert *x509.Certificate, chain [][]byte) *PolicyError {
+	if len(p.IssuerPins) > 0 {
+		if err := p.checkIssuer(cert, chain); err != nil {
+			return err
+		}
+	}
+	max := time.Duration(p.MaxValidity) * time.Second
+	if p.MaxValidity > 0 && cert.NotAfter.Sub(cert.NotBefore) > max {
+		return policyError(RuleValidity, "valid for more than "+max.String())
+	}
+	if len(p.SANPatterns) > 0 {
+		names := cert.DNSNames
+		if len(names) == 0 {
+			names = []string{cert.Subject.CommonName}
+		}
+		return p.checkNames(names)
+	}
+	return nil
+}
+
+// checkNames checks that all the names match a SAN pattern
+func (p *Policy) checkNames(names []string) *PolicyError {
+	for _, name := range names {
+		if !p.allowedName(name) {
+			return policyError(RuleSAN, strconv.Quote(name)+" matches no pattern")
+		}
+	}
+	return nil
+}
+
+// checkIssuer checks that the certificate chains up to a pinned issuer
+func (p *Policy) checkIssuer(cert *x509.Certificate, chain [][]byte) *PolicyError {
+	current := cert
+	for _, der := range chain {
+		issuer, err := x509.ParseCertificate(der)
+		if err != nil {
+			return policyError(RuleIssuer, "issuing certificate can't be parsed")
+		}
+		if err := current.CheckSignatureFrom(issuer); err != nil {
+			return policyError(RuleIssuer, "broken chain: "+err.Error())
+		}
+		pin := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		for _, allowed := range p.IssuerPins {
+			if bytes.Equal(allowed, pin[:]) {
+				return nil
+			}
+		}
+		current = issuer
+	}
+	return policyError(RuleIssuer, "no pinned issuer in the chain")
+}
+
+// allowedName returns true if the DNS name matches one of the SAN patterns
+func (p *Policy) allowedName(name string) bool {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for _, pattern := range p.SANPatterns {
+		patternLabels := strings.Split(strings.ToLower(strings.TrimSuffix(pattern, ".")), ".")
+		if len(patternLabels) != len(labels) {
+			continue
+		}
+		match := true
+		for i, label := range patternLabels {
+			if label != "*" && label != labels[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBlock checks a CertBlock appended after prev against the policy of the genesis block of
+// the CertChain, which may be nil. The interval is checked against the signed timestamps, so
+// that all the nodes agree on it.
+func checkBlock(policy *Policy, prev, cb *CertBlock) error {
+	if cb.Policy != nil {
+		return policyError(RulePolicy, "only the genesis block may set the policy")
+	}
+	if policy == nil {
+		return nil
+	}
+	if err := policy.Check(cb); err != nil {
+		return err
+	}
+	return policy.CheckInterval(prev.Time(), cb.Time())
+}
@@ -0,0 +1,475 @@
+package certchain
+
+/*
+The record.go defines the types of records a CertChain logs: X.509
+certificates, DNS RRsets, SSH host keys and OpenPGP keys. Every type has a
+canonical encoding, which is what the leaf hash is computed from, so that the
+same record always gets the same leaf. Validators can be added per type; the
+conodes run them on the bodies sent along with a CertBlock.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+)
+
+// RecordType is the type of the records logged in a CertBlock
+type RecordType int
+
+// Types of records. RecordX509 is 0 so that the CertBlocks of older CertChains log certificates.
+const (
+	RecordX509 RecordType = iota
+	RecordDNS
+	RecordSSH
+	RecordPGP
+)
+
+// recordNames are the names of the record types, as used by the app
+var recordNames = map[RecordType]string{
+	RecordX509: "x509",
+	RecordDNS:  "dns",
+	RecordSSH:  "ssh",
+	RecordPGP:  "pgp",
+}
+
+// String returns the name of the record type
+func (t RecordType) String() string {
+	if name, ok := recordNames[t]; ok {
+		return name
+	}
+	return "type " + strconv.Itoa(int(t))
+}
+
+// ParseRecordType returns the record type with the given name
+func ParseRecordType(name string) (RecordType, error) {
+	for t, n := range recordNames {
+		if n == strings.ToLower(name) {
+			return t, nil
+		}
+	}
+	return 0, errors.New("unknown record type " + name)
+}
+
+// RecordCodec defines the canonical encoding of a type of records
+type RecordCodec interface {
+	// Canonical returns the canonical encoding of a record, or an error if it is malformed
+	Canonical(raw []byte) ([]byte, error)
+	// Names returns the DNS names a record in canonical encoding is about
+	Names(canonical []byte) []string
+}
+
+// RecordValidator is a validation hook, called with a record in canonical encoding
+type RecordValidator func(canonical []byte) error
+
+// The codecs and validators of the record types. They are only changed by RegisterRecordType
+// and AddRecordValidator, which have to be called before the service is started.
+var (
+	recordCodecs = map[RecordType]RecordCodec{
+		RecordX509: x509Codec{},
+		RecordDNS:  dnsCodec{},
+		RecordSSH:  sshCodec{},
+		RecordPGP:  pgpCodec{},
+	}
+	recordValidators = make(map[RecordType][]RecordValidator)
+)
+
+// RegisterRecordType adds a record type, or replaces the codec of an existing one
+func RegisterRecordType(t RecordType, name string, codec RecordCodec) {
+	recordNames[t] = name
+	recordCodecs[t] = codec
+}
+
+// AddRecordValidator adds a validation hook for the records of a type. Every node of the
+// roster has to add the same hooks, otherwise they don't agree on the blocks.
+func AddRecordValidator(t RecordType, v RecordValidator) {
+	recordValidators[t] = append(recordValidators[t], v)
+}
+
+// CanonicalRecord returns the canonical encoding of a record
+func CanonicalRecord(t RecordType, raw []byte) ([]byte, error) {
+	codec, ok := recordCodecs[t]
+	if !ok {
+		return nil, errors.New("unknown record type " + t.String())
+	}
+	return codec.Canonical(raw)
+}
+
+// ValidateRecord checks that a record is in canonical encoding and passes the validation hooks
+func ValidateRecord(t RecordType, canonical []byte) error {
+	c, err := CanonicalRecord(t, canonical)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(c, canonical) {
+		return errors.New(t.String() + " record is not in canonical encoding")
+	}
+	for _, v := range recordValidators[t] {
+		if err := v(canonical); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordLeafHash returns the leaf under which a record in canonical encoding is logged. For an
+// X.509 certificate it is LeafHash, the other types are prefixed by a zero byte and their type,
+// which can't start a DER encoding.
+func RecordLeafHash(t RecordType, canonical []byte) crypto.HashID {
+	if t == RecordX509 {
+		return LeafHash(canonical)
+	}
+	h := sha256.New()
+	h.Write([]byte{0, byte(t)})
+	h.Write(canonical)
+	return crypto.HashID(h.Sum(nil))
+}
+
+// RecordNames returns the DNS names a record in canonical encoding is about
+func RecordNames(t RecordType, canonical []byte) []string {
+	codec, ok := recordCodecs[t]
+	if !ok {
+		return nil
+	}
+	return codec.Names(canonical)
+}
+
+// checkRecords checks the bodies sent along with a CertBlock: they have to be the records
+// under its leaves and to be valid records of its type. The CA attestations of the block are
+// checked as well.
+func checkRecords(cb *CertBlock) error {
+	if _, ok := recordCodecs[cb.Type]; !ok {
+		return errors.New("unknown record type " + cb.Type.String())
+	}
+	if len(cb.Certificates) == 0 && len(cb.Attestations) == 0 {
+		return nil
+	}
+	if len(cb.Certificates) != len(cb.Certs) {
+		return errors.New("the bodies of all the records are needed")
+	}
+	for i, c := range cb.Certificates {
+		if c == nil || !bytes.Equal(RecordLeafHash(cb.Type, c.Raw), cb.Certs[i]) {
+			return errors.New("body of record " + strconv.Itoa(i) + " doesn't match its leaf")
+		}
+		if err := ValidateRecord(cb.Type, c.Raw); err != nil {
+			return errors.New("record " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	_, err := checkAttestations(cb)
+	return err
+}
+
+// x509Codec encodes X.509 certificates in DER, a PEM certificate is accepted as well
+type x509Codec struct{}
+
+func (x509Codec) Canonical(raw []byte) ([]byte, error) {
+	if block, _ := pem.Decode(raw); block != nil && block.Type == "CERTIFICATE" {
+		raw = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cert.Raw, nil
+}
+
+func (x509Codec) Names(canonical []byte) []string {
+	cert, err := x509.ParseCertificate(canonical)
+	if err != nil {
+		return nil
+	}
+	if len(cert.DNSNames) == 0 && cert.Subject.CommonName != "" {
+		return []string{cert.Subject.CommonName}
+	}
+	return cert.DNSNames
+}
+
+// dnsCodec encodes an RRset in the text format of zone files, one record per line:
+//
+//	owner TTL class type rdata...
+//
+// The canonical encoding has a lower-case fully-qualified owner, an upper-case class and type,
+// single spaces between the fields and the records sorted, each ending with a newline. All the
+// records of an RRset share the owner, TTL, class and type.
+type dnsCodec struct{}
+
+func (dnsCodec) Canonical(raw []byte) ([]byte, error) {
+	var lines []string
+	var set []string
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 5 {
+			return nil, errors.New("DNS record needs an owner, a TTL, a class, a type and data")
+		}
+		ttl, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid TTL " + fields[1])
+		}
+		owner := strings.ToLower(strings.TrimSuffix(fields[0], ".")) + "."
+		head := []string{owner, strconv.FormatUint(ttl, 10), strings.ToUpper(fields[2]), strings.ToUpper(fields[3])}
+		if set == nil {
+			set = head
+		} else if strings.Join(set, " ") != strings.Join(head, " ") {
+			return nil, errors.New("records of an RRset need the same owner, TTL, class and type")
+		}
+		lines = append(lines, strings.Join(append(head, fields[4:]...), " "))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("empty RRset")
+	}
+	sort.Strings(lines)
+	for i := 1; i < len(lines); i++ {
+		if lines[i] == lines[i-1] {
+			return nil, errors.New("duplicate record in the RRset")
+		}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func (dnsCodec) Names(canonical []byte) []string {
+	fields := strings.Fields(string(canonical))
+	if len(fields) == 0 {
+		return nil
+	}
+	return []string{strings.TrimSuffix(fields[0], ".")}
+}
+
+// sshCodec encodes an SSH public key, given like in authorized_keys as "key-type base64 comment",
+// in the wire format of RFC 4253
+type sshCodec struct{}
+
+func (sshCodec) Canonical(raw []byte) ([]byte, error) {
+	if checkSSHKey(raw, "") == nil {
+		return raw, nil
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) < 2 {
+		return nil, errors.New("SSH public key needs a type and a key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, errors.New("malformed SSH public key")
+	}
+	if err := checkSSHKey(blob, fields[0]); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+func (sshCodec) Names(canonical []byte) []string {
+	return nil
+}
+
+// checkSSHKey checks that the wire format of an SSH public key is a list of strings, starting
+// with the key type. If keyType is not empty it has to match.
+func checkSSHKey(blob []byte, keyType string) error {
+	var fields [][]byte
+	for rest := blob; len(rest) > 0; {
+		if len(rest) < 4 {
+			return errors.New("malformed SSH public key")
+		}
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(len(rest)-4) < uint64(n) {
+			return errors.New("malformed SSH public key")
+		}
+		fields = append(fields, rest[4:4+n])
+		rest = rest[4+n:]
+	}
+	if len(fields) < 2 {
+		return errors.New("SSH public key needs a type and a key")
+	}
+	if keyType != "" && string(fields[0]) != keyType {
+		return errors.New("SSH key type doesn't match the key")
+	}
+	for _, prefix := range []string{"ssh-", "ecdsa-", "sk-"} {
+		if strings.HasPrefix(string(fields[0]), prefix) {
+			return nil
+		}
+	}
+	return errors.New("unknown SSH key type " + string(fields[0]))
+}
+
+// pgpCodec encodes an OpenPGP transferable public key (RFC 4880, section 11.1) in binary, with
+// every packet re-encoded with a new format header and the shortest length, so that a key has a
+// single encoding. An ASCII armored key is accepted as well.
+type pgpCodec struct{}
+
+// pgpPublicKey is the tag of an OpenPGP public key packet
+const pgpPublicKey = 6
+
+func (pgpCodec) Canonical(raw []byte) ([]byte, error) {
+	if bytes.Contains(raw, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		var err error
+		if raw, err = pgpDearmor(raw); err != nil {
+			return nil, err
+		}
+	}
+	packets, err := pgpPackets(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 || packets[0].tag != pgpPublicKey {
+		return nil, errors.New("OpenPGP key has to start with a public key packet")
+	}
+	var canonical []byte
+	for _, p := range packets {
+		canonical = append(canonical, p.encode()...)
+	}
+	return canonical, nil
+}
+
+func (pgpCodec) Names(canonical []byte) []string {
+	return nil
+}
+
+// pgpPacket is the tag and body of an OpenPGP packet
+type pgpPacket struct {
+	tag  int
+	body []byte
+}
+
+// encode returns the packet with a new format header and the shortest length encoding
+// (RFC 4880, section 4.2.2)
+func (p *pgpPacket) encode() []byte {
+	buf := []byte{0xc0 | byte(p.tag)}
+	switch n := len(p.body); {
+	case n < 192:
+		buf = append(buf, byte(n))
+	case n < 8384:
+		buf = append(buf, byte((n-192)>>8+192), byte(n-192))
+	default:
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(n))
+		buf = append(append(buf, 255), length[:]...)
+	}
+	return append(buf, p.body...)
+}
+
+// pgpPackets splits binary OpenPGP data in packets. Partial and indeterminate lengths are not
+// used by keys and are refused.
+func pgpPackets(data []byte) ([]*pgpPacket, error) {
+	var packets []*pgpPacket
+	errMalformed := errors.New("malformed OpenPGP packet")
+	for len(data) > 0 {
+		header := data[0]
+		if header&0x80 == 0 || len(data) < 2 {
+			return nil, errMalformed
+		}
+		var tag, length, offset int
+		if header&0x40 == 0 {
+			tag = int(header>>2) & 0xf
+			switch header & 3 {
+			case 0:
+				length, offset = int(data[1]), 2
+			case 1:
+				if len(data) < 3 {
+					return nil, errMalformed
+				}
+				length, offset = int(binary.BigEndian.Uint16(data[1:])), 3
+			case 2:
+				if len(data) < 5 {
+					return nil, errMalformed
+				}
+				length, offset = int(binary.BigEndian.Uint32(data[1:])), 5
+			default:
+				return nil, errMalformed
+			}
+		} else {
+			tag = int(header & 0x3f)
+			switch first := int(data[1]); {
+			case first < 192:
+				length, offset = first, 2
+			case first < 224:
+				if len(data) < 3 {
+					return nil, errMalformed
+				}
+				length, offset = (first-192)<<8+int(data[2])+192, 3
+			case first == 255:
+				if len(data) < 6 {
+					return nil, errMalformed
+				}
+				length, offset = int(binary.BigEndian.Uint32(data[2:])), 6
+			default:
+				return nil, errMalformed
+			}
+		}
+		if length < 0 || len(data)-offset < length {
+			return nil, errMalformed
+		}
+		packets = append(packets, &pgpPacket{tag, data[offset : offset+length]})
+		data = data[offset+length:]
+	}
+	return packets, nil
+}
+
+// pgpDearmor returns the binary data of an ASCII armored public key, after checking its CRC
+func pgpDearmor(armored []byte) ([]byte, error) {
+	var body, checksum string
+	inBlock, inBody := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(armored))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "-----BEGIN PGP PUBLIC KEY BLOCK-----":
+			inBlock = true
+		case !inBlock:
+		case line == "-----END PGP PUBLIC KEY BLOCK-----":
+			inBlock = false
+		case !inBody:
+			// The armor headers end with an empty line
+			inBody = line == ""
+		case strings.HasPrefix(line, "="):
+			checksum = line[1:]
+		default:
+			body += line
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("malformed OpenPGP armor")
+	}
+	if checksum != "" {
+		sum, err := base64.StdEncoding.DecodeString(checksum)
+		crc := crc24(data)
+		if err != nil || len(sum) != 3 || !bytes.Equal(sum, []byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) {
+			return nil, errors.New("wrong OpenPGP armor checksum")
+		}
+	}
+	return data, nil
+}
+
+// crc24 returns the CRC-24 of RFC 4880, section 6.1
+func crc24(data []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
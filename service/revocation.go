@@ -0,0 +1,137 @@
+package certchain
+
+/*
+The revocation.go keeps the set of the certificates revoked in a CertChain.
+The owner revokes certificates with a block that logs none but lists their
+leaves; the root of the sorted set of all the revoked certificates is part of
+the MTR signed by the owner.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/sign"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// RevokedSet returns the sorted set of the certificates revoked in a CertChain, given its blocks
+// from the genesis block on
+func RevokedSet(blocks []*skipchain.SkipBlock) ([]crypto.HashID, error) {
+	var set []crypto.HashID
+	for _, sb := range blocks {
+		cb, err := ExtractCertBlock(sb)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, cb.Revoked...)
+	}
+	return sortedSet(set), nil
+}
+
+// sortedSet returns a sorted copy of the leaves
+func sortedSet(leaves []crypto.HashID) []crypto.HashID {
+	set := append([]crypto.HashID{}, leaves...)
+	sort.Slice(set, func(i, j int) bool { return bytes.Compare(set[i], set[j]) < 0 })
+	return set
+}
+
+// revocationRoot returns the root of the tree of a revocation set, and the Merkle proofs of
+// its leaves in the order of the sorted set
+func revocationRoot(set []crypto.HashID) (crypto.HashID, []crypto.Proof) {
+	return crypto.ProofTree(sha256.New, sortedSet(set))
+}
+
+// checkRevocations checks the revocations of a CertBlock against the certificates logged and
+// revoked before it. logged tells whether a certificate is logged in the CertChain.
+func checkRevocations(cb *CertBlock, revoked []crypto.HashID, logged func(crypto.HashID) bool) error {
+	if len(cb.Revoked) == 0 && len(cb.RevocationRoot) == 0 {
+		return nil
+	}
+	if len(cb.Revoked) == 0 || len(cb.Certs) > 0 {
+		return errors.New("a block revoking certificates has to list them and log none")
+	}
+	set := make(map[string]bool)
+	for _, cert := range revoked {
+		set[string(cert)] = true
+	}
+	for _, cert := range cb.Revoked {
+		if set[string(cert)] {
+			return errors.New("certificate is already revoked")
+		}
+		if !logged(cert) {
+			return errors.New("certificate isn't logged in the CertChain")
+		}
+		set[string(cert)] = true
+	}
+	if root, _ := revocationRoot(append(append([]crypto.HashID{}, revoked...), cb.Revoked...)); !bytes.Equal(root, cb.RevocationRoot) {
+		return errors.New("wrong revocation root")
+	}
+	return nil
+}
+
+// Hash returns the hash of the revocation status that is signed by the node
+func (rs *RevocationStatus) Hash() []byte {
+	h := sha256.New()
+	h.Write(rs.SkipchainID)
+	h.Write(rs.Cert)
+	binary.Write(h, binary.LittleEndian, int64(rs.Index))
+	binary.Write(h, binary.LittleEndian, rs.Timestamp)
+	binary.Write(h, binary.LittleEndian, rs.Revoked)
+	if rs.Block != nil {
+		h.Write(rs.Block.Hash)
+	}
+	return h.Sum(nil)
+}
+
+// Verify checks that the revocation status is signed with the key the roster holds for the
+// signer and that the proof or the revocation set matches the revocation root of Block. It
+// doesn't check that Block is part of the CertChain nor that it is the latest revocation block.
+func (rs *RevocationStatus) Verify(r *onet.Roster) error {
+	if rs.Signer == nil {
+		return errors.New("revocation status is not signed")
+	}
+	i, signer := r.Search(rs.Signer.ID)
+	if i < 0 {
+		return errors.New("signer is not part of the roster")
+	}
+	if err := sign.VerifySchnorr(suite, signer.Public, rs.Hash(), rs.Signature); err != nil {
+		return err
+	}
+	if rs.Block == nil {
+		if rs.Revoked {
+			return errors.New("revoked certificate without a revocation block")
+		}
+		return nil
+	}
+	if rs.Block.Index > rs.Index || !bytes.Equal(rs.Block.Hash, rs.Block.CalculateHash()) {
+		return errors.New("wrong revocation block")
+	}
+	cb, err := ExtractCertBlock(rs.Block)
+	if err != nil {
+		return err
+	}
+	if len(cb.RevocationRoot) == 0 || !validMTR(cb) {
+		return errors.New("revocation block doesn't commit to a revocation set")
+	}
+	if rs.Revoked {
+		if !rs.Proof.Check(sha256.New, cb.RevocationRoot, rs.Cert) {
+			return errors.New("wrong proof of revocation")
+		}
+		return nil
+	}
+	if root, _ := revocationRoot(rs.Set); !bytes.Equal(root, cb.RevocationRoot) {
+		return errors.New("revocation set doesn't match the revocation root")
+	}
+	for _, cert := range rs.Set {
+		if bytes.Equal(cert, rs.Cert) {
+			return errors.New("certificate is in the revocation set")
+		}
+	}
+	return nil
+}
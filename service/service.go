@@ -7,7 +7,14 @@ runs on the node.
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/TinfoilHat0/certchain/merkle_tree"
 	"github.com/dedis/cothority/messaging"
 	"github.com/dedis/cothority/skipchain"
 	"gopkg.in/dedis/crypto.v0/sign"
@@ -26,39 +33,659 @@ func init() {
 // Service is our CertChain-service
 type Service struct {
 	*onet.ServiceProcessor
-	propagate messaging.PropagationFunc
+	propagate          messaging.PropagationFunc
+	propagateEvidence  messaging.PropagationFunc
+	propagateName      messaging.PropagationFunc
+	propagateChain     messaging.PropagationFunc
+	propagateHeartbeat messaging.PropagationFunc
+	storageMutex       sync.Mutex
 	// A map for the unspent transactions. Key is the string of latestMTR and value is the hash of the skipblock
 	unspentTxnMap map[string]skipchain.SkipBlockID
+	// A map for all the transactions. Key is the string of latestMTR and value is the hash of the skipblock
+	blockMap map[string]skipchain.SkipBlockID
+	// A map for the spent transactions. Key is the string of the spent PrevMTR and value is the MTR that spent it
+	spentTxnMap map[string]*SignedMTR
+	// A map for the equivocation evidence. Key is the string of the skipchain ID
+	evidenceMap map[string][]*EquivocationEvidence
+	// A map for the latest known block of each CertChain. Key is the string of the skipchain ID
+	latestMap map[string]*skipchain.SkipBlock
+	// A map for the logged certificates. Key is built by certKey and value is where the certificate is logged
+	certMap map[string][]*certLocation
+	// A map for the names bound to CertChains. Key is the name and value is the skipchain ID
+	nameMap map[string]skipchain.SkipBlockID
+	// A map for the signed bindings of the names in nameMap. Key is the name
+	nameBindings map[string]*NameBinding
+	// A map for the names reserved for CertChains being created. Key is the name
+	nameReservations map[string]*nameReservation
+	// A map for all the blocks of each CertChain, in order. Key is the string of the skipchain ID
+	chainMap map[string][]*skipchain.SkipBlock
+	// newBlock is closed and replaced whenever a block is stored, to wake up the subscriptions
+	newBlock chan struct{}
+	// timestampSkew is how far the timestamp of a CertBlock may be from the clock of the node
+	timestampSkew time.Duration
+	stampMutex    sync.Mutex
+	// A map for the timestamping rounds being collected. Key is the ID of the roster signing them
+	stampRounds map[onet.RosterID]*stampRound
+	// A map for the latest heartbeat of each CertChain. Key is the string of the skipchain ID
+	heartbeatMap map[string]*Heartbeat
+	// heartbeatTimer fires the next heartbeats, it is nil while no CertChain is known
+	heartbeatTimer    *time.Timer
+	heartbeatInterval time.Duration
+	// domainValidation are the names of the domain validators run before a CertChain is bound
+	// to a name or its key changes, see validateDomain
+	domainValidation []string
 }
 
-// CreateSkipchain creates a new skipchain
+// certLocation is the position of a certificate in the CertBlock of a block
+type certLocation struct {
+	BlockID  skipchain.SkipBlockID
+	Position int
+}
+
+// certKey returns the key of a certificate of a CertChain in certMap
+func certKey(id skipchain.SkipBlockID, cert crypto.HashID) string {
+	return string(id) + string(cert)
+}
+
+// CreateSkipchain creates a new skipchain. If a name is given, the CertChain is bound to it
+// on a first-come-first-served basis: the name is reserved across the roster first.
 func (s *Service) CreateSkipchain(cs *CreateSkipchainRequest) (*CreateSkipchainResponse, onet.ClientError) {
+	base, height := cs.BaseHeight, cs.MaximumHeight
+	if base == 0 {
+		base = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+	if base < 1 || height < 1 || (base == 1 && height > 1) {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "invalid base or maximum height")
+	}
+	if cs.Name != "" {
+		if err := checkName(cs.Name); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorParameter, err.Error())
+		}
+		s.storageMutex.Lock()
+		_, taken := s.nameMap[cs.Name]
+		s.storageMutex.Unlock()
+		if taken {
+			return nil, onet.NewClientErrorCode(ErrorNameTaken, cs.Name+" is already bound to a CertChain")
+		}
+	}
+	if cs.CertBlock == nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "CertBlock is needed")
+	}
+	if err := checkRecords(cs.CertBlock); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, err.Error())
+	}
+	if cs.CertBlock.Delegation != nil {
+		return nil, onet.NewClientErrorCode(ErrorDelegation, "the genesis block can't be delegated")
+	}
+	if err := checkDelegation(cs.CertBlock.PublicKey, cs.CertBlock); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorDelegation, err.Error())
+	}
+	if err := checkTimestamp(nil, cs.CertBlock, time.Now(), s.timestampSkew); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorTimestamp, err.Error())
+	}
+	if policy := cs.CertBlock.Policy; policy != nil {
+		if err := policy.Validate(); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorPolicy, err.Error())
+		}
+		if err := policy.Check(cs.CertBlock); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorPolicy, err.Error())
+		}
+	}
+	// The name is reserved across the roster before the genesis block is stored
+	var binding *NameBinding
+	if cs.Name != "" {
+		var err onet.ClientError
+		if binding, err = s.reserveName(cs.Roster, cs.Name, cs.CertBlock); err != nil {
+			return nil, err
+		}
+	}
 	client := skipchain.NewClient()
-	sb, err := client.CreateGenesis(cs.Roster, 1, 1, []skipchain.VerifierID{VerifyTxn}, cs.CertBlock, nil)
+	sb, err := client.CreateGenesis(cs.Roster, base, height, []skipchain.VerifierID{VerifyTxn}, cs.CertBlock, nil)
 	if err != nil {
 		return nil, err
 	}
-	perr := s.startPropagation(cs.Roster, cs.CertBlock.LatestMTR, sb.Hash)
+	perr := s.startPropagation(cs.Roster, sb)
 	log.ErrFatal(perr)
+	if binding != nil {
+		if err := s.bindName(cs.Roster, binding, sb.Hash); err != nil {
+			return nil, err
+		}
+	}
 	return &CreateSkipchainResponse{sb}, nil
 }
 
 // AddNewTxn stores a new transaction in the underlying Skipchain service
-func (s *Service) AddNewTxn(txn *AddNewTxnRequest) (*AddNewTxnResponse, onet.ClientError) { //Where do I use roster here ?
+func (s *Service) AddNewTxn(txn *AddNewTxnRequest) (*AddNewTxnResponse, onet.ClientError) {
+	if txn.SkipBlock == nil || txn.CertBlock == nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "skipblock and CertBlock are needed")
+	}
+	if txn.Roster != nil && txn.Roster.ID != txn.SkipBlock.Roster.ID {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster differs from the one of the CertChain")
+	}
+	if err := checkRecords(txn.CertBlock); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, err.Error())
+	}
+	if err := s.checkTimestamp(txn.SkipBlock, txn.CertBlock); err != nil {
+		return nil, err
+	}
+	if err := s.checkPolicy(txn.SkipBlock, txn.CertBlock); err != nil {
+		return nil, err
+	}
+	if err := s.checkKeyChange(txn.SkipBlock, txn.CertBlock); err != nil {
+		return nil, err
+	}
+	if err := s.checkDelegatedBlock(txn.SkipBlock, txn.CertBlock); err != nil {
+		return nil, err
+	}
+	s.storageMutex.Lock()
+	rerr := s.verifyRevocations(txn.SkipBlock, txn.CertBlock)
+	s.storageMutex.Unlock()
+	if rerr != nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, rerr.Error())
+	}
 	client := skipchain.NewClient()
 	sb, err := client.StoreSkipBlock(txn.SkipBlock, nil, txn.CertBlock)
 	if err != nil {
-		return nil, err
+		return nil, s.classifyRejection(txn.SkipBlock, txn.CertBlock, err)
 	}
-	perr := s.startPropagation(txn.Roster, txn.CertBlock.LatestMTR, sb.Latest.Hash)
+	perr := s.startPropagation(sb.Latest.Roster, sb.Latest)
 	log.ErrFatal(perr)
 	return &AddNewTxnResponse{sb.Latest}, nil
 }
 
+// ChangeRoster stores a block with a new roster. Members of both rosters learn about the new
+// block, leaving members drop the CertChain and joining members get all its blocks.
+func (s *Service) ChangeRoster(req *ChangeRosterRequest) (*ChangeRosterResponse, onet.ClientError) {
+	if req.SkipBlock == nil || req.CertBlock == nil || req.Roster == nil || len(req.Roster.List) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster, skipblock and CertBlock are needed")
+	}
+	if err := checkRecords(req.CertBlock); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, err.Error())
+	}
+	if req.CertBlock.Delegation != nil {
+		return nil, onet.NewClientErrorCode(ErrorDelegation, "a delegate can't change the roster")
+	}
+	if err := s.checkTimestamp(req.SkipBlock, req.CertBlock); err != nil {
+		return nil, err
+	}
+	if err := s.checkPolicy(req.SkipBlock, req.CertBlock); err != nil {
+		return nil, err
+	}
+	if err := s.checkKeyChange(req.SkipBlock, req.CertBlock); err != nil {
+		return nil, err
+	}
+	if err := s.checkDelegatedBlock(req.SkipBlock, req.CertBlock); err != nil {
+		return nil, err
+	}
+	client := skipchain.NewClient()
+	reply, err := client.StoreSkipBlock(req.SkipBlock, req.Roster, req.CertBlock)
+	if err != nil {
+		return nil, s.classifyRejection(req.SkipBlock, req.CertBlock, err)
+	}
+	sb := reply.Latest
+	oldRoster := req.SkipBlock.Roster
+	joined := joinedMembers(oldRoster, sb.Roster)
+	if len(joined) > 0 {
+		if err := s.catchUp(oldRoster, onet.NewRoster(joined), sb); err != nil {
+			return nil, err
+		}
+	}
+	union := append(append([]*network.ServerIdentity{}, oldRoster.List...), joined...)
+	perr := s.startPropagation(onet.NewRoster(union), sb)
+	log.ErrFatal(perr)
+	return &ChangeRosterResponse{sb}, nil
+}
+
+// catchUp propagates all the blocks of the CertChain before sb to the given roster. The blocks
+// are fetched from the old roster, as the joining members don't have them.
+func (s *Service) catchUp(oldRoster, roster *onet.Roster, sb *skipchain.SkipBlock) onet.ClientError {
+	client := skipchain.NewClient()
+	var blocks []*skipchain.SkipBlock
+	for id := sb.SkipChainID(); !bytes.Equal(id, sb.Hash); {
+		block, err := client.GetSingleBlock(oldRoster, id)
+		if err != nil {
+			return err
+		}
+		if len(block.ForwardLink) == 0 {
+			return onet.NewClientErrorCode(ErrorParameter, "missing forward link")
+		}
+		blocks = append(blocks, block)
+		id = block.ForwardLink[0].Hash
+	}
+	replies, err := s.propagateChain(roster, &PropagateChain{blocks}, propagateTimeout)
+	if err != nil {
+		return onet.NewClientError(err)
+	}
+	if replies != len(roster.List) {
+		log.Warn("Did only get", replies, "out of", len(roster.List))
+	}
+	return nil
+}
+
+// checkPolicy checks a CertBlock appended after latest against the policy of the CertChain.
+// A broken rule is returned as an ErrorPolicy.
+func (s *Service) checkPolicy(latest *skipchain.SkipBlock, cb *CertBlock) onet.ClientError {
+	policy, err := s.chainPolicy(latest)
+	if err != nil {
+		return err
+	}
+	prev, perr := ExtractCertBlock(latest)
+	if perr != nil {
+		return onet.NewClientErrorCode(ErrorParameter, perr.Error())
+	}
+	if perr = checkBlock(policy, prev, cb); perr != nil {
+		return onet.NewClientErrorCode(ErrorPolicy, perr.Error())
+	}
+	return nil
+}
+
+// chainPolicy returns the policy set in the genesis block of the CertChain of a block, or nil
+// if there is none
+func (s *Service) chainPolicy(sb *skipchain.SkipBlock) (*Policy, onet.ClientError) {
+	genesis := sb
+	if sb.Index > 0 {
+		s.storageMutex.Lock()
+		chain := s.chainMap[string(sb.SkipChainID())]
+		s.storageMutex.Unlock()
+		if len(chain) > 0 {
+			genesis = chain[0]
+		} else {
+			var err onet.ClientError
+			genesis, err = skipchain.NewClient().GetSingleBlock(sb.Roster, sb.SkipChainID())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	_, cb, err := network.Unmarshal(genesis.Data)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "genesis block doesn't hold a CertBlock")
+	}
+	certBlock, ok := cb.(*CertBlock)
+	if !ok {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "genesis block doesn't hold a CertBlock")
+	}
+	return certBlock.Policy, nil
+}
+
+// checkTimestamp checks the timestamp of a CertBlock appended after latest
+func (s *Service) checkTimestamp(latest *skipchain.SkipBlock, cb *CertBlock) onet.ClientError {
+	prev, err := ExtractCertBlock(latest)
+	if err != nil {
+		return onet.NewClientErrorCode(ErrorParameter, err.Error())
+	}
+	if err := checkTimestamp(prev, cb, time.Now(), s.timestampSkew); err != nil {
+		return onet.NewClientErrorCode(ErrorTimestamp, err.Error())
+	}
+	return nil
+}
+
+// checkTimestamp checks the timestamp of a CertBlock against the clock of the node and the
+// timestamp of the previous CertBlock, which is nil for a genesis block. A CertBlock without
+// timestamp is only accepted after another one without timestamp.
+func checkTimestamp(prev, cb *CertBlock, now time.Time, skew time.Duration) error {
+	if cb.Timestamp == 0 {
+		if prev != nil && prev.Timestamp != 0 {
+			return errors.New("timestamp is missing")
+		}
+		return nil
+	}
+	if d := cb.Time().Sub(now); d > skew || d < -skew {
+		return errors.New("timestamp is more than " + skew.String() + " away from the clock of the node")
+	}
+	if prev != nil && cb.Timestamp < prev.Timestamp {
+		return errors.New("timestamp is older than the one of the previous block")
+	}
+	return nil
+}
+
+// checkKeyChange checks that the domains of the names bound to the CertChain publish the new key
+// of a CertBlock changing the key of the owner
+func (s *Service) checkKeyChange(latest *skipchain.SkipBlock, cb *CertBlock) onet.ClientError {
+	prev, err := ExtractCertBlock(latest)
+	if err != nil {
+		return onet.NewClientErrorCode(ErrorParameter, err.Error())
+	}
+	if len(s.domainValidation) == 0 || cb.PublicKey == nil || prev.PublicKey.Equal(cb.PublicKey) {
+		return nil
+	}
+	var names []string
+	s.storageMutex.Lock()
+	for name, id := range s.nameMap {
+		if bytes.Equal(id, latest.SkipChainID()) {
+			names = append(names, name)
+		}
+	}
+	s.storageMutex.Unlock()
+	for _, name := range names {
+		if err := validateDomain(s.domainValidation, name, cb.PublicKey); err != nil {
+			return onet.NewClientErrorCode(ErrorDomain, err.Error())
+		}
+	}
+	return nil
+}
+
+// verifyRevocations checks the revocations of a CertBlock appended after latest against the
+// certificates logged and revoked in the CertChain. storageMutex must be held by the caller.
+func (s *Service) verifyRevocations(latest *skipchain.SkipBlock, cb *CertBlock) error {
+	if len(cb.Revoked) == 0 && len(cb.RevocationRoot) == 0 {
+		return nil
+	}
+	id := latest.SkipChainID()
+	chain := s.chainMap[string(id)]
+	if len(chain) != latest.Index+1 {
+		return errors.New("revocations have to follow the latest block")
+	}
+	revoked, err := RevokedSet(chain)
+	if err != nil {
+		return err
+	}
+	return checkRevocations(cb, revoked, func(cert crypto.HashID) bool {
+		_, logged := s.certMap[certKey(id, cert)]
+		return logged
+	})
+}
+
+// classifyRejection turns the error of a rejected transaction into a final rejection if the
+// transaction can never be accepted, so that the client doesn't retry it with other nodes
+func (s *Service) classifyRejection(latest *skipchain.SkipBlock, cb *CertBlock, err onet.ClientError) onet.ClientError {
+	s.storageMutex.Lock()
+	_, spent := s.spentTxnMap[string(cb.PrevMTR)]
+	s.storageMutex.Unlock()
+	if spent {
+		return onet.NewClientErrorCode(ErrorSpent, "PrevMTR has already been spent")
+	}
+	if _, prev, merr := network.Unmarshal(latest.Data); merr == nil {
+		if cbPrev, ok := prev.(*CertBlock); ok {
+			if sign.VerifySchnorr(suite, signingKey(cbPrev.PublicKey, cb), cb.LatestMTR, cb.LatestSignedMTR) != nil {
+				return onet.NewClientErrorCode(ErrorSignature, "CertBlock is not signed by the owner")
+			}
+		}
+	}
+	return err
+}
+
+// GetLatest returns the latest block of a CertChain together with the forward-link proof
+// from the trusted block
+func (s *Service) GetLatest(req *GetLatestRequest) (*GetLatestResponse, onet.ClientError) {
+	if req.Roster == nil || len(req.TrustedID) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster and trusted block are needed")
+	}
+	client := skipchain.NewClient()
+	reply, err := client.GetUpdateChain(req.Roster, req.TrustedID)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Update) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "unknown trusted block")
+	}
+	return &GetLatestResponse{reply.Update[len(reply.Update)-1], reply.Update}, nil
+}
+
+// GetBlockByMTR returns the block holding the requested MTR together with the forward-link
+// proof from the trusted block
+func (s *Service) GetBlockByMTR(req *GetBlockByMTRRequest) (*GetBlockByMTRResponse, onet.ClientError) {
+	if req.Roster == nil || len(req.TrustedID) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster and trusted block are needed")
+	}
+	s.storageMutex.Lock()
+	id, exists := s.blockMap[string(req.MTR)]
+	s.storageMutex.Unlock()
+	if !exists {
+		return nil, onet.NewClientErrorCode(ErrorUnknownMTR, "no block with this MTR")
+	}
+	proof, err := getProof(req.Roster, req.TrustedID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &GetBlockByMTRResponse{proof[len(proof)-1], proof}, nil
+}
+
+// LookupCert tells whether a certificate is logged in a CertChain. If it is, the inclusion
+// proof in the first block holding it is returned. Otherwise the node signs a statement that
+// the certificate is not logged up to the latest block it knows.
+func (s *Service) LookupCert(req *LookupCertRequest) (*LookupCertResponse, onet.ClientError) {
+	if req.Roster == nil || len(req.SkipchainID) == 0 || len(req.Cert) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster, skipchain ID and certificate are needed")
+	}
+	s.storageMutex.Lock()
+	locations := s.certMap[certKey(req.SkipchainID, req.Cert)]
+	latest, known := s.latestMap[string(req.SkipchainID)]
+	s.storageMutex.Unlock()
+	if !known {
+		return nil, onet.NewClientErrorCode(ErrorUnknownChain, "unknown CertChain")
+	}
+	if len(locations) == 0 {
+		absence := &CertAbsence{
+			SkipchainID: req.SkipchainID,
+			Cert:        req.Cert,
+			Height:      latest.Index,
+			BlockID:     latest.Hash,
+			Signer:      s.ServerIdentity(),
+		}
+		sig, err := sign.Schnorr(suite, s.Private(), absence.Hash())
+		if err != nil {
+			return nil, onet.NewClientError(err)
+		}
+		absence.Signature = sig
+		return &LookupCertResponse{Absence: absence}, nil
+	}
+	inclusion, err := getInclusionProof(req.Roster, req.SkipchainID, locations[0])
+	if err != nil {
+		return nil, err
+	}
+	return &LookupCertResponse{Inclusion: inclusion}, nil
+}
+
+// FirstSeen returns the inclusion proof of a certificate in the earliest block of a CertChain
+// logging it
+func (s *Service) FirstSeen(req *FirstSeenRequest) (*FirstSeenResponse, onet.ClientError) {
+	if req.Roster == nil || len(req.SkipchainID) == 0 || len(req.Cert) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster, skipchain ID and certificate are needed")
+	}
+	s.storageMutex.Lock()
+	locations := s.certMap[certKey(req.SkipchainID, req.Cert)]
+	chain := s.chainMap[string(req.SkipchainID)]
+	_, known := s.latestMap[string(req.SkipchainID)]
+	s.storageMutex.Unlock()
+	if !known {
+		return nil, onet.NewClientErrorCode(ErrorUnknownChain, "unknown CertChain")
+	}
+	if len(locations) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "certificate is not logged in the CertChain")
+	}
+	// The locations are stored in the order of the blocks, but the node may have missed some
+	indexes := make(map[string]int)
+	for _, sb := range chain {
+		indexes[string(sb.Hash)] = sb.Index
+	}
+	first := locations[0]
+	for _, location := range locations[1:] {
+		index, ok := indexes[string(location.BlockID)]
+		firstIndex, firstOk := indexes[string(first.BlockID)]
+		if ok && firstOk && index < firstIndex {
+			first = location
+		}
+	}
+	inclusion, err := getInclusionProof(req.Roster, req.SkipchainID, first)
+	if err != nil {
+		return nil, err
+	}
+	return &FirstSeenResponse{inclusion}, nil
+}
+
+// ResolveName returns the CertChain bound to a name together with its latest block. If the name
+// itself is not bound, the wildcard zone covering it is tried.
+func (s *Service) ResolveName(req *ResolveNameRequest) (*ResolveNameResponse, onet.ClientError) {
+	if req.Roster == nil || req.Name == "" {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster and name are needed")
+	}
+	s.storageMutex.Lock()
+	name := req.Name
+	id, exists := s.nameMap[name]
+	if !exists {
+		name = wildcardName(req.Name)
+		id, exists = s.nameMap[name]
+	}
+	binding := s.nameBindings[name]
+	s.storageMutex.Unlock()
+	if !exists {
+		return nil, onet.NewClientErrorCode(ErrorUnknownName, req.Name+" is not bound to a CertChain")
+	}
+	latest, err := s.GetLatest(&GetLatestRequest{req.Roster, id})
+	if err != nil {
+		return nil, err
+	}
+	return &ResolveNameResponse{id, latest.SkipBlock, latest.Proof, binding}, nil
+}
+
+// GetEvidence returns the equivocation evidence the node holds for a CertChain
+func (s *Service) GetEvidence(req *GetEvidenceRequest) (*GetEvidenceResponse, onet.ClientError) {
+	if len(req.SkipchainID) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "no skipchain ID given")
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	return &GetEvidenceResponse{s.evidenceMap[string(req.SkipchainID)]}, nil
+}
+
+// Subscribe returns the blocks of the CertChains starting at the requested heights. If none is
+// known yet, the request is held until a new block is stored or subscribeWait is over, so that a
+// client looping over Subscribe receives every new block as soon as it is propagated.
+func (s *Service) Subscribe(req *SubscribeRequest) (*SubscribeResponse, onet.ClientError) {
+	if len(req.Chains) == 0 || len(req.Chains) != len(req.Heights) {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "one height per CertChain is needed")
+	}
+	timeout := time.After(subscribeWait)
+	for {
+		s.storageMutex.Lock()
+		blocks, err := s.newBlocks(req)
+		notify := s.newBlock
+		s.storageMutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if len(blocks) > 0 {
+			return &SubscribeResponse{blocks}, nil
+		}
+		select {
+		case <-notify:
+		case <-timeout:
+			return &SubscribeResponse{}, nil
+		}
+	}
+}
+
+// newBlocks returns at most maxSubscribeBlocks blocks of the subscribed CertChains.
+// storageMutex must be held by the caller.
+func (s *Service) newBlocks(req *SubscribeRequest) ([]*skipchain.SkipBlock, onet.ClientError) {
+	var blocks []*skipchain.SkipBlock
+	for i, id := range req.Chains {
+		chain, known := s.chainMap[string(id)]
+		if !known {
+			return nil, onet.NewClientErrorCode(ErrorUnknownChain, "unknown CertChain")
+		}
+		if req.Heights[i] < 0 {
+			return nil, onet.NewClientErrorCode(ErrorParameter, "negative height")
+		}
+		if req.Heights[i] < len(chain) {
+			blocks = append(blocks, chain[req.Heights[i]:]...)
+		}
+	}
+	if len(blocks) > maxSubscribeBlocks {
+		blocks = blocks[:maxSubscribeBlocks]
+	}
+	return blocks, nil
+}
+
+// GetSTH returns the RFC 6962 tree head of a CertChain up to the latest block the node knows,
+// signed by the node
+func (s *Service) GetSTH(req *GetSTHRequest) (*GetSTHResponse, onet.ClientError) {
+	if len(req.SkipchainID) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "no skipchain ID given")
+	}
+	s.storageMutex.Lock()
+	chain, known := s.chainMap[string(req.SkipchainID)]
+	s.storageMutex.Unlock()
+	if !known {
+		return nil, onet.NewClientErrorCode(ErrorUnknownChain, "unknown CertChain")
+	}
+	entries, err := CTEntries(chain)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	sth := &SignedTreeHead{
+		SkipchainID: req.SkipchainID,
+		Index:       chain[len(chain)-1].Index,
+		TreeSize:    len(entries),
+		Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+		RootHash:    crypto.RFC6962Root(CTLeaves(entries)),
+		Signer:      s.ServerIdentity(),
+	}
+	sth.Signature, err = sign.Schnorr(suite, s.Private(), sth.Hash())
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return &GetSTHResponse{sth}, nil
+}
+
+// RevocationStatus returns whether a certificate of a CertChain is revoked as of the latest block
+// the node knows, signed by the node
+func (s *Service) RevocationStatus(req *RevocationStatusRequest) (*RevocationStatusResponse, onet.ClientError) {
+	if len(req.SkipchainID) == 0 || len(req.Cert) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "skipchain ID and certificate are needed")
+	}
+	s.storageMutex.Lock()
+	chain, known := s.chainMap[string(req.SkipchainID)]
+	s.storageMutex.Unlock()
+	if !known {
+		return nil, onet.NewClientErrorCode(ErrorUnknownChain, "unknown CertChain")
+	}
+	rs := &RevocationStatus{
+		SkipchainID: req.SkipchainID,
+		Cert:        req.Cert,
+		Index:       chain[len(chain)-1].Index,
+		Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+		Signer:      s.ServerIdentity(),
+	}
+	for i := len(chain) - 1; i >= 0 && rs.Block == nil; i-- {
+		if cb, err := ExtractCertBlock(chain[i]); err == nil && len(cb.RevocationRoot) > 0 {
+			rs.Block = chain[i]
+		}
+	}
+	if rs.Block != nil {
+		set, err := RevokedSet(chain[:rs.Block.Index+1])
+		if err != nil {
+			return nil, onet.NewClientError(err)
+		}
+		rs.Set = set
+		_, proofs := revocationRoot(set)
+		for i, cert := range set {
+			if bytes.Equal(cert, req.Cert) {
+				rs.Revoked, rs.Proof, rs.Set = true, proofs[i], nil
+				break
+			}
+		}
+	}
+	var err error
+	rs.Signature, err = sign.Schnorr(suite, s.Private(), rs.Hash())
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return &RevocationStatusResponse{rs}, nil
+}
+
 // VerifyTxn verifies a txn as follows:
 // 1. Get the public key from the previous block
 // 2. Verify the signature on the blocks latestMTRW
-// 3. Check whether the block is in unspentTxnMap. If it is, remove block from the map and return true. Otherwise, return false
+// 3. Check its timestamp against the clock of the node and the previous block
+// 4. Check the block against the policy of the CertChain
+// 5. Check the certificates it revokes and the delegation it is signed under, if any
+// 6. Check whether the block is in unspentTxnMap. If it is, remove block from the map and return true. Otherwise, return false
+// If the PrevMTR has already been spent by another MTR, an equivocation evidence is created and propagated
 func (s *Service) VerifyTxn(newID []byte, newSB *skipchain.SkipBlock) bool {
 	client := skipchain.NewClient()
 	previousSB, cerr := client.GetSingleBlock(newSB.Roster, newSB.BackLinkIDs[0])
@@ -68,30 +695,133 @@ func (s *Service) VerifyTxn(newID []byte, newSB *skipchain.SkipBlock) bool {
 	// Get the public key from the previous block as verification has to be done using that key
 	_, cbPrev, err := network.Unmarshal(previousSB.Data)
 	log.ErrFatal(err)
-	publicKey := cbPrev.(*CertBlock).PublicKey
-	// Verify the signature
+	owner := cbPrev.(*CertBlock).PublicKey
+	// Verify the signature, made by the owner or by a delegate
 	_, cb, _ := network.Unmarshal(newSB.Data)
+	publicKey := signingKey(owner, cb.(*CertBlock))
 	signErr := sign.VerifySchnorr(suite, publicKey, cb.(*CertBlock).LatestMTR, cb.(*CertBlock).LatestSignedMTR)
 	if signErr != nil {
 		return false
 	}
-	// If block is the genesis block, verification only consists of checking the signature
+	// The MTR has to be computed from the certificates of the block
+	if !validMTR(cb.(*CertBlock)) {
+		return false
+	}
+	// The bodies sent along have to be valid records of the type of the block
+	if err := checkRecords(cb.(*CertBlock)); err != nil {
+		log.Lvl2(s.ServerIdentity(), "rejects block:", err)
+		return false
+	}
+	// If block is the genesis block, verification only consists of checking the signature and
+	// that its own certificates follow the policy it sets
 	if bytes.Equal(cb.(*CertBlock).PrevMTR, make([]byte, 32)) {
+		if len(cb.(*CertBlock).Revoked) > 0 || len(cb.(*CertBlock).RevocationRoot) > 0 {
+			return false
+		}
+		if checkTimestamp(nil, cb.(*CertBlock), time.Now(), s.timestampSkew) != nil {
+			return false
+		}
+		if cb.(*CertBlock).Delegation != nil || checkDelegation(cb.(*CertBlock).PublicKey, cb.(*CertBlock)) != nil {
+			return false
+		}
+		if policy := cb.(*CertBlock).Policy; policy != nil {
+			return policy.Validate() == nil && policy.Check(cb.(*CertBlock)) == nil
+		}
 		return true
 	}
+	if err := checkTimestamp(cbPrev.(*CertBlock), cb.(*CertBlock), time.Now(), s.timestampSkew); err != nil {
+		log.Lvl2(s.ServerIdentity(), "rejects block:", err)
+		return false
+	}
+	if err := s.checkPolicy(previousSB, cb.(*CertBlock)); err != nil {
+		log.Lvl2(s.ServerIdentity(), "rejects block:", err.ErrorMsg())
+		return false
+	}
+	if err := checkDelegation(owner, cb.(*CertBlock)); err != nil {
+		log.Lvl2(s.ServerIdentity(), "rejects block:", err)
+		return false
+	}
+	// The domains of the names bound to the CertChain have to publish a new owner key
+	if err := s.checkKeyChange(previousSB, cb.(*CertBlock)); err != nil {
+		log.Lvl2(s.ServerIdentity(), "rejects block:", err.ErrorMsg())
+		return false
+	}
+	signed := newSignedMTR(cb.(*CertBlock), publicKey)
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if err := s.verifyRevocations(previousSB, cb.(*CertBlock)); err != nil {
+		log.Lvl2(s.ServerIdentity(), "rejects block:", err)
+		return false
+	}
+	if err := s.verifyDelegation(previousSB, cb.(*CertBlock)); err != nil {
+		log.Lvl2(s.ServerIdentity(), "rejects block:", err)
+		return false
+	}
 	// Check if the block is unspent. If it is spent, i.e. it can't be found in the map, return false
-	if _, exists := s.unspentTxnMap[string(cb.(*CertBlock).PrevMTR)]; !exists {
+	if _, exists := s.unspentTxnMap[string(signed.PrevMTR)]; !exists {
+		// The same key signed a competing history
+		if spent, ok := s.spentTxnMap[string(signed.PrevMTR)]; ok && !bytes.Equal(spent.LatestMTR, signed.LatestMTR) &&
+			spent.PublicKey.Equal(signed.PublicKey) {
+			s.reportEquivocation(previousSB.SkipChainID(), newSB.Roster, spent, signed)
+		}
 		return false
 	}
 	// Spend the txn by removing it from the map
-	delete(s.unspentTxnMap, string(cb.(*CertBlock).PrevMTR))
+	delete(s.unspentTxnMap, string(signed.PrevMTR))
+	s.spentTxnMap[string(signed.PrevMTR)] = signed
 	return true
 }
 
+// reportEquivocation signs an evidence for two MTRs spending the same PrevMTR, stores it
+// and propagates it to the roster. storageMutex must be held by the caller.
+func (s *Service) reportEquivocation(id skipchain.SkipBlockID, roster *onet.Roster, first, second *SignedMTR) {
+	evidence := &EquivocationEvidence{
+		SkipchainID: id,
+		First:       first,
+		Second:      second,
+		Reporter:    s.ServerIdentity(),
+	}
+	hash, err := evidence.Hash()
+	if err != nil {
+		log.Error("Couldn't hash equivocation evidence:", err)
+		return
+	}
+	sig, err := sign.Schnorr(suite, s.Private(), hash)
+	if err != nil {
+		log.Error("Couldn't sign equivocation evidence:", err)
+		return
+	}
+	evidence.Signature = sig
+	log.Lvl2(s.ServerIdentity(), "detected an equivocation in", id)
+	s.addEvidence(evidence)
+	go func() {
+		replies, err := s.propagateEvidence(roster, evidence, propagateTimeout)
+		if err != nil {
+			log.Error("Couldn't propagate equivocation evidence:", err)
+			return
+		}
+		if replies != len(roster.List) {
+			log.Warn("Did only get", replies, "out of", len(roster.List))
+		}
+	}()
+}
+
+// addEvidence stores an evidence unless the same equivocation is already known.
+// storageMutex must be held by the caller.
+func (s *Service) addEvidence(evidence *EquivocationEvidence) {
+	key := string(evidence.SkipchainID)
+	for _, e := range s.evidenceMap[key] {
+		if e.sameEquivocation(evidence) {
+			return
+		}
+	}
+	s.evidenceMap[key] = append(s.evidenceMap[key], evidence)
+}
+
 // StartPropagation is a convenience function to call propagate so that we don't duplicate code
-func (s *Service) startPropagation(roster *onet.Roster, blockMTR []byte, blockHash skipchain.SkipBlockID) error {
+func (s *Service) startPropagation(roster *onet.Roster, sb *skipchain.SkipBlock) error {
 	log.Lvl3("Starting to propagate for service", s.ServerIdentity())
-	replies, err := s.propagate(roster, &PropagateTxnInfo{blockMTR, blockHash}, propagateTimeout)
+	replies, err := s.propagate(roster, &PropagateTxnInfo{sb}, propagateTimeout)
 	if err != nil {
 		return err
 	}
@@ -109,7 +839,268 @@ func (s *Service) propagateTxnMap(msg network.Message) {
 		log.Error("Couldn't convert to PropagateTxnInfo")
 		return
 	}
-	s.unspentTxnMap[string(txnInfo.BlockMTR)] = txnInfo.BlockHash
+	sb := txnInfo.SkipBlock
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if i, _ := sb.Roster.Search(s.ServerIdentity().ID); i < 0 {
+		log.Lvl2(s.ServerIdentity(), "left the roster of", sb.SkipChainID())
+		s.dropChain(sb.SkipChainID())
+		return
+	}
+	s.storeBlock(sb)
+}
+
+// propagateChainMap stores all the blocks of a CertChain this node just joined, once they are
+// checked to be linked from the genesis block on
+func (s *Service) propagateChainMap(msg network.Message) {
+	chain, ok := msg.(*PropagateChain)
+	if !ok {
+		log.Error("Couldn't convert to PropagateChain")
+		return
+	}
+	if err := verifyChain(chain.Blocks); err != nil {
+		log.Error("Received invalid CertChain:", err)
+		return
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	for _, sb := range chain.Blocks {
+		s.storeBlock(sb)
+	}
+}
+
+// verifyChain checks that the blocks are a CertChain from its genesis block on
+func verifyChain(blocks []*skipchain.SkipBlock) error {
+	if len(blocks) == 0 || blocks[0].Index != 0 {
+		return errors.New("blocks don't start with a genesis block")
+	}
+	if err := VerifyGenesis(blocks[0]); err != nil {
+		return err
+	}
+	for i := 1; i < len(blocks); i++ {
+		if err := VerifyBlockLink(blocks[i-1], blocks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeBlock updates the maps with a new block of a CertChain.
+// storageMutex must be held by the caller.
+func (s *Service) storeBlock(sb *skipchain.SkipBlock) {
+	_, cb, err := network.Unmarshal(sb.Data)
+	if err != nil {
+		log.Error("Couldn't unmarshal CertBlock:", err)
+		return
+	}
+	certBlock, ok := cb.(*CertBlock)
+	if !ok {
+		log.Error("Block doesn't hold a CertBlock")
+		return
+	}
+	id := sb.SkipChainID()
+	delete(s.unspentTxnMap, string(certBlock.PrevMTR))
+	s.unspentTxnMap[string(certBlock.LatestMTR)] = sb.Hash
+	s.blockMap[string(certBlock.LatestMTR)] = sb.Hash
+	if latest, exists := s.latestMap[string(id)]; !exists || latest.Index < sb.Index {
+		s.latestMap[string(id)] = sb
+	}
+	for i, cert := range certBlock.Certs {
+		key := certKey(id, cert)
+		s.certMap[key] = append(s.certMap[key], &certLocation{sb.Hash, i})
+	}
+	s.scheduleHeartbeats()
+	chain := s.chainMap[string(id)]
+	// A member that didn't validate the block, e.g. one that joined the roster, still has to
+	// know that its PrevMTR is spent
+	if _, spent := s.spentTxnMap[string(certBlock.PrevMTR)]; !spent && sb.Index > 0 && sb.Index == len(chain) {
+		if prev, err := ExtractCertBlock(chain[sb.Index-1]); err == nil {
+			s.spentTxnMap[string(certBlock.PrevMTR)] = newSignedMTR(certBlock, signingKey(prev.PublicKey, certBlock))
+		}
+	}
+	if sb.Index == len(chain) {
+		s.chainMap[string(id)] = append(chain, sb)
+		close(s.newBlock)
+		s.newBlock = make(chan struct{})
+	} else if sb.Index > len(chain) {
+		log.Warn(s.ServerIdentity(), "missed blocks of", id, "before block", sb.Index)
+	}
+}
+
+// dropChain forgets the state of a CertChain.
+// storageMutex must be held by the caller.
+func (s *Service) dropChain(id skipchain.SkipBlockID) {
+	if latest, exists := s.latestMap[string(id)]; exists {
+		if _, cb, err := network.Unmarshal(latest.Data); err == nil {
+			delete(s.unspentTxnMap, string(cb.(*CertBlock).LatestMTR))
+		}
+	}
+	delete(s.latestMap, string(id))
+	delete(s.chainMap, string(id))
+	delete(s.heartbeatMap, string(id))
+	for key := range s.certMap {
+		if strings.HasPrefix(key, string(id)) {
+			delete(s.certMap, key)
+		}
+	}
+}
+
+// joinedMembers returns the members of the new roster that are not in the old one
+func joinedMembers(oldRoster, newRoster *onet.Roster) []*network.ServerIdentity {
+	var joined []*network.ServerIdentity
+	for _, si := range newRoster.List {
+		if i, _ := oldRoster.Search(si.ID); i < 0 {
+			joined = append(joined, si)
+		}
+	}
+	return joined
+}
+
+// propagateNameMap binds a name to a CertChain unless it is already bound to another one. The
+// binding has to be signed by the roster of the CertChain for its genesis block.
+func (s *Service) propagateNameMap(msg network.Message) {
+	binding, ok := msg.(*PropagateName)
+	if !ok {
+		log.Error("Couldn't convert to PropagateName")
+		return
+	}
+	if err := checkName(binding.Name); err != nil {
+		log.Error("Received invalid name:", err)
+		return
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	chain := s.chainMap[string(binding.SkipchainID)]
+	if binding.Binding == nil || binding.Binding.Name != binding.Name || len(chain) == 0 {
+		log.Error("Received name binding of an unknown CertChain")
+		return
+	}
+	if err := binding.Binding.Verify(chain[0].Roster); err != nil {
+		log.Error("Received invalid name binding:", err)
+		return
+	}
+	if err := binding.Binding.VerifyGenesis(chain[0]); err != nil {
+		log.Error("Received invalid name binding:", err)
+		return
+	}
+	if id, exists := s.nameMap[binding.Name]; exists {
+		if !bytes.Equal(id, binding.SkipchainID) {
+			log.Warn(binding.Name, "is already bound to another CertChain")
+		}
+		return
+	}
+	s.nameMap[binding.Name] = binding.SkipchainID
+	s.nameBindings[binding.Name] = binding.Binding
+	delete(s.nameReservations, binding.Name)
+}
+
+// propagateEvidenceMap stores the equivocation evidence received from another node
+func (s *Service) propagateEvidenceMap(msg network.Message) {
+	evidence, ok := msg.(*EquivocationEvidence)
+	if !ok {
+		log.Error("Couldn't convert to EquivocationEvidence")
+		return
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	chain, known := s.chainMap[string(evidence.SkipchainID)]
+	if !known {
+		log.Error("Received equivocation evidence for an unknown CertChain")
+		return
+	}
+	if err := evidence.Verify(chain[len(chain)-1].Roster); err != nil {
+		log.Error("Received invalid equivocation evidence:", err)
+		return
+	}
+	s.addEvidence(evidence)
+}
+
+// bindName propagates the signed binding of a name to a CertChain and checks that the
+// binding won, i.e. no other CertChain has been bound to the name in the meantime
+func (s *Service) bindName(roster *onet.Roster, binding *NameBinding, id skipchain.SkipBlockID) onet.ClientError {
+	replies, err := s.propagateName(roster, &PropagateName{binding.Name, id, binding}, propagateTimeout)
+	if err != nil {
+		return onet.NewClientError(err)
+	}
+	if replies != len(roster.List) {
+		log.Warn("Did only get", replies, "out of", len(roster.List))
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if !bytes.Equal(s.nameMap[binding.Name], id) {
+		return onet.NewClientErrorCode(ErrorNameTaken, binding.Name+" has been bound to another CertChain")
+	}
+	return nil
+}
+
+// checkName returns an error if name is neither a DNS name nor a wildcard zone like *.example.com
+func checkName(name string) error {
+	if len(name) > 253 {
+		return errors.New("name is too long")
+	}
+	labels := strings.Split(strings.TrimPrefix(name, "*."), ".")
+	if len(labels) < 2 {
+		return errors.New("name needs at least two labels")
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return errors.New("invalid label length in " + name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("label can't start or end with a hyphen in " + name)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return errors.New("invalid character in " + name)
+			}
+		}
+	}
+	return nil
+}
+
+// wildcardName returns the wildcard zone covering a name, i.e. *.example.com for www.example.com
+func wildcardName(name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return ""
+	}
+	return "*" + name[i:]
+}
+
+// getProof returns the blocks from the block with ID from to the block with ID to,
+// following the highest forward link that doesn't jump over the target each time
+func getProof(roster *onet.Roster, from, to skipchain.SkipBlockID) ([]*skipchain.SkipBlock, onet.ClientError) {
+	client := skipchain.NewClient()
+	target, err := client.GetSingleBlock(roster, to)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := walk(roster, from, target.Index)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(proof[len(proof)-1].Hash, target.Hash) {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "requested block is not in the trusted chain")
+	}
+	return proof, nil
+}
+
+// getInclusionProof returns the proof that a certificate is logged at the given location,
+// together with the forward-link proof from the genesis block
+func getInclusionProof(roster *onet.Roster, id skipchain.SkipBlockID, location *certLocation) (*InclusionProof, onet.ClientError) {
+	blocks, err := getProof(roster, id, location.BlockID)
+	if err != nil {
+		return nil, err
+	}
+	_, cb, merr := network.Unmarshal(blocks[len(blocks)-1].Data)
+	if merr != nil {
+		return nil, onet.NewClientError(merr)
+	}
+	certBlock := cb.(*CertBlock)
+	// The root of the certificate tree and the prevLeaf are the two leaves of the LatestMTR
+	_, proofs := crypto.ProofTree(sha256.New, certBlock.Certs)
+	proof := append(crypto.Proof{prevLeaf(certBlock.PrevMTR, certBlock.Timestamp)}, proofs[location.Position]...)
+	return &InclusionProof{blocks, location.Position, proof}, nil
 }
 
 // newService receives the context and a path where it can write its
@@ -118,15 +1109,57 @@ func (s *Service) propagateTxnMap(msg network.Message) {
 func newService(c *onet.Context) onet.Service {
 	//TODO: Register verification functions of skipchain
 	s := &Service{
-		ServiceProcessor: onet.NewServiceProcessor(c),
-		unspentTxnMap:    make(map[string]skipchain.SkipBlockID),
+		ServiceProcessor:  onet.NewServiceProcessor(c),
+		unspentTxnMap:     make(map[string]skipchain.SkipBlockID),
+		blockMap:          make(map[string]skipchain.SkipBlockID),
+		spentTxnMap:       make(map[string]*SignedMTR),
+		evidenceMap:       make(map[string][]*EquivocationEvidence),
+		latestMap:         make(map[string]*skipchain.SkipBlock),
+		certMap:           make(map[string][]*certLocation),
+		nameMap:           make(map[string]skipchain.SkipBlockID),
+		nameBindings:      make(map[string]*NameBinding),
+		nameReservations:  make(map[string]*nameReservation),
+		chainMap:          make(map[string][]*skipchain.SkipBlock),
+		newBlock:          make(chan struct{}),
+		timestampSkew:     defaultTimestampSkew,
+		stampRounds:       make(map[onet.RosterID]*stampRound),
+		heartbeatMap:      make(map[string]*Heartbeat),
+		heartbeatInterval: defaultHeartbeatInterval,
+	}
+	if env := os.Getenv("CERTCHAIN_TIMESTAMP_SKEW"); env != "" {
+		skew, err := time.ParseDuration(env)
+		log.ErrFatal(err, "Invalid CERTCHAIN_TIMESTAMP_SKEW")
+		s.timestampSkew = skew
+	}
+	if env := os.Getenv("CERTCHAIN_HEARTBEAT_INTERVAL"); env != "" {
+		interval, err := time.ParseDuration(env)
+		log.ErrFatal(err, "Invalid CERTCHAIN_HEARTBEAT_INTERVAL")
+		s.heartbeatInterval = interval
+	}
+	if env := os.Getenv("CERTCHAIN_DOMAIN_VALIDATION"); env != "" {
+		for _, name := range strings.Split(env, ",") {
+			if _, ok := domainValidators[name]; !ok {
+				log.Fatal("Unknown domain validator in CERTCHAIN_DOMAIN_VALIDATION:", name)
+			}
+			s.domainValidation = append(s.domainValidation, name)
+		}
 	}
-	if err := s.RegisterHandlers(s.CreateSkipchain, s.AddNewTxn); err != nil {
+	if err := s.RegisterHandlers(s.CreateSkipchain, s.AddNewTxn, s.ChangeRoster, s.GetLatest, s.GetBlockByMTR,
+		s.LookupCert, s.ResolveName, s.GetEvidence, s.Subscribe, s.GetSTH, s.RevocationStatus,
+		s.FirstSeen, s.Stamp, s.SignStamp, s.SignHeartbeat, s.GetHeartbeat, s.ReserveName); err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
 	var err error
 	s.propagate, err = messaging.NewPropagationFunc(c, "TxnMapPropagate", s.propagateTxnMap)
 	log.ErrFatal(err)
+	s.propagateEvidence, err = messaging.NewPropagationFunc(c, "EvidencePropagate", s.propagateEvidenceMap)
+	log.ErrFatal(err)
+	s.propagateName, err = messaging.NewPropagationFunc(c, "NamePropagate", s.propagateNameMap)
+	log.ErrFatal(err)
+	s.propagateChain, err = messaging.NewPropagationFunc(c, "ChainPropagate", s.propagateChainMap)
+	log.ErrFatal(err)
+	s.propagateHeartbeat, err = messaging.NewPropagationFunc(c, "HeartbeatPropagate", s.propagateHeartbeatMap)
+	log.ErrFatal(err)
 	log.ErrFatal(skipchain.RegisterVerification(c, VerifyTxn, s.VerifyTxn))
 	return s
 }
@@ -0,0 +1,184 @@
+package certchain
+
+/*
+The stamp.go is a proof-of-beforeness timestamping service. Anyone submits the
+hashes of documents to a node, which batches them for a round into a Merkle
+tree. Every member of the roster signs the root together with the time of the
+round, if that time is close to its own clock, and every submitter gets a
+receipt: the Merkle proof of its hash and the signed root. A receipt is
+verified offline with the public keys of the roster.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"gopkg.in/dedis/crypto.v0/sign"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// stampRound collects the hashes submitted to a node for a roster until the round is signed
+type stampRound struct {
+	roster *onet.Roster
+	hashes []crypto.HashID
+	once   sync.Once
+	// done is closed once the fields below are set
+	done       chan struct{}
+	root       crypto.HashID
+	proofs     []crypto.Proof
+	timestamp  int64
+	signatures [][]byte
+	err        onet.ClientError
+}
+
+// Stamp adds the hashes to the current round of the roster and returns their receipts once
+// the round is signed. A round is signed stampInterval after its first hash, or as soon as
+// it holds maxStampBatch hashes.
+func (s *Service) Stamp(req *StampRequest) (*StampResponse, onet.ClientError) {
+	if req.Roster == nil || len(req.Roster.List) == 0 || len(req.Hashes) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "roster and hashes are needed")
+	}
+	if i, _ := req.Roster.Search(s.ServerIdentity().ID); i < 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "node is not part of the roster")
+	}
+	if len(req.Hashes) > maxStampBatch {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "too many hashes")
+	}
+	for _, h := range req.Hashes {
+		if len(h) == 0 || len(h) > maxStampHash {
+			return nil, onet.NewClientErrorCode(ErrorParameter, "invalid hash length")
+		}
+	}
+	s.stampMutex.Lock()
+	round, exists := s.stampRounds[req.Roster.ID]
+	if exists && len(round.hashes)+len(req.Hashes) > maxStampBatch {
+		// The current round is full, it is signed right away and a new one is started
+		delete(s.stampRounds, req.Roster.ID)
+		go s.signRound(round)
+		exists = false
+	}
+	if !exists {
+		round = &stampRound{roster: req.Roster, done: make(chan struct{})}
+		s.stampRounds[req.Roster.ID] = round
+		time.AfterFunc(stampInterval, func() {
+			s.stampMutex.Lock()
+			if s.stampRounds[req.Roster.ID] == round {
+				delete(s.stampRounds, req.Roster.ID)
+			}
+			s.stampMutex.Unlock()
+			s.signRound(round)
+		})
+	}
+	first := len(round.hashes)
+	round.hashes = append(round.hashes, req.Hashes...)
+	s.stampMutex.Unlock()
+
+	<-round.done
+	if round.err != nil {
+		return nil, round.err
+	}
+	receipts := make([]*Receipt, len(req.Hashes))
+	for i, h := range req.Hashes {
+		receipts[i] = &Receipt{
+			Hash:       h,
+			Proof:      round.proofs[first+i],
+			Root:       round.root,
+			Timestamp:  round.timestamp,
+			Signatures: round.signatures,
+		}
+	}
+	return &StampResponse{receipts}, nil
+}
+
+// signRound builds the tree of a round and has the root signed by the members of its roster.
+// The round must not get new hashes anymore.
+func (s *Service) signRound(round *stampRound) {
+	round.once.Do(func() {
+		defer close(round.done)
+		round.root, round.proofs = crypto.ProofTree(sha256.New, round.hashes)
+		round.timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+		round.signatures = make([][]byte, len(round.roster.List))
+		client := onet.NewClient(Name)
+		for i, si := range round.roster.List {
+			reply := &SignStampResponse{}
+			if err := client.SendProtobuf(si, &SignStampRequest{round.root, round.timestamp}, reply); err != nil {
+				log.Lvl2(si, "doesn't sign the round:", err)
+				continue
+			}
+			round.signatures[i] = reply.Signature
+		}
+		if err := verifySignatures(round.roster, stampMessage(round.root, round.timestamp), round.signatures); err != nil {
+			log.Error("Couldn't sign the round:", err)
+			round.err = onet.NewClientErrorCode(ErrorTimeout, err.Error())
+			return
+		}
+		log.Lvl3(s.ServerIdentity(), "signed a round of", len(round.hashes), "hashes")
+	})
+}
+
+// SignStamp signs the root of a timestamping round if its time is close to the clock of the node
+func (s *Service) SignStamp(req *SignStampRequest) (*SignStampResponse, onet.ClientError) {
+	if len(req.Root) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParameter, "root is needed")
+	}
+	if d := time.Since(time.Unix(0, req.Timestamp*int64(time.Millisecond))); d > s.timestampSkew || d < -s.timestampSkew {
+		return nil, onet.NewClientErrorCode(ErrorTimestamp, "time is too far from the clock of the node")
+	}
+	sig, err := sign.Schnorr(suite, s.Private(), stampMessage(req.Root, req.Timestamp))
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return &SignStampResponse{sig}, nil
+}
+
+// stampMessage returns the message signed by the members of the roster for a round
+func stampMessage(root crypto.HashID, timestamp int64) []byte {
+	msg := append([]byte("certchain stamp"), root...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(timestamp))
+	return append(msg, ts[:]...)
+}
+
+// Time returns when the round of the receipt has been signed
+func (rc *Receipt) Time() time.Time {
+	return time.Unix(0, rc.Timestamp*int64(time.Millisecond))
+}
+
+// Verify checks that the hash is in the tree of the round and that the root and the time are
+// signed by enough members of the roster. It doesn't need to contact any node.
+func (rc *Receipt) Verify(r *onet.Roster) error {
+	if r == nil || len(r.List) == 0 {
+		return errors.New("empty roster")
+	}
+	if len(rc.Hash) == 0 || !rc.Proof.Check(sha256.New, rc.Root, rc.Hash) {
+		return errors.New("hash isn't part of the round")
+	}
+	return verifySignatures(r, stampMessage(rc.Root, rc.Timestamp), rc.Signatures)
+}
+
+// Stamp submits the hashes of documents to the roster and returns their receipts, each checked
+// to be signed by the roster. The call returns once the round holding the hashes is over.
+func (c *Client) Stamp(r *onet.Roster, hashes []crypto.HashID) ([]*Receipt, onet.ClientError) {
+	reply := &StampResponse{}
+	if err := c.send(r, &StampRequest{r, hashes}, reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Receipts) != len(hashes) {
+		return nil, onet.NewClientErrorCode(ErrorVerification, "wrong number of receipts")
+	}
+	for i, rc := range reply.Receipts {
+		if rc == nil || !bytes.Equal(rc.Hash, hashes[i]) {
+			return nil, onet.NewClientErrorCode(ErrorVerification, "receipt is about another hash")
+		}
+		if err := rc.Verify(r); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorVerification, err.Error())
+		}
+	}
+	return reply.Receipts, nil
+}
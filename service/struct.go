@@ -5,6 +5,9 @@ This holds the messages used to communicate with the service over the network.
 */
 
 import (
+	"time"
+
+	"github.com/TinfoilHat0/certchain/merkle_tree"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/satori/go.uuid"
 	"gopkg.in/dedis/crypto.v0/abstract"
@@ -20,7 +23,56 @@ func init() {
 		&AddNewTxnRequest{},
 		&AddNewTxnResponse{},
 		&PropagateTxnInfo{},
+		&ChangeRosterRequest{},
+		&ChangeRosterResponse{},
+		&GetLatestRequest{},
+		&GetLatestResponse{},
+		&GetBlockByMTRRequest{},
+		&GetBlockByMTRResponse{},
+		&LookupCertRequest{},
+		&LookupCertResponse{},
+		&ResolveNameRequest{},
+		&ResolveNameResponse{},
+		&PropagateName{},
+		&ReserveNameRequest{},
+		&ReserveNameResponse{},
+		&NameBinding{},
+		&PropagateChain{},
+		&GetEvidenceRequest{},
+		&GetEvidenceResponse{},
+		&SubscribeRequest{},
+		&SubscribeResponse{},
+		&GetSTHRequest{},
+		&GetSTHResponse{},
+		&SignedTreeHead{},
+		&RevocationStatusRequest{},
+		&RevocationStatusResponse{},
+		&RevocationStatus{},
+		&FirstSeenRequest{},
+		&FirstSeenResponse{},
+		&StampRequest{},
+		&StampResponse{},
+		&SignStampRequest{},
+		&SignStampResponse{},
+		&Receipt{},
+		&SignHeartbeatRequest{},
+		&SignHeartbeatResponse{},
+		&GetHeartbeatRequest{},
+		&GetHeartbeatResponse{},
+		&HeartbeatRound{},
+		&HeartbeatHead{},
+		&Heartbeat{},
 		&CertBlock{},
+		&Certificate{},
+		&CAAttestation{},
+		&Delegation{},
+		&Policy{},
+		&InclusionProof{},
+		&CertAbsence{},
+		&SignedMTR{},
+		&Bundle{},
+		&BundleProof{},
+		&EquivocationEvidence{},
 		&Service{},
 	} {
 		network.RegisterMessage(msg)
@@ -33,10 +85,79 @@ var VerifyTxn = skipchain.VerifierID(uuid.NewV5(uuid.NamespaceURL, "Certchain"))
 // How many msec to wait before a timeout is generated in the propagation.
 const propagateTimeout = 10000
 
+// How long a node holds a subscription request while no new block arrives. It is below the
+// default timeout of the Client.
+const subscribeWait = 10 * time.Second
+
+// How many blocks a node returns at most for a single subscription request
+const maxSubscribeBlocks = 100
+
+// How old a revocation status may be when the Client gets it
+const maxStatusAge = 5 * time.Minute
+
+// How far the timestamp of a CertBlock may be from the clock of a node, unless the
+// CERTCHAIN_TIMESTAMP_SKEW environment variable of the node gives another duration
+const defaultTimestampSkew = 5 * time.Minute
+
+// How often the leader of a roster has the heads of its CertChains signed, unless the
+// CERTCHAIN_HEARTBEAT_INTERVAL environment variable of the node gives another duration
+const defaultHeartbeatInterval = 30 * time.Second
+
+// How long a node collects hashes to timestamp before the round is signed
+const stampInterval = time.Second
+
+// How many hashes a round holds at most, and how long a hash may be
+const (
+	maxStampBatch = 4096
+	maxStampHash  = 64
+)
+
+// Error codes returned by the CertChain service
+const (
+	// ErrorParameter indicates a missing or malformed request parameter
+	ErrorParameter = iota + 4100
+	// ErrorUnknownMTR indicates that no block with the requested MTR is known
+	ErrorUnknownMTR
+	// ErrorVerification indicates that a reply from the cothority failed verification
+	ErrorVerification
+	// ErrorUnknownChain indicates that the node doesn't know the requested CertChain
+	ErrorUnknownChain
+	// ErrorNameTaken indicates that the name is already bound to another CertChain
+	ErrorNameTaken
+	// ErrorUnknownName indicates that the name is not bound to any CertChain
+	ErrorUnknownName
+	// ErrorSpent indicates that the PrevMTR of the CertBlock has already been spent
+	ErrorSpent
+	// ErrorSignature indicates that the CertBlock is not signed by the owner of the CertChain
+	ErrorSignature
+	// ErrorTimeout indicates that a node didn't answer in time
+	ErrorTimeout
+	// ErrorPolicy indicates that the CertBlock breaks the policy of the CertChain. The message
+	// is "rule: detail", see PolicyError.
+	ErrorPolicy
+	// ErrorTimestamp indicates that the timestamp of the CertBlock is too far from the clock of
+	// the node or older than the one of the previous block
+	ErrorTimestamp
+	// ErrorStale indicates that a heartbeat is missing, too old, or newer than the result it
+	// should vouch for
+	ErrorStale
+	// ErrorDomain indicates that the domain of a name bound to the CertChain doesn't publish
+	// the key of the owner
+	ErrorDomain
+	// ErrorDelegation indicates that the CertBlock is signed by a delegate but exceeds its
+	// delegation, or that the delegation is invalid
+	ErrorDelegation
+)
+
 // CreateSkipchainRequest is the structure for a new skipchain addition request
 type CreateSkipchainRequest struct {
 	Roster    *onet.Roster
 	CertBlock *CertBlock
+	// Name is the optional DNS name or wildcard zone the CertChain is bound to
+	Name string
+	// BaseHeight and MaximumHeight of the forward links, 1 is used if they are 0
+	BaseHeight    int
+	MaximumHeight int
 }
 
 // CreateSkipchainResponse is the structure for a skipchain addition response
@@ -44,7 +165,8 @@ type CreateSkipchainResponse struct {
 	SkipBlock *skipchain.SkipBlock
 }
 
-// AddNewTxnRequest is the structure for a txn addition request
+// AddNewTxnRequest is the structure for a txn addition request. Roster is optional and,
+// if given, has to be the roster of SkipBlock; use ChangeRosterRequest to change it.
 type AddNewTxnRequest struct {
 	Roster    *onet.Roster
 	SkipBlock *skipchain.SkipBlock
@@ -56,10 +178,258 @@ type AddNewTxnResponse struct {
 	SkipBlock *skipchain.SkipBlock
 }
 
-// PropagateTxnInfo is a wrapper to propagate a txn info across nodes
+// ChangeRosterRequest asks to move a CertChain to a new roster. The CertBlock has to be signed
+// by the owner and the new block is approved by the roster of SkipBlock, the latest block.
+type ChangeRosterRequest struct {
+	Roster    *onet.Roster
+	SkipBlock *skipchain.SkipBlock
+	CertBlock *CertBlock
+}
+
+// ChangeRosterResponse holds the first block with the new roster
+type ChangeRosterResponse struct {
+	SkipBlock *skipchain.SkipBlock
+}
+
+// GetLatestRequest asks for the latest block of the CertChain the trusted block belongs to
+type GetLatestRequest struct {
+	Roster    *onet.Roster
+	TrustedID skipchain.SkipBlockID
+}
+
+// GetLatestResponse holds the latest block and the forward-link proof from the trusted block to it
+type GetLatestResponse struct {
+	SkipBlock *skipchain.SkipBlock
+	Proof     []*skipchain.SkipBlock
+}
+
+// GetBlockByMTRRequest asks for the block holding the CertBlock with the given LatestMTR
+type GetBlockByMTRRequest struct {
+	Roster    *onet.Roster
+	TrustedID skipchain.SkipBlockID
+	MTR       []byte
+}
+
+// GetBlockByMTRResponse holds the requested block and the forward-link proof from the trusted block to it
+type GetBlockByMTRResponse struct {
+	SkipBlock *skipchain.SkipBlock
+	Proof     []*skipchain.SkipBlock
+}
+
+// LookupCertRequest asks whether a certificate is logged in a CertChain
+type LookupCertRequest struct {
+	Roster      *onet.Roster
+	SkipchainID skipchain.SkipBlockID
+	Cert        crypto.HashID
+}
+
+// LookupCertResponse holds either the inclusion proof of the certificate or a signed
+// statement that it is not logged
+type LookupCertResponse struct {
+	Inclusion *InclusionProof
+	Absence   *CertAbsence
+}
+
+// ResolveNameRequest asks for the CertChain bound to a name and its latest block
+type ResolveNameRequest struct {
+	Roster *onet.Roster
+	Name   string
+}
+
+// ResolveNameResponse holds the genesis ID of the CertChain bound to the name, its latest
+// block, the forward-link proof from the genesis block to it and the signed binding
+type ResolveNameResponse struct {
+	SkipchainID skipchain.SkipBlockID
+	SkipBlock   *skipchain.SkipBlock
+	Proof       []*skipchain.SkipBlock
+	Binding     *NameBinding
+}
+
+// GetEvidenceRequest asks a node for the equivocation evidence it holds for a CertChain
+type GetEvidenceRequest struct {
+	SkipchainID skipchain.SkipBlockID
+}
+
+// GetEvidenceResponse holds all the equivocation evidence known for a CertChain
+type GetEvidenceResponse struct {
+	Evidence []*EquivocationEvidence
+}
+
+// SubscribeRequest asks a node for the blocks of the CertChains starting at the given heights.
+// The node holds the request until at least one such block is known or subscribeWait is over.
+type SubscribeRequest struct {
+	Chains  []skipchain.SkipBlockID
+	Heights []int
+}
+
+// SubscribeResponse holds the new blocks of the subscribed CertChains, in order within each
+// CertChain. It is empty if no block arrived in time.
+type SubscribeResponse struct {
+	Blocks []*skipchain.SkipBlock
+}
+
+// BlockUpdate is a new block of a subscribed CertChain together with its CertBlock
+type BlockUpdate struct {
+	SkipBlock *skipchain.SkipBlock
+	CertBlock *CertBlock
+}
+
+// GetSTHRequest asks a node for the signed tree head of a CertChain
+type GetSTHRequest struct {
+	SkipchainID skipchain.SkipBlockID
+}
+
+// GetSTHResponse holds the signed tree head of a CertChain
+type GetSTHResponse struct {
+	STH *SignedTreeHead
+}
+
+// RevocationStatusRequest asks a node whether a certificate of a CertChain is revoked
+type RevocationStatusRequest struct {
+	SkipchainID skipchain.SkipBlockID
+	Cert        crypto.HashID
+}
+
+// RevocationStatusResponse holds the revocation status of a certificate
+type RevocationStatusResponse struct {
+	Status *RevocationStatus
+}
+
+// FirstSeenRequest asks a node for the earliest block of a CertChain logging a certificate
+type FirstSeenRequest struct {
+	Roster      *onet.Roster
+	SkipchainID skipchain.SkipBlockID
+	Cert        crypto.HashID
+}
+
+// FirstSeenResponse holds the inclusion proof of a certificate in the earliest block logging it
+type FirstSeenResponse struct {
+	Inclusion *InclusionProof
+}
+
+// StampRequest submits the hashes of documents to be timestamped by the roster
+type StampRequest struct {
+	Roster *onet.Roster
+	Hashes []crypto.HashID
+}
+
+// StampResponse holds the receipts of the hashes, in the order they were submitted
+type StampResponse struct {
+	Receipts []*Receipt
+}
+
+// Receipt proves that a hash existed before Timestamp: Proof is its Merkle proof in the tree of
+// a round with the given Root, and Signatures are the signatures of the roster members on the
+// root and the time, see stampMessage. They are in the order of the roster, nil for a member
+// that didn't sign.
+type Receipt struct {
+	Hash  crypto.HashID
+	Proof crypto.Proof
+	Root  crypto.HashID
+	// Timestamp is in milliseconds since the epoch
+	Timestamp  int64
+	Signatures [][]byte
+}
+
+// SignStampRequest asks a member of the roster to sign the root of a timestamping round
+type SignStampRequest struct {
+	Root crypto.HashID
+	// Timestamp is in milliseconds since the epoch
+	Timestamp int64
+}
+
+// SignStampResponse holds the signature of the member on the round, see stampMessage
+type SignStampResponse struct {
+	Signature []byte
+}
+
+// SignHeartbeatRequest asks a member of the roster to sign the heads of a heartbeat round
+type SignHeartbeatRequest struct {
+	Roster    *onet.Roster
+	Heads     []*HeartbeatHead
+	Timestamp int64
+}
+
+// SignHeartbeatResponse holds the signature of the member on the round, see heartbeatMessage
+type SignHeartbeatResponse struct {
+	Signature []byte
+}
+
+// GetHeartbeatRequest asks a node for the latest heartbeat of a CertChain
+type GetHeartbeatRequest struct {
+	SkipchainID skipchain.SkipBlockID
+}
+
+// GetHeartbeatResponse holds the latest heartbeat of a CertChain
+type GetHeartbeatResponse struct {
+	Heartbeat *Heartbeat
+}
+
+// HeartbeatHead is the latest block of a CertChain as stated by a heartbeat
+type HeartbeatHead struct {
+	SkipchainID skipchain.SkipBlockID
+	Index       int
+	BlockID     skipchain.SkipBlockID
+}
+
+// HeartbeatRound holds the heads of all the CertChains of a roster, sorted by ID, and the
+// signatures of the members on the root of their tree and the time. The signatures are in the
+// order of the roster, nil for a member that didn't sign.
+type HeartbeatRound struct {
+	Roster *onet.Roster
+	Heads  []*HeartbeatHead
+	// Timestamp is in milliseconds since the epoch
+	Timestamp  int64
+	Signatures [][]byte
+}
+
+// Heartbeat states that Head was the latest block of its CertChain at Timestamp. Proof is the
+// Merkle proof of the head in the tree of its round, whose Root is signed by the roster.
+type Heartbeat struct {
+	Head *HeartbeatHead
+	// Timestamp is in milliseconds since the epoch
+	Timestamp  int64
+	Root       crypto.HashID
+	Proof      crypto.Proof
+	Signatures [][]byte
+}
+
+// PropagateTxnInfo is a wrapper to propagate a new block of a CertChain across nodes
 type PropagateTxnInfo struct {
-	BlockMTR  []byte
-	BlockHash skipchain.SkipBlockID
+	SkipBlock *skipchain.SkipBlock
+}
+
+// PropagateChain is a wrapper to propagate all the blocks of a CertChain to nodes joining its roster
+type PropagateChain struct {
+	Blocks []*skipchain.SkipBlock
+}
+
+// PropagateName is a wrapper to propagate the binding of a name to a CertChain across nodes
+type PropagateName struct {
+	Name        string
+	SkipchainID skipchain.SkipBlockID
+	Binding     *NameBinding
+}
+
+// ReserveNameRequest asks a member of the roster to reserve a name for the genesis CertBlock of
+// a new CertChain
+type ReserveNameRequest struct {
+	Name      string
+	CertBlock *CertBlock
+}
+
+// ReserveNameResponse holds the signature of the member on the binding, see nameMessage
+type ReserveNameResponse struct {
+	Signature []byte
+}
+
+// NameBinding binds a name to the CertChain whose genesis CertBlock has the MTR. The signatures
+// are those of the members of Roster, in its order, nil for a member that didn't sign.
+type NameBinding struct {
+	Name       string
+	MTR        []byte
+	Roster     *onet.Roster
+	Signatures [][]byte
 }
 
 // CertBlock stores a transaction of the Certchain (this is stored in data field of a Skipblock)
@@ -68,4 +438,183 @@ type CertBlock struct {
 	LatestMTR       []byte
 	PrevMTR         []byte
 	PublicKey       abstract.Point
+	// Certs are the leaves of the certificate tree, LatestMTR is computed from PrevMTR and their root
+	Certs []crypto.HashID
+	// Type is the type of the records under the leaves, see RecordLeafHash
+	Type RecordType
+	// Timestamp is when the owner created the block, in milliseconds since the epoch. The
+	// LatestMTR is computed from it as well, see prevLeaf. It is 0 in older CertBlocks.
+	Timestamp int64
+	// Certificates are the bodies of the records, in the order of Certs. They are needed
+	// when the policy of the CertChain checks the records themselves.
+	Certificates []*Certificate
+	// Policy is enforced on every block of the CertChain. Only the genesis block may set it.
+	Policy *Policy
+	// Revoked are the leaves of the certificates revoked by the block. A block revoking
+	// certificates logs none.
+	Revoked []crypto.HashID
+	// RevocationRoot is the root of the sorted set of all the certificates revoked in the
+	// CertChain up to this block. Only blocks revoking certificates set it, LatestMTR is then
+	// computed from it as well.
+	RevocationRoot crypto.HashID
+	// Attestations are the signatures of the CAs that issued the certificates of the block.
+	// They aren't signed by the owner and the LatestMTR isn't computed from them.
+	Attestations []*CAAttestation
+	// Delegations are published by the owner to authorize sub-keys to append blocks. Each of
+	// them is signed by the owner.
+	Delegations []*Delegation
+	// Delegation authorizes the key the block is signed with, if it isn't signed by the owner
+	Delegation *Delegation
+}
+
+// Delegation authorizes a sub-key to append blocks to a CertChain under constraints. Zero
+// values disable a constraint.
+type Delegation struct {
+	// Key signs the blocks appended under the delegation
+	Key abstract.Point
+	// Suffixes are the domains under which the names of the records have to be
+	Suffixes []string
+	// Expiry is the latest timestamp of a block appended under the delegation, in
+	// milliseconds since the epoch
+	Expiry int64
+	// MaxCerts is the largest number of certificates logged under the delegation
+	MaxCerts int
+	// Signature is made with the key of the owner over Hash
+	Signature []byte
+}
+
+// CAAttestation is the signature by an issuing CA of the certificates of a CertBlock it issued,
+// see AttestationMessage
+type CAAttestation struct {
+	// Issuer is the DER encoding of the issuing certificate, the first of the chain of the
+	// attested certificates
+	Issuer []byte
+	// Signature is made with the key of Issuer
+	Signature []byte
+}
+
+// Certificate is the body of a logged certificate, or of another record
+type Certificate struct {
+	// Raw is the canonical encoding of the record, the DER encoding for a certificate. Its leaf
+	// is RecordLeafHash(Type, Raw), with the Type of the CertBlock.
+	Raw []byte
+	// Chain holds the DER encodings of the issuing certificates, starting with the issuer
+	Chain [][]byte
+}
+
+// Policy restricts what can be logged in a CertChain. Zero values disable a rule.
+type Policy struct {
+	// IssuerPins are the SHA-256 hashes of the SubjectPublicKeyInfo of the allowed issuers.
+	// Every certificate has to chain up to one of them.
+	IssuerPins [][]byte
+	// MaxValidity is the longest validity period of a certificate, in seconds
+	MaxValidity int64
+	// SANPatterns are the patterns of the allowed DNS names, where "*" stands for one label.
+	// Every DNS name of a certificate has to match one of them.
+	SANPatterns []string
+	// MaxBatch is the largest number of certificates in a block
+	MaxBatch int
+	// MinInterval is the shortest time between the timestamps of two blocks, in seconds
+	MinInterval int64
+	// RequireCAAttestation requires every certificate to be attested by the CA that issued it.
+	// It needs IssuerPins.
+	RequireCAAttestation bool
+}
+
+// SignedMTR is the signed part of a CertBlock together with the key it has been verified with.
+// Timestamp, CertRoot and RevocationRoot let the LatestMTR be recomputed from the PrevMTR.
+type SignedMTR struct {
+	LatestSignedMTR []byte
+	LatestMTR       []byte
+	PrevMTR         []byte
+	PublicKey       abstract.Point
+	Timestamp       int64
+	CertRoot        crypto.HashID
+	RevocationRoot  crypto.HashID
+}
+
+// EquivocationEvidence proves that the owner of a CertChain signed two different
+// MTRs on top of the same PrevMTR. It is signed by the node that detected it.
+type EquivocationEvidence struct {
+	SkipchainID skipchain.SkipBlockID
+	First       *SignedMTR
+	Second      *SignedMTR
+	Reporter    *network.ServerIdentity
+	Signature   []byte
+}
+
+// InclusionProof proves that a certificate is committed in the CertBlock of the last block
+// of Blocks. Blocks is a forward-link proof starting at the genesis block of the CertChain.
+type InclusionProof struct {
+	Blocks   []*skipchain.SkipBlock
+	Position int
+	Proof    crypto.Proof
+}
+
+// CertAbsence is a statement signed by a node that a certificate is not logged in a
+// CertChain up to the block at the given height
+type CertAbsence struct {
+	SkipchainID skipchain.SkipBlockID
+	Cert        crypto.HashID
+	Height      int
+	BlockID     skipchain.SkipBlockID
+	Signer      *network.ServerIdentity
+	Signature   []byte
+}
+
+// SignedTreeHead is the RFC 6962 tree head of a CertChain, signed by a node. The tree has one
+// leaf per logged certificate, in the order they are logged, up to the block at Index.
+type SignedTreeHead struct {
+	SkipchainID skipchain.SkipBlockID
+	Index       int
+	TreeSize    int
+	// Timestamp is in milliseconds since the epoch, like in RFC 6962
+	Timestamp int64
+	RootHash  crypto.HashID
+	Signer    *network.ServerIdentity
+	Signature []byte
+}
+
+// RevocationStatus tells whether a certificate is revoked as of the block at Index, signed by a
+// node. Block is the latest block revoking certificates up to Index, nil if there is none. If
+// the certificate is revoked, Proof is its Merkle proof in the revocation set of Block,
+// otherwise Set is the whole revocation set.
+type RevocationStatus struct {
+	SkipchainID skipchain.SkipBlockID
+	Cert        crypto.HashID
+	Index       int
+	// Timestamp is in milliseconds since the epoch
+	Timestamp int64
+	Revoked   bool
+	Block     *skipchain.SkipBlock
+	Proof     crypto.Proof
+	Set       []crypto.HashID
+	Signer    *network.ServerIdentity
+	Signature []byte
+}
+
+// Bundle holds everything needed to verify a CertChain offline
+type Bundle struct {
+	Roster *onet.Roster
+	// Blocks are all the blocks of the CertChain, starting with the genesis block
+	Blocks []*skipchain.SkipBlock
+	// Certificates are the optional DER encodings of the logged certificates
+	Certificates [][]byte
+	Proofs       []*BundleProof
+}
+
+// BundleProof is the Merkle proof of the certificate at Position in the block at Index
+type BundleProof struct {
+	Index    int
+	Position int
+	Proof    crypto.Proof
+}
+
+// BundleReport is the result of the offline verification of a Bundle
+type BundleReport struct {
+	Blocks       int
+	Certificates int
+	Bodies       int
+	Proofs       int
+	Errors       []string
 }
@@ -0,0 +1,248 @@
+/*
+Package staple defines the CertChain proof a TLS server presents along with its
+certificate, so that a client checks that the certificate is logged before it
+trusts it, without contacting the cothority.
+
+A Proof holds the inclusion proof of the leaf of the certificate: the
+forward-link proof from the genesis block of the CertChain, whose links are
+collectively signed by the roster, to the block holding the CertBlock, and the
+Merkle proof of the leaf under its LatestMTR. A heartbeat signed by the roster
+tells that the proof is fresh, and a revocation status at least as recent as
+the heartbeat that the certificate isn't revoked.
+
+The encoding starts with the Magic byte and the Version, followed by the
+proof marshalled by the network package. As the first byte is never the
+version of an RFC 6962 SCT, the encoding can be served in the SCT list of a
+TLS handshake, where CT clients ignore it, or as the OCSP staple.
+*/
+package staple
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Magic is the first byte of an encoded proof
+const Magic = 0xcc
+
+// Version of the encoding produced by Encode
+const Version = 1
+
+// MaxExtensionSize is the largest encoding that fits in a TLS extension or an SCT
+const MaxExtensionSize = 1<<16 - 1
+
+// DefaultMaxAge is how old the heartbeat of a proof may be if the Config doesn't say
+const DefaultMaxAge = 10 * time.Minute
+
+// ErrRevoked is returned for a proof whose revocation status tells the certificate is revoked
+var ErrRevoked = errors.New("certchain: certificate is revoked")
+
+func init() {
+	network.RegisterMessage(&Proof{})
+}
+
+// Proof is the CertChain proof of a certificate
+type Proof struct {
+	// Inclusion is the forward-link proof from the genesis block to the block holding the
+	// CertBlock, and the Merkle proof of the leaf of the certificate
+	Inclusion *certchain.InclusionProof
+	// Heartbeat states the head of the CertChain, at least as recent as the block holding the
+	// certificate
+	Heartbeat *certchain.Heartbeat
+	// Revocation is the revocation status of the certificate, at least as recent as the head
+	// stated by the heartbeat
+	Revocation *certchain.RevocationStatus
+}
+
+// New fetches the proof of a certificate from the roster, given its DER encoding
+func New(client *certchain.Client, r *onet.Roster, id skipchain.SkipBlockID, cert []byte) (*Proof, error) {
+	leaf := certchain.LeafHash(cert)
+	inclusion, _, err := client.LookupCert(r, id, leaf)
+	if err != nil {
+		return nil, err
+	}
+	if inclusion == nil {
+		return nil, errors.New("certificate is not logged")
+	}
+	hb, err := client.GetHeartbeat(r, id)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := client.RevocationStatus(r, id, leaf)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{inclusion, hb, rs}, nil
+}
+
+// Encode returns the versioned encoding of the proof
+func Encode(p *Proof) ([]byte, error) {
+	buf, err := network.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{Magic, Version}, buf...), nil
+}
+
+// Decode returns the proof of a versioned encoding
+func Decode(buf []byte) (*Proof, error) {
+	if len(buf) < 2 || buf[0] != Magic {
+		return nil, errors.New("not a CertChain proof")
+	}
+	if buf[1] != Version {
+		return nil, errors.New("unsupported version " + strconv.Itoa(int(buf[1])))
+	}
+	_, msg, err := network.Unmarshal(buf[2:])
+	if err != nil {
+		return nil, err
+	}
+	p, ok := msg.(*Proof)
+	if !ok {
+		return nil, errors.New("not a CertChain proof")
+	}
+	return p, nil
+}
+
+// Attach encodes the proof into the SCT list of the certificate of a TLS server, replacing the
+// proof attached before if any
+func Attach(cert *tls.Certificate, p *Proof) error {
+	buf, err := Encode(p)
+	if err != nil {
+		return err
+	}
+	if len(buf) > MaxExtensionSize {
+		return errors.New("proof doesn't fit in an SCT")
+	}
+	var scts [][]byte
+	for _, sct := range cert.SignedCertificateTimestamps {
+		if len(sct) == 0 || sct[0] != Magic {
+			scts = append(scts, sct)
+		}
+	}
+	cert.SignedCertificateTimestamps = append(scts, buf)
+	return nil
+}
+
+// Find returns the encoded proof stapled in a TLS handshake, either in the SCT list or as the
+// OCSP staple, or nil if there is none
+func Find(cs tls.ConnectionState) []byte {
+	for _, sct := range cs.SignedCertificateTimestamps {
+		if len(sct) > 0 && sct[0] == Magic {
+			return sct
+		}
+	}
+	if len(cs.OCSPResponse) > 0 && cs.OCSPResponse[0] == Magic {
+		return cs.OCSPResponse
+	}
+	return nil
+}
+
+// Verify checks the proof of a certificate, given its DER encoding, against the CertChain with
+// the given genesis block and its roster. The heartbeat and the revocation status have to be
+// younger than maxAge at now.
+func (p *Proof) Verify(cert []byte, r *onet.Roster, id skipchain.SkipBlockID, maxAge time.Duration, now time.Time) error {
+	if p.Inclusion == nil || p.Heartbeat == nil {
+		return errors.New("inclusion proof and heartbeat are needed")
+	}
+	leaf := certchain.LeafHash(cert)
+	cb, err := p.Inclusion.Verify(id, leaf)
+	if err != nil {
+		return err
+	}
+	if cb.Type != certchain.RecordX509 {
+		return errors.New("block doesn't log certificates")
+	}
+	hb := p.Heartbeat
+	if hb.Head == nil || !bytes.Equal(hb.Head.SkipchainID, id) {
+		return errors.New("heartbeat is about another CertChain")
+	}
+	if err := hb.Verify(r); err != nil {
+		return err
+	}
+	if now.Sub(hb.Time()) > maxAge {
+		return errors.New("heartbeat is older than " + maxAge.String())
+	}
+	if hb.Head.Index < p.Inclusion.Block().Index {
+		return errors.New("heartbeat is older than the block holding the certificate")
+	}
+	rs := p.Revocation
+	if rs == nil {
+		return errors.New("revocation status is needed")
+	}
+	if !bytes.Equal(rs.SkipchainID, id) || !bytes.Equal(rs.Cert, leaf) {
+		return errors.New("revocation status is about another certificate")
+	}
+	if err := rs.Verify(r); err != nil {
+		return err
+	}
+	if now.Sub(time.Unix(0, rs.Timestamp*int64(time.Millisecond))) > maxAge {
+		return errors.New("revocation status is older than " + maxAge.String())
+	}
+	if rs.Index < hb.Head.Index {
+		return errors.New("revocation status is older than the head stated by the heartbeat")
+	}
+	if rs.Revoked {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// Config tells how a TLS client checks the proofs stapled by servers
+type Config struct {
+	// Roster is the trusted roster running the CertChains
+	Roster *onet.Roster
+	// Chains maps a server name, or a wildcard zone like *.example.com, to the genesis block
+	// of its CertChain. Servers with no CertChain are accepted without proof.
+	Chains map[string]skipchain.SkipBlockID
+	// MaxAge is how old a heartbeat may be, DefaultMaxAge if it is 0
+	MaxAge time.Duration
+}
+
+// Chain returns the genesis block of the CertChain of a server name, or nil if it has none
+func (c *Config) Chain(name string) skipchain.SkipBlockID {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if id, exists := c.Chains[name]; exists {
+		return id
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		return c.Chains["*"+name[i:]]
+	}
+	return nil
+}
+
+// VerifyConnection checks the proof stapled for the certificate of the server. It is meant
+// for tls.Config.VerifyConnection, after the usual verification of the certificate.
+func (c *Config) VerifyConnection(cs tls.ConnectionState) error {
+	id := c.Chain(cs.ServerName)
+	if id == nil {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("certchain: no certificate")
+	}
+	buf := Find(cs)
+	if buf == nil {
+		return errors.New("certchain: no proof stapled for " + cs.ServerName)
+	}
+	p, err := Decode(buf)
+	if err != nil {
+		return errors.New("certchain: " + err.Error())
+	}
+	maxAge := c.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	if err := p.Verify(cs.PeerCertificates[0].Raw, c.Roster, id, maxAge, time.Now()); err != nil {
+		return errors.New("certchain: " + err.Error())
+	}
+	return nil
+}
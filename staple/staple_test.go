@@ -0,0 +1,79 @@
+package staple
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/internal/testutil"
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	testutil.MainTest(m)
+}
+
+func TestStaple(t *testing.T) {
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+
+	client := certchain.NewClient()
+	kp := config.NewKeyPair(network.Suite)
+	der := testutil.NewCertificate(t, nil, nil, time.Hour, "www.example.com")
+	cb := client.CreateCertBlock([]crypto.HashID{certchain.LeafHash(der)}, make([]byte, 32), kp)
+	sb, err := client.CreateSkipchain(roster, cb)
+	log.ErrFatal(err)
+	id := sb.Hash
+	testutil.WaitHeartbeat(t, func() error {
+		_, err := client.GetHeartbeat(roster, id)
+		return err
+	})
+
+	p, perr := New(client, roster, id, der)
+	log.ErrFatal(perr)
+	buf, perr := Encode(p)
+	log.ErrFatal(perr)
+	assert.True(t, len(buf) <= MaxExtensionSize)
+	decoded, perr := Decode(buf)
+	log.ErrFatal(perr)
+	assert.Nil(t, decoded.Verify(der, roster, id, time.Minute, time.Now()))
+	assert.NotNil(t, decoded.Verify(testutil.NewCertificate(t, nil, nil, time.Hour, "www.example.com"), roster, id, time.Minute, time.Now()))
+	assert.NotNil(t, decoded.Verify(der, roster, id, time.Minute, time.Now().Add(time.Hour)))
+	unrevoked := *decoded
+	unrevoked.Revocation = nil
+	assert.NotNil(t, unrevoked.Verify(der, roster, id, time.Minute, time.Now()))
+	buf[1] = Version + 1
+	_, perr = Decode(buf)
+	assert.NotNil(t, perr)
+
+	cert := &tls.Certificate{Certificate: [][]byte{der}, SignedCertificateTimestamps: [][]byte{{0, 1, 2}}}
+	log.ErrFatal(Attach(cert, p))
+	log.ErrFatal(Attach(cert, p))
+	assert.Equal(t, 2, len(cert.SignedCertificateTimestamps))
+	parsed, perr := x509.ParseCertificate(der)
+	log.ErrFatal(perr)
+	cs := tls.ConnectionState{
+		ServerName:                  "www.example.com",
+		PeerCertificates:            []*x509.Certificate{parsed},
+		SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+	}
+	verifier := &Config{Roster: roster, Chains: map[string]skipchain.SkipBlockID{"*.example.com": id}}
+	assert.Nil(t, verifier.VerifyConnection(cs))
+
+	// The proof may be the OCSP staple as well
+	cs.OCSPResponse, cs.SignedCertificateTimestamps = cert.SignedCertificateTimestamps[1], nil
+	assert.Nil(t, verifier.VerifyConnection(cs))
+	cs.OCSPResponse = nil
+	assert.NotNil(t, verifier.VerifyConnection(cs))
+	cs.ServerName = "www.example.org"
+	assert.Nil(t, verifier.VerifyConnection(cs))
+}
@@ -0,0 +1,208 @@
+package main
+
+/*
+The state.go keeps the local state of the app: the key of the CertChain owner
+and, for every CertChain, the latest block that has been seen.
+*/
+
+import (
+	gocrypto "crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// keyStore is the TOML representation of the key of the CertChain owner
+type keyStore struct {
+	Public  string
+	Private string
+}
+
+// policyFile is the TOML representation of the policy of a CertChain. The issuer pins are the
+// hex SHA-256 hashes of the SubjectPublicKeyInfo of the issuers and the durations are given
+// like "2160h".
+type policyFile struct {
+	IssuerPins           []string
+	MaxValidity          string
+	SANPatterns          []string
+	MaxBatch             int
+	MinInterval          string
+	RequireCAAttestation bool
+}
+
+// loadKeyPair reads the key pair from the keystore
+func loadKeyPair(file string) (*config.KeyPair, error) {
+	ks := &keyStore{}
+	if _, err := toml.DecodeFile(file, ks); err != nil {
+		return nil, err
+	}
+	buf, err := hex.DecodeString(ks.Private)
+	if err != nil {
+		return nil, err
+	}
+	kp := &config.KeyPair{Suite: network.Suite, Secret: network.Suite.Scalar()}
+	if err := kp.Secret.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	kp.Public = network.Suite.Point().Mul(nil, kp.Secret)
+	return kp, nil
+}
+
+// loadOrCreateKeyPair reads the key pair from the keystore and creates the
+// keystore with a new key pair if it doesn't exist
+func loadOrCreateKeyPair(file string) (*config.KeyPair, error) {
+	if _, err := os.Stat(file); err == nil {
+		return loadKeyPair(file)
+	}
+	kp := config.NewKeyPair(network.Suite)
+	pub, err := kp.Public.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	priv, err := kp.Secret.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return kp, toml.NewEncoder(f).Encode(&keyStore{hex.EncodeToString(pub), hex.EncodeToString(priv)})
+}
+
+// saveHead stores the latest known block of the CertChain with the given genesis ID
+func saveHead(dir string, id skipchain.SkipBlockID, sb *skipchain.SkipBlock) error {
+	buf, err := network.Marshal(sb)
+	if err != nil {
+		return err
+	}
+	return writeFile(path.Join(dir, hex.EncodeToString(id)), buf)
+}
+
+// loadHead returns the latest known block of the CertChain with the given genesis ID
+func loadHead(dir string, id skipchain.SkipBlockID) (*skipchain.SkipBlock, error) {
+	buf, err := ioutil.ReadFile(path.Join(dir, hex.EncodeToString(id)))
+	if err != nil {
+		return nil, err
+	}
+	_, msg, err := network.Unmarshal(buf)
+	if err != nil {
+		return nil, err
+	}
+	sb, ok := msg.(*skipchain.SkipBlock)
+	if !ok {
+		return nil, errors.New("file doesn't hold a skipblock")
+	}
+	return sb, nil
+}
+
+// writeFile writes buf to file, creating the directories if needed
+func writeFile(file string, buf []byte) error {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buf, 0600)
+}
+
+// readCertFile returns the DER encoding of the certificates in a PEM file,
+// or the content of the file if it isn't PEM encoded
+func readCertFile(file string) ([][]byte, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ders [][]byte
+	for rest := buf; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, buf)
+	}
+	return ders, nil
+}
+
+// readSigningKey reads the PEM private key of a CA, in PKCS#8, SEC 1 or PKCS#1
+func readSigningKey(file string) (gocrypto.Signer, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no PEM key in " + file)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(gocrypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key in " + file)
+}
+
+// readPolicy reads the policy of a CertChain from a TOML file
+func readPolicy(file string) (*certchain.Policy, error) {
+	pf := &policyFile{}
+	if _, err := toml.DecodeFile(file, pf); err != nil {
+		return nil, err
+	}
+	policy := &certchain.Policy{
+		SANPatterns:          pf.SANPatterns,
+		MaxBatch:             pf.MaxBatch,
+		RequireCAAttestation: pf.RequireCAAttestation,
+	}
+	for _, pin := range pf.IssuerPins {
+		buf, err := hex.DecodeString(pin)
+		if err != nil {
+			return nil, errors.New("invalid issuer pin " + pin)
+		}
+		policy.IssuerPins = append(policy.IssuerPins, buf)
+	}
+	var err error
+	if policy.MaxValidity, err = seconds(pf.MaxValidity); err != nil {
+		return nil, err
+	}
+	if policy.MinInterval, err = seconds(pf.MinInterval); err != nil {
+		return nil, err
+	}
+	return policy, policy.Validate()
+}
+
+// seconds returns the number of seconds of a duration like "2160h", or 0 for an empty string
+func seconds(duration string) (int64, error) {
+	if duration == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+	return int64(d / time.Second), nil
+}
@@ -9,33 +9,91 @@ DBG_APP=2
 main(){
     startTest
     buildConode
-	test Count
-	test Time
+	test Build
+	test ChainCreate
+	test ChainAdd
+	test CertVerify
+	test CertFresh
+	test Bundle
+	test Monitor
     stopTest
 }
 
-testCount(){
+testBuild(){
+    testOK dbgRun runCc --help
+}
+
+testChainCreate(){
        runCoBG 1 2
-       testFail runTmpl counter
-       testOK runTmpl counter public.toml
-       testGrep ": 0" runTmpl counter public.toml
-       runTmpl time public.toml
-       testGrep ": 1" runTmpl counter public.toml
+       testFail runCc -g none.toml chain create
+       testOK runCc chain create
+       testGrep "Created CertChain" runCc chain create
+       testOK runCc chain create --name www.example.com
+       testFail runCc chain create --name www.example.com
+       testGrep "Head of" runCc chain head www.example.com
+       genCert cert1.pem
+       testFail runCc chain create --issuer cert1.pem cert1.pem
 }
 
-testTime(){
+testChainAdd(){
        runCoBG 1 2
-       testFail runTmpl time
-       testOK runTmpl time public.toml
-       testGrep Time runTmpl time public.toml
+       genCert cert1.pem
+       ID=$( runCc chain create | grep "Created CertChain" | sed -e "s/.* CertChain \([0-9a-f]*\) .*/\1/" )
+       testFail runCc chain add $ID
+       testGrep "in block 1" runCc chain add $ID cert1.pem
+       testGrep "Block 1" runCc chain show $ID
+       testGrep "block 1" runCc chain head $ID
 }
 
-testBuild(){
-    testOK dbgRun runTmpl --help
+testCertVerify(){
+       runCoBG 1 2
+       genCert cert1.pem
+       genCert cert2.pem
+       ID=$( runCc chain create cert1.pem | grep "Created CertChain" | sed -e "s/.* CertChain \([0-9a-f]*\) .*/\1/" )
+       testGrep "is logged in block 0" runCc cert verify $ID cert1.pem
+       testGrep "is not logged" runCc cert verify $ID cert2.pem
+       testOK runCc cert prove --out proof.bin $ID cert1.pem
+       testFail runCc cert prove $ID cert2.pem
+}
+
+testCertFresh(){
+       CERTCHAIN_HEARTBEAT_INTERVAL=1s runCoBG 1 2
+       genCert cert1.pem
+       ID=$( runCc chain create cert1.pem | grep "Created CertChain" | sed -e "s/.* CertChain \([0-9a-f]*\) .*/\1/" )
+       sleep 3
+       testGrep "is logged in block 0" runCc cert verify --fresh 1m $ID cert1.pem
+       testFail runCc cert verify --fresh 1ms $ID cert1.pem
+}
+
+testBundle(){
+       runCoBG 1 2
+       genCert cert1.pem
+       genCert cert2.pem
+       ID=$( runCc chain create cert1.pem | grep "Created CertChain" | sed -e "s/.* CertChain \([0-9a-f]*\) .*/\1/" )
+       testOK runCc export --out bundle.bin --cert cert1.pem $ID
+       testGrep "Bundle is valid" runCc verify-bundle bundle.bin
+       testOK runCc export --out bad.bin --cert cert2.pem $ID
+       testFail runCc verify-bundle bad.bin
+}
+
+testMonitor(){
+       runCoBG 1 2
+       genCert cert1.pem
+       ID=$( runCc chain create --name www.example.com | grep "Created CertChain" | sed -e "s/.* CertChain \([0-9a-f]*\) .*/\1/" )
+       testFail runCc monitor --once
+       testOK runCc monitor --once --chain $ID
+       runCc chain add $ID cert1.pem
+       testGrep "certificate" runCc monitor --once --domain www.example.com
+       testNGrep "critical" runCc monitor --once --chain $ID
+}
+
+genCert(){
+    openssl req -x509 -newkey rsa:2048 -nodes -days 1 -subj /CN=www.example.com \
+        -keyout /dev/null -out $1 2> /dev/null
 }
 
-runTmpl(){
-    dbgRun ./$APP -d $DBG_APP $@
+runCc(){
+    dbgRun ./$APP -d $DBG_APP -k key.toml -s state $@
 }
 
 main
@@ -0,0 +1,184 @@
+/*
+Package verifier enforces CertChain in the handshakes of TLS clients. The
+certificate of a server whose name is mapped to a CertChain is only accepted if
+it is logged in that CertChain and not revoked.
+
+The proof stapled by the server, see the staple package, is checked first. If
+there is none or it doesn't verify, a proof is fetched from the roster. A
+certificate proven not to be logged, or to be revoked, is always rejected. When
+no proof can be had at all, e.g. because the roster can't be reached, the Mode
+decides: FailClosed rejects the certificate and FailOpen accepts it.
+
+	v, err := verifier.FromGroup("public.toml")
+	v.Chains["www.example.com"] = id
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: v.TLSConfig(nil)}}
+*/
+package verifier
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/TinfoilHat0/certchain/staple"
+	"github.com/dedis/cothority/skipchain"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/app"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// Mode tells what to do with a certificate when no proof can be had
+type Mode int
+
+// Modes of a Verifier
+const (
+	// FailClosed rejects the certificate
+	FailClosed Mode = iota
+	// FailOpen accepts the certificate
+	FailOpen
+)
+
+// Errors returned for certificates that are proven to be invalid, whatever the Mode
+var (
+	ErrNotLogged = errors.New("certchain: certificate is not logged in the CertChain of the server")
+	ErrRevoked   = staple.ErrRevoked
+)
+
+// Verifier checks the certificates of TLS servers against their CertChains
+type Verifier struct {
+	// Config holds the trusted roster, the CertChains of the server names and how old a
+	// proof may be
+	staple.Config
+	// Mode tells what to do when no proof can be had
+	Mode Mode
+	// ResolveNames looks up the CertChain bound to a name through the roster if the name
+	// isn't in Chains
+	ResolveNames bool
+	// Client fetches the proofs
+	Client *certchain.Client
+}
+
+// New returns a fail-closed Verifier trusting the roster, with no CertChain mapped yet
+func New(r *onet.Roster) *Verifier {
+	return &Verifier{
+		Config: staple.Config{Roster: r, Chains: make(map[string]skipchain.SkipBlockID)},
+		Client: certchain.NewClient(),
+	}
+}
+
+// FromGroup returns a fail-closed Verifier trusting the roster of a group TOML file
+func FromGroup(file string) (*Verifier, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	group, err := app.ReadGroupDescToml(f)
+	if err != nil {
+		return nil, err
+	}
+	if group.Roster == nil || len(group.Roster.List) == 0 {
+		return nil, errors.New("empty roster in " + file)
+	}
+	return New(group.Roster), nil
+}
+
+// TLSConfig returns a copy of base, or of an empty configuration if it is nil, that checks the
+// certificates of the servers with the Verifier once they are verified as usual
+func (v *Verifier) TLSConfig(base *tls.Config) *tls.Config {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	config.VerifyConnection = v.VerifyConnection
+	return config
+}
+
+// VerifyConnection checks the certificate of the server with the proof it stapled, if any. It
+// is meant for tls.Config.VerifyConnection.
+func (v *Verifier) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("certchain: no certificate")
+	}
+	return v.Verify(cs.ServerName, cs.PeerCertificates[0].Raw, staple.Find(cs))
+}
+
+// Verify checks the certificate of a server, given its DER encoding, and the encoded proof it
+// stapled, which may be nil. A stapled proof is only accepted with a revocation status, else the
+// proof is fetched.
+func (v *Verifier) Verify(name string, cert []byte, stapled []byte) error {
+	id, err := v.chain(name)
+	if err != nil {
+		return v.unavailable(name, err)
+	}
+	if id == nil {
+		return nil
+	}
+	maxAge := v.MaxAge
+	if maxAge == 0 {
+		maxAge = staple.DefaultMaxAge
+	}
+	if stapled != nil {
+		p, err := staple.Decode(stapled)
+		if err == nil {
+			err = p.Verify(cert, v.Roster, id, maxAge, time.Now())
+		}
+		switch err {
+		case nil:
+			return nil
+		case staple.ErrRevoked:
+			return ErrRevoked
+		}
+		log.Lvl2("Stapled proof of", name, "is invalid:", err)
+	}
+	return v.fetch(name, id, cert, maxAge)
+}
+
+// fetch checks the certificate with a proof fetched from the roster
+func (v *Verifier) fetch(name string, id skipchain.SkipBlockID, cert []byte, maxAge time.Duration) error {
+	client := *v.Client
+	client.MaxHeartbeatAge = maxAge
+	leaf := certchain.LeafHash(cert)
+	inclusion, _, cerr := client.LookupCert(v.Roster, id, leaf)
+	if cerr != nil {
+		return v.unavailable(name, cerr)
+	}
+	if inclusion == nil {
+		return ErrNotLogged
+	}
+	if cb, err := certchain.ExtractCertBlock(inclusion.Block()); err != nil || cb.Type != certchain.RecordX509 {
+		return ErrNotLogged
+	}
+	status, cerr := client.RevocationStatus(v.Roster, id, leaf)
+	if cerr != nil {
+		return v.unavailable(name, cerr)
+	}
+	if status.Revoked {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// chain returns the CertChain of a server name, or nil if it has none
+func (v *Verifier) chain(name string) (skipchain.SkipBlockID, onet.ClientError) {
+	if id := v.Chain(name); id != nil || !v.ResolveNames || name == "" {
+		return id, nil
+	}
+	id, _, err := v.Client.ResolveName(v.Roster, name)
+	if err != nil && err.ErrorCode() == certchain.ErrorUnknownName {
+		return nil, nil
+	}
+	return id, err
+}
+
+// unavailable returns the error for a certificate whose proof couldn't be had, or nil if the
+// Verifier fails open
+func (v *Verifier) unavailable(name string, err onet.ClientError) error {
+	if v.Mode == FailOpen {
+		log.Warn("Accepting", name, "without CertChain proof:", err)
+		return nil
+	}
+	return errors.New("certchain: no proof for " + name + ": " + err.Error())
+}
@@ -0,0 +1,104 @@
+package verifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TinfoilHat0/certchain/internal/testutil"
+	"github.com/TinfoilHat0/certchain/merkle_tree"
+	"github.com/TinfoilHat0/certchain/service"
+	"github.com/TinfoilHat0/certchain/staple"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	testutil.MainTest(m)
+}
+
+func TestVerifier(t *testing.T) {
+	local := onet.NewTCPTest()
+	servers, roster, _ := local.GenTree(4, true)
+	defer local.CloseAll()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	der := server.Certificate().Raw
+
+	client := certchain.NewClient()
+	heartbeat := func(id skipchain.SkipBlockID) func() error {
+		return func() error {
+			_, err := client.GetHeartbeat(roster, id)
+			return err
+		}
+	}
+
+	// The CertChain of example.com logs the certificate of the server, the other one doesn't
+	kp := config.NewKeyPair(network.Suite)
+	leaf := certchain.LeafHash(der)
+	cb := client.CreateCertBlock([]crypto.HashID{leaf}, make([]byte, 32), kp)
+	sb, err := client.CreateNamedSkipchain(roster, "example.com", cb)
+	log.ErrFatal(err)
+	id := sb.Hash
+	other, err := client.CreateSkipchain(roster, client.CreateCertBlock(client.GenerateCertificates(1), make([]byte, 32), kp))
+	log.ErrFatal(err)
+	testutil.WaitHeartbeat(t, heartbeat(id))
+	testutil.WaitHeartbeat(t, heartbeat(other.Hash))
+
+	v := New(roster)
+	v.Client.Timeout = 2 * time.Second
+	v.Chains["example.com"] = id
+	get := func(v *Verifier) error {
+		transport := server.Client().Transport.(*http.Transport)
+		config := v.TLSConfig(transport.TLSClientConfig)
+		config.ServerName = "example.com"
+		_, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: config}}).Get(server.URL)
+		return err
+	}
+	assert.Nil(t, get(v))
+	v.Chains["example.com"] = other.Hash
+	assert.NotNil(t, get(v))
+	assert.Equal(t, ErrNotLogged, v.Verify("example.com", der, nil))
+
+	// The name is resolved through the roster
+	delete(v.Chains, "example.com")
+	assert.Nil(t, v.Verify("www.example.org", der, nil))
+	v.ResolveNames = true
+	assert.Nil(t, get(v))
+
+	// A revoked certificate is rejected even when failing open
+	revokedCB := client.CreateCertBlock([]crypto.HashID{leaf}, make([]byte, 32), kp)
+	revoked, err := client.CreateSkipchain(roster, revokedCB)
+	log.ErrFatal(err)
+	_, err = client.AddNewTxn(roster, revoked, client.CreateRevocationBlock([]crypto.HashID{leaf}, nil, revokedCB.LatestMTR, kp))
+	log.ErrFatal(err)
+	testutil.WaitHeartbeat(t, heartbeat(revoked.Hash))
+	v.Chains["example.com"] = revoked.Hash
+	v.Mode = FailOpen
+	assert.Equal(t, ErrRevoked, v.Verify("example.com", der, nil))
+	assert.NotNil(t, get(v))
+
+	// A stapled proof is checked without contacting the roster
+	p, perr := staple.New(client, roster, id, der)
+	log.ErrFatal(perr)
+	log.ErrFatal(staple.Attach(&server.TLS.Certificates[0], p))
+	log.ErrFatal(servers[3].Close())
+	closed := New(roster)
+	closed.Client.Retries = 0
+	closed.Client.Preferred = []network.ServerIdentityID{servers[3].ServerIdentity.ID}
+	closed.Chains["example.com"] = id
+	assert.Nil(t, get(closed))
+	// A staple without revocation status isn't enough
+	p.Revocation = nil
+	log.ErrFatal(staple.Attach(&server.TLS.Certificates[0], p))
+	assert.NotNil(t, get(closed))
+	server.TLS.Certificates[0].SignedCertificateTimestamps = nil
+	assert.NotNil(t, get(closed))
+	closed.Mode = FailOpen
+	assert.Nil(t, get(closed))
+}